@@ -0,0 +1,143 @@
+package res
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// valueCache is a least recently used cache of resource values, as
+// returned by the get handlers of a pattern, with the resource ID as key.
+type valueCache struct {
+	mu      sync.Mutex
+	size    int                                 // Maximum number of cached values
+	ttl     time.Duration                       // Time to live for cached values. Zero means no expiry
+	lru     *list.List                          // List of *cacheEntry, most recently used first
+	entries map[string]map[string]*list.Element // Elements by resource name and resource ID
+	gen     uint64                              // Generation, incremented on each invalidation
+}
+
+// cacheEntry is a cached resource value.
+type cacheEntry struct {
+	rname   string
+	rid     string
+	value   interface{}
+	expires time.Time
+}
+
+// ValueCache sets a cache for values returned by Resource.Value for
+// resources matching the pattern, holding up to size values. If ttl is
+// greater than zero, cached values expire after that duration.
+//
+// A cached value is invalidated when a change, add, remove, create, or
+// delete event, or a system.reset event, is sent for the resource. Any
+// call to Service.Reset or Service.ResetAll clears all cached values.
+// Values returned from the cache are shared, and must not be modified.
+//
+// Panics if size is less than 1.
+func ValueCache(size int, ttl time.Duration) HandlerOption {
+	if size < 1 {
+		panic("res: value cache size less than 1")
+	}
+	return func(hs *Handler) {
+		hs.ValueCacheSize = size
+		hs.ValueCacheTTL = ttl
+	}
+}
+
+// newValueCache creates a new value cache.
+func newValueCache(size int, ttl time.Duration) *valueCache {
+	return &valueCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]map[string]*list.Element),
+	}
+}
+
+// get returns the cached value for the resource ID, and true if found.
+// The current generation is also returned, to be passed to set.
+func (c *valueCache) get(rname, rid string) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[rname][rid]
+	if !ok {
+		return nil, c.gen, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, c.gen, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, c.gen, true
+}
+
+// set caches the value for the resource ID, unless the cache has been
+// invalidated since generation gen was returned by get.
+func (c *valueCache) set(rname, rid string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[rname][rid]; ok {
+		c.remove(el)
+	}
+	if c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	e := &cacheEntry{rname: rname, rid: rid, value: value}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	m, ok := c.entries[rname]
+	if !ok {
+		m = make(map[string]*list.Element)
+		c.entries[rname] = m
+	}
+	m[rid] = c.lru.PushFront(e)
+}
+
+// invalidate removes any cached values for the resource name, including
+// those of query resources.
+func (c *valueCache) invalidate(rname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, el := range c.entries[rname] {
+		c.lru.Remove(el)
+	}
+	delete(c.entries, rname)
+}
+
+// clear removes all cached values.
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.entries = make(map[string]map[string]*list.Element)
+}
+
+// remove removes the element from the cache.
+// The mu lock must be held when calling remove.
+func (c *valueCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	m := c.entries[e.rname]
+	delete(m, e.rid)
+	if len(m) == 0 {
+		delete(c.entries, e.rname)
+	}
+}
+
+// clearValueCaches clears the value caches of all patterns.
+func (s *Service) clearValueCaches() {
+	s.pmu.RLock()
+	defer s.pmu.RUnlock()
+	s.patterns.walk(func(_ string, hs *regHandler) {
+		if hs.cache != nil {
+			hs.cache.clear()
+		}
+	})
+}
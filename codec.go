@@ -44,3 +44,16 @@ type resetEvent struct {
 type tokenEvent struct {
 	Token interface{} `json:"token"`
 }
+
+type queryEvent struct {
+	Subject string `json:"subject"`
+}
+
+type queryResponse struct {
+	Events []resEvent `json:"events"`
+}
+
+type resEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
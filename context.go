@@ -0,0 +1,101 @@
+package res
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The default duration before a requester times out a request, matching
+// the default request timeout of Resgate.
+const defaultRequestTimeout = 3 * time.Second
+
+// requestContext is the context of a request. It is cancelled when the
+// service is shut down, when the request is done, or when the deadline is
+// exceeded. Unlike a context created by context.WithDeadline, the deadline
+// may be extended by calling setTimeout.
+type requestContext struct {
+	context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	exceeded bool
+}
+
+// SetRequestTimeout sets the duration before a requester times out a
+// request, used to set the deadline of the request context. It should
+// match the request timeout setting of the gateways. Defaults to 3 seconds.
+//
+// Panics if d is not greater than zero, or if service is already started.
+func (s *Service) SetRequestTimeout(d time.Duration) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if d <= 0 {
+		panic("res: request timeout not greater than zero")
+	}
+
+	s.requestTimeout = d
+	return s
+}
+
+// newRequestContext creates a new request context with a deadline set to
+// start plus d.
+func newRequestContext(parent context.Context, start time.Time, d time.Duration) *requestContext {
+	ctx, cancel := context.WithCancel(parent)
+	c := &requestContext{
+		Context:  ctx,
+		cancel:   cancel,
+		deadline: start.Add(d),
+	}
+	c.timer = time.AfterFunc(time.Until(c.deadline), c.expire)
+	return c
+}
+
+// Deadline returns the current deadline of the request.
+func (c *requestContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline, true
+}
+
+// Err returns context.DeadlineExceeded if the deadline was exceeded, or
+// otherwise the error of the underlying context.
+func (c *requestContext) Err() error {
+	c.mu.Lock()
+	exceeded := c.exceeded
+	c.mu.Unlock()
+	if exceeded {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// setTimeout sets the deadline to d from now, unless the context is
+// already done.
+func (c *requestContext) setTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exceeded || c.Context.Err() != nil || !c.timer.Stop() {
+		return
+	}
+	c.deadline = time.Now().Add(d)
+	c.timer.Reset(d)
+}
+
+// expire cancels the context as the deadline is exceeded.
+func (c *requestContext) expire() {
+	c.mu.Lock()
+	if c.Context.Err() == nil {
+		c.exceeded = true
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+// done cancels the context as the request is done.
+func (c *requestContext) done() {
+	c.timer.Stop()
+	c.cancel()
+}
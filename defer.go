@@ -0,0 +1,318 @@
+package res
+
+import (
+	"sync"
+	"time"
+)
+
+// Responder sends the deferred response to a request, as returned by the
+// request's Defer method. It may be used from any goroutine.
+//
+// Only the first response is sent. Any later response is ignored. Panics
+// while sending the response are recovered and handled as for a panic
+// inside the handler.
+//
+// Until the response is sent, the timeout of the request is extended
+// automatically to prevent the requester from timing out the request, for
+// at most one minute after the response was deferred. Use Timeout to
+// set a later deadline. The automatic extension does not extend any
+// handler timeout.
+type Responder struct {
+	r           deferrable
+	mu          sync.Mutex
+	replied     bool
+	timer       *time.Timer   // Timer for extending the request timeout
+	extendUntil time.Time     // Time after which the request timeout is no longer extended
+	done        chan struct{} // Closed once the response is sent
+	onDone      func()        // Called once the response is sent
+}
+
+// The maximum duration the request timeout of a deferred response is
+// extended automatically.
+const maxDeferExtension = time.Minute
+
+// deferrable is a request with a response that may be deferred.
+type deferrable interface {
+	Model(model interface{})
+	QueryModel(model interface{}, query string)
+	Collection(collection interface{})
+	QueryCollection(collection interface{}, query string)
+	NotFound()
+	Error(err *Error)
+	Timeout(d time.Duration)
+	handlePanic(v interface{})
+}
+
+// Defer defers the response to the request, returning a Responder used to
+// send the response once it is available. Once deferred, the handler may
+// return without responding, freeing the worker to handle other requests
+// and callbacks for the resource.
+//
+// The request context is cancelled once the response is sent, instead of
+// when the handler returns.
+//
+// Panics if a response is already sent, or if the request is already
+// deferred.
+func (r *Request) Defer() *Responder {
+	if r.rtype == "query" {
+		panic("res: defer on query request")
+	}
+	if r.responder != nil {
+		panic("res: request already deferred")
+	}
+	if r.replied {
+		panic("res: response already sent on request")
+	}
+
+	// The responder uses a copy of the request, to avoid any data race with
+	// the request still used by the handler.
+	c := *r
+	s := r.s
+	p := newResponder(&c, nil)
+	p.onDone = func() {
+		c.rctx.done()
+		s.mu.Lock()
+		delete(s.deferred, p)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.deferred[p] = true
+	s.mu.Unlock()
+
+	p.mu.Lock()
+	if r.ht != nil && !r.ht.deferTo(p) {
+		// The handler timeout has already expired and been responded to.
+		p.replied = true
+		p.complete()
+	} else {
+		p.extendUntil = time.Now().Add(maxDeferExtension)
+		p.timer = time.AfterFunc(p.nextExtension(), p.extend)
+	}
+	p.mu.Unlock()
+
+	r.responder = p
+	return p
+}
+
+// Defer defers the response to the get request made by Value, which waits
+// for the response to be sent.
+//
+// Value blocks the worker of the resource until the response is sent. The
+// response must not depend on any callback queued for the same resource
+// or group, such as one passed to Service.With, as that callback will not
+// be called until Value returns. Set a handler timeout to have Value fail
+// with ErrTimeout instead of blocking indefinitely.
+//
+// Panics if a response is already sent, or if the request is already
+// deferred.
+func (r *getRequest) Defer() *Responder {
+	if r.responder != nil {
+		panic("res: get request already deferred")
+	}
+	if r.replied {
+		panic("res: response already sent on get request")
+	}
+
+	c := *r
+	p := newResponder(&c, nil)
+	if r.ht != nil && !r.ht.deferTo(p) {
+		p.replied = true
+		p.complete()
+	}
+	r.responder = p
+	return p
+}
+
+func newResponder(r deferrable, onDone func()) *Responder {
+	return &Responder{
+		r:      r,
+		done:   make(chan struct{}),
+		onDone: onDone,
+	}
+}
+
+// OK sends a successful result response to the deferred request.
+// Only valid for call and auth requests.
+func (p *Responder) OK(result interface{}) {
+	p.respond(func(r deferrable) { p.request().OK(result) })
+}
+
+// Error sends a custom error response to the deferred request.
+func (p *Responder) Error(err *Error) {
+	p.respond(func(r deferrable) { r.Error(err) })
+}
+
+// NotFound sends a system.notFound response to the deferred request.
+func (p *Responder) NotFound() {
+	p.respond(func(r deferrable) { r.NotFound() })
+}
+
+// MethodNotFound sends a system.methodNotFound response to the deferred
+// request.
+// Only valid for call and auth requests.
+func (p *Responder) MethodNotFound() {
+	p.respond(func(r deferrable) { p.request().MethodNotFound() })
+}
+
+// InvalidParams sends a system.invalidParams response to the deferred
+// request. An empty message will default to "Invalid parameters".
+// Only valid for call and auth requests.
+func (p *Responder) InvalidParams(message string) {
+	p.respond(func(r deferrable) { p.request().InvalidParams(message) })
+}
+
+// Model sends a successful model response to the deferred request.
+// Only valid for get requests for a model resource.
+func (p *Responder) Model(model interface{}) {
+	p.respond(func(r deferrable) { r.Model(model) })
+}
+
+// QueryModel sends a successful query model response to the deferred
+// request.
+// Only valid for get requests for a model query resource.
+func (p *Responder) QueryModel(model interface{}, query string) {
+	p.respond(func(r deferrable) { r.QueryModel(model, query) })
+}
+
+// Collection sends a successful collection response to the deferred
+// request.
+// Only valid for get requests for a collection resource.
+func (p *Responder) Collection(collection interface{}) {
+	p.respond(func(r deferrable) { r.Collection(collection) })
+}
+
+// QueryCollection sends a successful query collection response to the
+// deferred request.
+// Only valid for get requests for a collection query resource.
+func (p *Responder) QueryCollection(collection interface{}, query string) {
+	p.respond(func(r deferrable) { r.QueryCollection(collection, query) })
+}
+
+// New sends a successful response for the deferred new call request.
+// Only valid for new call requests.
+func (p *Responder) New(rid Ref) {
+	p.respond(func(r deferrable) { p.request().New(rid) })
+}
+
+// Access sends a successful response to the deferred access request.
+// Only valid for access requests.
+func (p *Responder) Access(get bool, call string) {
+	p.respond(func(r deferrable) { p.request().Access(get, call) })
+}
+
+// AccessDenied sends a system.accessDenied response to the deferred access
+// request.
+// Only valid for access requests.
+func (p *Responder) AccessDenied() {
+	p.respond(func(r deferrable) { p.request().AccessDenied() })
+}
+
+// AccessGranted sends a successful response to the deferred access
+// request, granting full access.
+// Only valid for access requests.
+func (p *Responder) AccessGranted() {
+	p.respond(func(r deferrable) { p.request().AccessGranted() })
+}
+
+// Timeout attempts to set the timeout duration of the deferred request.
+// The automatic extension of the timeout continues from the new deadline.
+// The call has no effect if the response is already sent.
+func (p *Responder) Timeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.replied {
+		return
+	}
+	p.r.Timeout(d)
+	if p.timer != nil {
+		p.timer.Reset(p.nextExtension())
+	}
+}
+
+// request returns the deferred request, or panics if it is a get request
+// made by Value.
+func (p *Responder) request() *Request {
+	r, ok := p.r.(*Request)
+	if !ok {
+		panic("res: invalid response on get request")
+	}
+	return r
+}
+
+// respond calls f to send the response, unless a response is already sent.
+func (p *Responder) respond(f func(r deferrable)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.replied {
+		if r, ok := p.r.(*Request); ok {
+			r.s.Debugf("response already sent on deferred request %s", r.msg.Subject)
+		}
+		return
+	}
+	p.replied = true
+	defer p.complete()
+	defer func() {
+		if v := recover(); v != nil {
+			p.r.handlePanic(v)
+		}
+	}()
+	f(p.r)
+}
+
+// panicked handles a value recovered from a panic inside the handler after
+// the response was deferred, sending an error response unless a response
+// is already sent.
+func (p *Responder) panicked(v interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.replied {
+		p.replied = true
+		defer p.complete()
+	}
+	p.r.handlePanic(v)
+}
+
+// complete stops any timeout extension, and signals that the response is
+// sent. The mutex must be held when calling complete.
+func (p *Responder) complete() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	close(p.done)
+	if p.onDone != nil {
+		p.onDone()
+	}
+}
+
+// stop stops any timeout extension, as the service is stopped.
+func (p *Responder) stop() {
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.mu.Unlock()
+}
+
+// nextExtension returns the duration until the request timeout should be
+// extended, which is halfway to the current deadline.
+func (p *Responder) nextExtension() time.Duration {
+	deadline, _ := p.request().rctx.Deadline()
+	return time.Until(deadline) / 2
+}
+
+// extend extends the request timeout, unless a response is already sent,
+// the request context is done, or the maximum extension is reached.
+func (p *Responder) extend() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.request()
+	if p.replied || r.rctx.Err() != nil {
+		return
+	}
+	if time.Now().After(p.extendUntil) {
+		r.s.Debugf("deferred request %s no longer extended: maximum extension reached", r.msg.Subject)
+		return
+	}
+	r.timeout(r.s.requestTimeout)
+	p.timer.Reset(p.nextExtension())
+}
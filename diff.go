@@ -0,0 +1,201 @@
+package res
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// The maximum number of cells in the table used by diffCollection to find
+// the longest common subsequence.
+const maxDiffCells = 1 << 20
+
+var (
+	errNotJSONObject = errors.New("res: model does not marshal into a JSON object")
+	errNotJSONArray  = errors.New("res: collection does not marshal into a JSON array")
+)
+
+// DiffModel compares two model values and returns the properties that
+// has changed, mapped to their new values. Properties missing in the new
+// model are mapped to DeleteAction. The result may be used as payload for
+// a change event.
+//
+// The models may be structs, using json struct tags, maps, or any other
+// value that marshals into a JSON object. A nil model is treated as a
+// model without properties. Property values are compared by their JSON
+// encoding, so that resource references (Ref) are compared by resource ID.
+//
+// If no properties has changed, an empty map is returned.
+// Returns an error if either model fails to marshal into a JSON object.
+func DiffModel(oldModel, newModel interface{}) (map[string]interface{}, error) {
+	a, err := modelProps(oldModel)
+	if err != nil {
+		return nil, err
+	}
+	b, err := modelProps(newModel)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]interface{})
+	for k, bv := range b {
+		av, ok := a[k]
+		if !ok || !equalJSON(av, bv) {
+			changed[k] = bv
+		}
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			changed[k] = DeleteAction
+		}
+	}
+	return changed, nil
+}
+
+// modelProps marshals a model and returns its JSON encoded properties.
+func modelProps(model interface{}) (map[string]json.RawMessage, error) {
+	if model == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	var props map[string]json.RawMessage
+	if json.Unmarshal(data, &props) != nil {
+		return nil, errNotJSONObject
+	}
+	return props, nil
+}
+
+// collectionValues marshals a collection and returns its JSON encoded values.
+func collectionValues(collection interface{}) ([]json.RawMessage, error) {
+	data, err := json.Marshal(collection)
+	if err != nil {
+		return nil, err
+	}
+	var values []json.RawMessage
+	if len(data) == 0 || data[0] != '[' || json.Unmarshal(data, &values) != nil {
+		return nil, errNotJSONArray
+	}
+	return values, nil
+}
+
+// equalJSON reports whether two JSON encoded values are equal, disregarding
+// insignificant whitespace and object key order. Numbers are compared by
+// their encoding, to not lose precision of large integers.
+func equalJSON(a, b json.RawMessage) bool {
+	var av, bv interface{}
+	if decodeJSON(a, &av) != nil || decodeJSON(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// decodeJSON unmarshals the JSON encoded data into v, decoding numbers as
+// json.Number.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// collectionEvent is an add or remove event produced by diffCollection.
+type collectionEvent struct {
+	add   bool
+	value interface{}
+	idx   int
+}
+
+// diffCollection returns a minimal sequence of add and remove events that
+// transforms the old collection into the new one, based on the longest
+// common subsequence. Values are compared by their JSON encoding.
+// The idx of each event is the index in the collection at the time the
+// event is applied.
+//
+// If the changed parts of the collections are too large to compare within
+// maxDiffCells, all changed values are removed and the new values added.
+func diffCollection(oldCol, newCol []interface{}) ([]collectionEvent, error) {
+	a, err := encodeValues(oldCol)
+	if err != nil {
+		return nil, err
+	}
+	b, err := encodeValues(newCol)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip common prefix and suffix
+	s := 0
+	for s < len(a) && s < len(b) && a[s] == b[s] {
+		s++
+	}
+	ea, eb := len(a), len(b)
+	for ea > s && eb > s && a[ea-1] == b[eb-1] {
+		ea--
+		eb--
+	}
+	a, b = a[s:ea], b[s:eb]
+	n, m := len(a), len(b)
+
+	if n*m > maxDiffCells {
+		evs := make([]collectionEvent, 0, n+m)
+		for i := 0; i < n; i++ {
+			evs = append(evs, collectionEvent{idx: s})
+		}
+		for j := 0; j < m; j++ {
+			evs = append(evs, collectionEvent{add: true, value: newCol[s+j], idx: s + j})
+		}
+		return evs, nil
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var evs []collectionEvent
+	i, j, k := 0, 0, s
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			i++
+			j++
+			k++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			evs = append(evs, collectionEvent{idx: k})
+			i++
+		default:
+			evs = append(evs, collectionEvent{add: true, value: newCol[s+j], idx: k})
+			j++
+			k++
+		}
+	}
+	return evs, nil
+}
+
+// encodeValues returns the JSON encoding of each value as a string.
+func encodeValues(vs []interface{}) ([]string, error) {
+	enc := make([]string, len(vs))
+	for i, v := range vs {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		enc[i] = string(data)
+	}
+	return enc, nil
+}
@@ -116,6 +116,15 @@ s.Handle("mymodel",
 	}),
 )
 
+Add middleware for all handlers:
+
+	s.Use(func(next res.RequestHandler) res.RequestHandler {
+		return func(r *res.Request) {
+			log.Printf("%s request for %s", r.Type(), r.ResourceName())
+			next(r)
+		}
+	})
+
 Start service:
 
 	s.ListenAndServe("nats://localhost:4222")
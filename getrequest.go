@@ -11,35 +11,41 @@ import (
 // the reply values in memory.
 type getRequest struct {
 	*resource
-	replied bool // Flag telling if a reply has been made
-	value   interface{}
-	err     error
+	replied   bool            // Flag telling if a reply has been made
+	responder *Responder      // Responder of a deferred response
+	ht        *handlerTimeout // Handler timeout. Nil if no timeout is set
+	value     interface{}
+	err       error
 }
 
 func (r *getRequest) Model(model interface{}) {
-	r.reply()
-	r.value = model
+	if r.reply() {
+		r.value = model
+	}
 }
 
 func (r *getRequest) QueryModel(model interface{}, query string) {
 	if query != "" && r.query == "" {
 		panic("res: query model response on non-query get request")
 	}
-	r.reply()
-	r.value = model
+	if r.reply() {
+		r.value = model
+	}
 }
 
 func (r *getRequest) Collection(collection interface{}) {
-	r.reply()
-	r.value = collection
+	if r.reply() {
+		r.value = collection
+	}
 }
 
 func (r *getRequest) QueryCollection(collection interface{}, query string) {
 	if query != "" && r.query == "" {
 		panic("res: query model response on non-query get request")
 	}
-	r.reply()
-	r.value = collection
+	if r.reply() {
+		r.value = collection
+	}
 }
 
 func (r *getRequest) NotFound() {
@@ -47,61 +53,53 @@ func (r *getRequest) NotFound() {
 }
 
 func (r *getRequest) Error(err *Error) {
-	r.reply()
-	r.err = err
+	if r.reply() {
+		r.err = err
+	}
 }
 
 func (r *getRequest) Timeout(d time.Duration) {
-	// Implement once an internal timeout for requests is implemented
+	if d < 0 {
+		panic("res: negative timeout duration")
+	}
+	if r.ht != nil {
+		r.ht.extend(d)
+	}
 }
 
-func (r *getRequest) reply() {
+// reply marks the get request as replied. Returns false if the handler
+// timeout has expired, in which case the error is set to ErrTimeout, and
+// the response should be ignored.
+func (r *getRequest) reply() bool {
+	if r.responder != nil {
+		panic("res: response on deferred get request")
+	}
 	if r.replied {
 		panic("res: response already sent on get request")
 	}
 	r.replied = true
+	if r.ht != nil && !r.ht.reply() {
+		r.err = ErrTimeout
+		return false
+	}
+	return true
 }
 
 func (r *getRequest) executeHandler() {
+	if d := r.s.handlerTimeoutFor(r.hs); d > 0 {
+		r.ht = r.s.newHandlerTimeout(d, func(bool) {
+			r.s.Logf("handler timeout: get request for %s, called by Value", r.rname)
+		})
+	}
+	defer r.wait()
+
 	r.inGet = true
 	// Recover from panics inside handlers
 	defer func() {
 		r.inGet = false
-
-		v := recover()
-		if v == nil {
-			return
+		if v := recover(); v != nil {
+			r.handlePanic(v)
 		}
-
-		var str string
-
-		switch e := v.(type) {
-		case *Error:
-			if !r.replied {
-				r.Error(e)
-				// Return without logging as panicing with a *Error is considered
-				// a valid way of sending an error response.
-				return
-			}
-			str = e.Message
-		case error:
-			str = e.Error()
-			if !r.replied {
-				r.Error(ToError(e))
-			}
-		case string:
-			str = e
-			if !r.replied {
-				r.Error(ToError(errors.New(e)))
-			}
-		default:
-			str = fmt.Sprintf("%v", e)
-			if !r.replied {
-				r.Error(ToError(errors.New(str)))
-			}
-		}
-
-		r.s.Logf("error handling get request %#v: %s", r.rname, str)
 	}()
 
 	hs := r.hs
@@ -115,7 +113,60 @@ func (r *getRequest) executeHandler() {
 		return
 	}
 
-	if !r.replied {
+	if !r.replied && r.responder == nil {
 		r.Error(InternalError(fmt.Errorf("missing response on get request for %#v", r.rname)))
 	}
 }
+
+// handlePanic sets an error response for a value recovered from a panic
+// inside a get handler, unless a response is already set, and logs the
+// error.
+func (r *getRequest) handlePanic(v interface{}) {
+	if r.responder != nil {
+		r.responder.panicked(v)
+		return
+	}
+
+	var str string
+
+	switch e := v.(type) {
+	case *Error:
+		if !r.replied {
+			r.Error(e)
+			// Return without logging as panicing with a *Error is considered
+			// a valid way of sending an error response.
+			return
+		}
+		str = e.Message
+	case error:
+		str = e.Error()
+		if !r.replied {
+			r.Error(ToError(e))
+		}
+	case string:
+		str = e
+		if !r.replied {
+			r.Error(ToError(errors.New(e)))
+		}
+	default:
+		str = fmt.Sprintf("%v", e)
+		if !r.replied {
+			r.Error(ToError(errors.New(str)))
+		}
+	}
+
+	r.s.Logf("error handling get request %#v: %s", r.rname, str)
+}
+
+// wait waits for any deferred response to be sent, and sets the response
+// value and error.
+func (r *getRequest) wait() {
+	p := r.responder
+	if p == nil {
+		return
+	}
+	<-p.done
+	dr := p.r.(*getRequest)
+	r.value = dr.value
+	r.err = dr.err
+}
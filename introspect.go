@@ -0,0 +1,62 @@
+package res
+
+import "sort"
+
+// PatternInfo describes a registered resource pattern and its handlers.
+type PatternInfo struct {
+	// Pattern is the full resource pattern, including the service name.
+	Pattern string `json:"pattern"`
+
+	// Type is the resource type. Either "model", "collection", or empty if
+	// no get handler is registered.
+	Type string `json:"type,omitempty"`
+
+	// Params contains the names of the path parameters, in the order they
+	// appear in the pattern.
+	Params []string `json:"params,omitempty"`
+
+	// Group is the group the resource belongs to, if set.
+	Group string `json:"group,omitempty"`
+
+	// Access is true if the pattern has an access handler.
+	Access bool `json:"access"`
+
+	// Call contains the sorted names of the call methods, excluding new.
+	Call []string `json:"call,omitempty"`
+
+	// New is true if the pattern has a new handler.
+	New bool `json:"new"`
+
+	// Auth contains the sorted names of the auth methods.
+	Auth []string `json:"auth,omitempty"`
+}
+
+// Patterns returns information on all registered resource patterns
+// and their handlers, sorted by pattern.
+func (s *Service) Patterns() []PatternInfo {
+	var pis []PatternInfo
+	s.pmu.RLock()
+	s.patterns.walk(func(pattern string, hs *regHandler) {
+		pi := PatternInfo{
+			Pattern: pattern,
+			Type:    hs.typ.String(),
+			Params:  patternParams(pattern),
+			Group:   hs.Group,
+			Access:  hs.Access != nil,
+			New:     hs.New != nil,
+		}
+		for m := range hs.Call {
+			pi.Call = append(pi.Call, m)
+		}
+		for m := range hs.Auth {
+			pi.Auth = append(pi.Auth, m)
+		}
+		sort.Strings(pi.Call)
+		sort.Strings(pi.Auth)
+		pis = append(pis, pi)
+	})
+	s.pmu.RUnlock()
+
+	sort.Slice(pis, func(i, j int) bool { return pis[i].Pattern < pis[j].Pattern })
+	return pis
+}
@@ -0,0 +1,53 @@
+package res
+
+// RequestHandler is a function called to handle an incoming request.
+// The request may be type asserted to the request interface matching its
+// type and method, such as AccessRequest, ModelRequest, CollectionRequest,
+// CallRequest, NewRequest, or AuthRequest.
+type RequestHandler func(r *Request)
+
+// MiddlewareFunc is a function that wraps a RequestHandler, returning a new
+// RequestHandler. The middleware may inspect the request, using Type and
+// Method, before and after calling the next handler.
+//
+// To short-circuit the request, the middleware may send a response, such as
+// calling r.Error(err), without calling next. Panicking with an *Error has the
+// same effect.
+type MiddlewareFunc func(next RequestHandler) RequestHandler
+
+// Use adds middleware to the service. The middleware wraps all Access, Get,
+// Call, New, and Auth handlers of all registered patterns.
+//
+// Service middleware is called in the order it is added, before any pattern
+// middleware set with the Middleware handler option.
+// Panics if service is already started.
+func (s *Service) Use(mw ...MiddlewareFunc) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	s.middleware = append(s.middleware, mw...)
+	return s
+}
+
+// Middleware adds middleware for the resource pattern. The middleware wraps
+// the Access, Get, Call, New, and Auth handlers of the pattern.
+//
+// Pattern middleware is called in the order it is added, after any service
+// middleware added with Use.
+func Middleware(mw ...MiddlewareFunc) HandlerOption {
+	return func(hs *Handler) {
+		hs.Middleware = append(hs.Middleware, mw...)
+	}
+}
+
+// wrapHandler wraps the handler h with the service middleware followed by
+// the pattern middleware, mw. The first middleware will be the outermost.
+func (s *Service) wrapHandler(h RequestHandler, mw []MiddlewareFunc) RequestHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
@@ -0,0 +1,328 @@
+package res
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OutboxEvent is an event held by the outbox while it could not be published.
+type OutboxEvent struct {
+	Subject string `json:"subject"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// OutboxLog is a write-ahead log used by the outbox to persist unpublished
+// events, so that they may be published after a restart of the service.
+type OutboxLog interface {
+	// Append adds an event to the end of the log.
+	Append(ev OutboxEvent) error
+
+	// Load returns all events in the log, in the order they were appended.
+	Load() ([]OutboxEvent, error)
+
+	// Truncate removes all events from the log.
+	Truncate() error
+}
+
+// outbox holds events that could not be published while disconnected.
+type outbox struct {
+	mu       sync.Mutex
+	size     int             // Maximum number of events held
+	log      OutboxLog       // Optional write-ahead log
+	offline  bool            // Flag telling if the connection is lost
+	events   []OutboxEvent   // Events waiting to be published
+	dropped  map[string]bool // Resource names of events dropped on overflow
+	resetAll bool            // Flag telling if a full reset is needed on flush
+}
+
+// SetOutbox enables the outbox, holding up to size events that could not
+// be published while disconnected from NATS Server. Once reconnected, the
+// events are published in order, instead of resetting all resources.
+//
+// Only resource events and system.reset events are held by the outbox.
+// Other messages, such as connection token events and request replies,
+// are published directly, and are lost if the publish fails.
+//
+// If the outbox overflows, the oldest events are dropped. On flush, the
+// remaining events of any resource with dropped events are discarded, and
+// a system.reset event is sent for those resources instead.
+//
+// If log is not nil, unpublished events are also appended to the
+// write-ahead log, and any events in the log are published when the
+// service is started.
+//
+// Panics if size is less than 1, or if service is already started.
+func (s *Service) SetOutbox(size int, log OutboxLog) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if size < 1 {
+		panic("res: outbox size less than 1")
+	}
+
+	s.outbox = &outbox{size: size, log: log}
+	return s
+}
+
+// publish publishes the payload on a subject. Resource events and
+// system.reset events are held in the outbox if the service is
+// disconnected, if there are earlier unpublished events, or if the publish
+// fails.
+//
+// Returns an error if the service is stopped.
+func (s *Service) publish(subj string, payload []byte) error {
+	s.nmu.RLock()
+	defer s.nmu.RUnlock()
+	if s.nc == nil {
+		return errNotStarted
+	}
+
+	o := s.outbox
+	if o == nil || !isOutboxSubject(subj) {
+		return s.nc.Publish(subj, payload)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.offline && o.flush(s) {
+		err := s.nc.Publish(subj, payload)
+		if err == nil {
+			return nil
+		}
+		s.Debugf("error sending event %s, holding it in outbox: %s", subj, err)
+	}
+	o.add(s, OutboxEvent{Subject: subj, Payload: payload})
+	return nil
+}
+
+// loadOutbox adds any events in the outbox log to the outbox, and
+// publishes them.
+func (s *Service) loadOutbox() {
+	o := s.outbox
+	if o == nil || o.log == nil {
+		return
+	}
+
+	evs, err := o.log.Load()
+	if err != nil {
+		s.Logf("error loading outbox log: %s", err)
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, ev := range evs {
+		if !isOutboxSubject(ev.Subject) {
+			s.Logf("discarding event %s from outbox log: not a resource or reset event", ev.Subject)
+			continue
+		}
+		o.push(ev)
+	}
+	o.flush(s)
+}
+
+// setOutboxOffline sets the offline flag of the outbox.
+// If offline is false, any events in the outbox are published.
+// Returns false if there is no outbox.
+func (s *Service) setOutboxOffline(offline bool) bool {
+	o := s.outbox
+	if o == nil {
+		return false
+	}
+
+	s.nmu.RLock()
+	defer s.nmu.RUnlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offline = offline
+	if !offline && s.nc != nil {
+		o.flush(s)
+	}
+	return true
+}
+
+// add adds an event to the outbox, and appends it to the log.
+// The mu lock must be held when calling add.
+func (o *outbox) add(s *Service, ev OutboxEvent) {
+	if o.log != nil {
+		if err := o.log.Append(ev); err != nil {
+			s.Logf("error appending event %s to outbox log: %s", ev.Subject, err)
+		}
+	}
+	o.push(ev)
+}
+
+// push adds an event to the outbox, dropping the oldest event on overflow.
+// A dropped event is replaced by a reset on flush.
+// The mu lock must be held when calling push.
+func (o *outbox) push(ev OutboxEvent) {
+	if len(o.events) >= o.size {
+		dev := o.events[0]
+		o.events = o.events[1:]
+		if rname := eventResource(dev.Subject); rname != "" {
+			if o.dropped == nil {
+				o.dropped = make(map[string]bool)
+			}
+			o.dropped[rname] = true
+		} else {
+			o.resetAll = true
+		}
+	}
+	o.events = append(o.events, ev)
+}
+
+// flush publishes the events in the outbox in order, followed by a
+// system.reset event for any resources with dropped events.
+// Returns true if the outbox was emptied, or false if a publish failed.
+// The mu lock must be held when calling flush.
+func (o *outbox) flush(s *Service) bool {
+	if len(o.events) == 0 && o.dropped == nil && !o.resetAll {
+		return true
+	}
+
+	for len(o.events) > 0 {
+		ev := o.events[0]
+		if !o.dropped[eventResource(ev.Subject)] {
+			s.Tracef("<-- %s: %s", ev.Subject, ev.Payload)
+			if err := s.nc.Publish(ev.Subject, ev.Payload); err != nil {
+				s.Logf("error flushing outbox event %s: %s", ev.Subject, err)
+				return false
+			}
+		}
+		o.events = o.events[1:]
+	}
+	o.events = nil
+
+	if o.resetAll || len(o.dropped) > 0 {
+		var ev resetEvent
+		if o.resetAll {
+			s.Logf("outbox overflow, resetting all resources")
+			ev = s.resetAllEvent()
+		} else {
+			rnames := make([]string, 0, len(o.dropped))
+			for rname := range o.dropped {
+				rnames = append(rnames, rname)
+			}
+			sort.Strings(rnames)
+			s.Logf("outbox overflow, resetting %d resource(s)", len(rnames))
+			ev.Resources = rnames
+			s.pmu.RLock()
+			if s.withAccess {
+				ev.Access = rnames
+			}
+			s.pmu.RUnlock()
+		}
+		s.refs.reset(ev.Resources)
+		data, _ := json.Marshal(ev)
+		s.Tracef("<-- system.reset: %s", data)
+		if err := s.nc.Publish("system.reset", data); err != nil {
+			s.Logf("error flushing outbox event system.reset: %s", err)
+			return false
+		}
+	}
+	o.dropped = nil
+	o.resetAll = false
+
+	if o.log != nil {
+		if err := o.log.Truncate(); err != nil {
+			s.Logf("error truncating outbox log: %s", err)
+		}
+	}
+	return true
+}
+
+// isOutboxSubject reports whether events published on the subject are held
+// by the outbox. Only events that can be recovered with a reset, if
+// dropped, are held.
+func isOutboxSubject(subj string) bool {
+	return subj == "system.reset" || eventResource(subj) != ""
+}
+
+// eventResource returns the resource name of a resource event subject,
+// or empty string if the subject is not a resource event.
+func eventResource(subj string) string {
+	if !strings.HasPrefix(subj, "event.") {
+		return ""
+	}
+	subj = subj[len("event."):]
+	idx := strings.LastIndexByte(subj, '.')
+	if idx < 0 {
+		return ""
+	}
+	return subj[:idx]
+}
+
+// FileOutboxLog is an OutboxLog storing the events in a file, with one JSON
+// encoded event per line.
+type FileOutboxLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileOutboxLog opens the file at path, creating it if it does not
+// exist, and returns a FileOutboxLog using the file.
+func NewFileOutboxLog(path string) (*FileOutboxLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOutboxLog{f: f}, nil
+}
+
+// Append writes the event to the end of the file, and syncs the file to
+// stable storage.
+func (l *FileOutboxLog) Append(ev OutboxEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Load reads all events from the file.
+// An incomplete last line, caused by an interrupted write, is ignored.
+func (l *FileOutboxLog) Load() ([]OutboxEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	var evs []OutboxEvent
+	sc := bufio.NewScanner(l.f)
+	sc.Buffer(nil, 1<<26)
+	for sc.Scan() {
+		var ev OutboxEvent
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			break
+		}
+		evs = append(evs, ev)
+	}
+	return evs, sc.Err()
+}
+
+// Truncate removes all events from the file.
+func (l *FileOutboxLog) Truncate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Truncate(0)
+}
+
+// Close closes the file.
+func (l *FileOutboxLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -1,11 +1,14 @@
 package res
 
+import "strings"
+
 // Code inspired, and partly borrowed, from SubList in gnatsd
 // https://github.com/nats-io/gnatsd/blob/master/server/sublist.go
 
 // Common byte variables for wildcards and token separator.
 const (
 	pmark = '$'
+	fwc   = '>'
 	btsep = '.'
 )
 
@@ -20,16 +23,19 @@ type patterns struct {
 // to the next nodes, including wildcards.
 // Only one instance of handlers may exist per node.
 type node struct {
-	hs     *regHandler // Handlers on this node
-	params []pathParam // path parameters for the handlers
-	nodes  map[string]*node
-	param  *node
+	hs      *regHandler // Handlers on this node
+	pattern string      // pattern of the handlers
+	params  []pathParam // path parameters for the handlers
+	nodes   map[string]*node
+	param   *node
+	wild    *node // Full wildcard node matching all remaining tokens
 }
 
 // A pathParam represent a parameter part of the resource name.
 type pathParam struct {
 	name string // name of the parameter
 	idx  int    // token index of the parameter
+	wild bool   // flag telling if the parameter captures all remaining tokens
 }
 
 // Matchin handlers instance to a resource name
@@ -39,20 +45,12 @@ type nodeMatch struct {
 }
 
 // add inserts new handlers to the pattern store.
+// A full wildcard, either a single greater than (>) character or a
+// placeholder name followed by one, such as "$path>", may only be used
+// as the last token of the pattern.
 // An invalid pattern, or a pattern already registered will make add panic.
 func (ls *patterns) add(pattern string, hs *regHandler) {
-	var tokens []string
-	if len(pattern) > 0 {
-		tokens = make([]string, 0, 32)
-		start := 0
-		for i := 0; i < len(pattern); i++ {
-			if pattern[i] == btsep {
-				tokens = append(tokens, pattern[start:i])
-				start = i + 1
-			}
-		}
-		tokens = append(tokens, pattern[start:])
-	}
+	tokens := splitTokens(pattern)
 	var params []pathParam
 
 	l := ls.root
@@ -64,7 +62,28 @@ func (ls *patterns) add(pattern string, hs *regHandler) {
 			panic(invalidPattern)
 		}
 
-		if t[0] == pmark {
+		if t[lt-1] == fwc {
+			// Full wildcard must be the last token
+			if i < len(tokens)-1 {
+				panic(invalidPattern)
+			}
+			if lt > 1 {
+				if t[0] != pmark || lt == 2 {
+					panic(invalidPattern)
+				}
+				name := t[1 : lt-1]
+				for _, p := range params {
+					if p.name == name {
+						panic("res: placeholder " + t + " found multiple times in pattern: " + pattern)
+					}
+				}
+				params = append(params, pathParam{name: name, idx: i, wild: true})
+			}
+			if l.wild == nil {
+				l.wild = &node{}
+			}
+			n = l.wild
+		} else if t[0] == pmark {
 			if lt == 1 {
 				panic(invalidPattern)
 			}
@@ -102,26 +121,66 @@ func (ls *patterns) add(pattern string, hs *regHandler) {
 		panic("res: registration already done for pattern " + pattern)
 	}
 
+	l.pattern = pattern
 	l.params = params
 	l.hs = hs
 }
 
+// remove removes the handlers registered for the pattern from the store.
+// Placeholder names are not compared, only the position of the placeholders.
+// Returns the removed handlers, or nil if no handlers were registered for
+// the pattern.
+func (ls *patterns) remove(pattern string) *regHandler {
+	l := ls.root
+	for _, t := range splitTokens(pattern) {
+		switch {
+		case len(t) == 0:
+			return nil
+		case t[len(t)-1] == fwc:
+			l = l.wild
+		case t[0] == pmark:
+			l = l.param
+		default:
+			l = l.nodes[t]
+		}
+		if l == nil {
+			return nil
+		}
+	}
+
+	hs := l.hs
+	l.hs = nil
+	l.pattern = ""
+	l.params = nil
+	return hs
+}
+
+// walk calls cb for each registered pattern and its handlers.
+// Patterns are visited in no particular order.
+func (ls *patterns) walk(cb func(pattern string, hs *regHandler)) {
+	walkNode(ls.root, cb)
+}
+
+func walkNode(n *node, cb func(pattern string, hs *regHandler)) {
+	if n.hs != nil {
+		cb(n.pattern, n.hs)
+	}
+	for _, c := range n.nodes {
+		walkNode(c, cb)
+	}
+	if n.param != nil {
+		walkNode(n.param, cb)
+	}
+	if n.wild != nil {
+		walkNode(n.wild, cb)
+	}
+}
+
 // get parses the resource name and gets the registered handlers and
 // any path params.
 // Returns nil, nil if there is no match
 func (ls *patterns) get(rname string) (*regHandler, map[string]string) {
-	var tokens []string
-	if len(rname) > 0 {
-		tokens = make([]string, 0, 32)
-		start := 0
-		for i := 0; i < len(rname); i++ {
-			if rname[i] == btsep {
-				tokens = append(tokens, rname[start:i])
-				start = i + 1
-			}
-		}
-		tokens = append(tokens, rname[start:])
-	}
+	tokens := splitTokens(rname)
 
 	var m nodeMatch
 	matchNode(ls.root, tokens, 0, &m)
@@ -129,6 +188,10 @@ func (ls *patterns) get(rname string) (*regHandler, map[string]string) {
 	return m.hs, m.params
 }
 
+// matchNode matches the tokens, starting at index i, against the node l
+// and its descendants. Exact token matches takes precedence over
+// placeholder matches, which in turn takes precedence over full wildcard
+// matches.
 func matchNode(l *node, toks []string, i int, m *nodeMatch) bool {
 	t := toks[i]
 	i++
@@ -141,15 +204,7 @@ func matchNode(l *node, toks []string, i int, m *nodeMatch) bool {
 			if len(toks) == i {
 				// Check if this node has handlers
 				if n.hs != nil {
-					m.hs = n.hs
-					// Check if we have path parameters for the handlers
-					if len(n.params) > 0 {
-						// Create a map with path parameter values
-						m.params = make(map[string]string, len(n.params))
-						for _, pp := range n.params {
-							m.params[pp.name] = toks[pp.idx]
-						}
-					}
+					setMatch(n, toks, m)
 					return true
 				}
 			} else {
@@ -166,5 +221,106 @@ func matchNode(l *node, toks []string, i int, m *nodeMatch) bool {
 		c--
 	}
 
+	// Full wildcard matches all remaining tokens
+	if l.wild != nil && l.wild.hs != nil {
+		setMatch(l.wild, toks, m)
+		return true
+	}
+
 	return false
 }
+
+// setMatch sets the handlers and path parameter values of the matching
+// node n to m.
+func setMatch(n *node, toks []string, m *nodeMatch) {
+	m.hs = n.hs
+	// Check if we have path parameters for the handlers
+	if len(n.params) > 0 {
+		// Create a map with path parameter values
+		m.params = make(map[string]string, len(n.params))
+		for _, pp := range n.params {
+			if pp.wild {
+				m.params[pp.name] = strings.Join(toks[pp.idx:], ".")
+			} else {
+				m.params[pp.name] = toks[pp.idx]
+			}
+		}
+	}
+}
+
+// splitTokens splits a resource name or pattern into tokens.
+func splitTokens(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	tokens := make([]string, 0, 32)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == btsep {
+			tokens = append(tokens, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(tokens, s[start:])
+}
+
+// patternParams returns the names of the placeholders in the pattern.
+func patternParams(pattern string) []string {
+	var params []string
+	for _, t := range splitTokens(pattern) {
+		if len(t) < 2 || t[0] != pmark {
+			continue
+		}
+		if t[len(t)-1] == fwc {
+			t = t[:len(t)-1]
+		}
+		params = append(params, t[1:])
+	}
+	return params
+}
+
+// patternSubject converts a pattern into a NATS subject wildcard by
+// replacing placeholders with a single token wildcard (*), and any full
+// wildcard with a full wildcard (>).
+func patternSubject(pattern string) string {
+	tokens := splitTokens(pattern)
+	for i, t := range tokens {
+		if len(t) == 0 {
+			continue
+		}
+		if t[len(t)-1] == fwc {
+			tokens[i] = ">"
+		} else if t[0] == pmark {
+			tokens[i] = "*"
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// matchSubject reports whether the subject matches the NATS subject
+// wildcard, pattern.
+func matchSubject(pattern, subj string) bool {
+	ptoks := strings.Split(pattern, ".")
+	stoks := strings.Split(subj, ".")
+	for i, t := range ptoks {
+		if t == ">" {
+			return len(stoks) > i
+		}
+		if i >= len(stoks) || (t != "*" && t != stoks[i]) {
+			return false
+		}
+	}
+	return len(ptoks) == len(stoks)
+}
+
+// patternSubjects translates a list of patterns using patternSubject.
+func patternSubjects(patterns []string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	subjs := make([]string, len(patterns))
+	for i, p := range patterns {
+		subjs[i] = patternSubject(p)
+	}
+	return subjs
+}
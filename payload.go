@@ -0,0 +1,134 @@
+package res
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	errModelNotObject     = errors.New("res: model must marshal into a JSON object")
+	errCollectionNotArray = errors.New("res: collection must marshal into a JSON array")
+	errChangeNotObject    = errors.New("res: change event properties must marshal into a JSON object")
+)
+
+// SetPayloadValidation sets whether the service should validate model and
+// collection responses, and change and add event payloads, against the
+// rules of the RES protocol. Values must marshal into JSON primitives or
+// resource references, models into JSON objects, and collections into
+// JSON arrays. Change events may also contain DeleteAction values.
+//
+// Invalid responses result in a system.internalError response. Invalid
+// events sent within a request handler also result in a
+// system.internalError response, while invalid events sent outside of a
+// request handler, such as within a With callback, are dropped. All are
+// logged.
+//
+// If not set, validation is enabled if the logger has an IsDebug method
+// returning true, to catch errors close to their source during
+// development, and disabled otherwise, to avoid the extra cost of
+// inspecting the marshaled JSON in production.
+//
+// Panics if service is already started.
+func (s *Service) SetPayloadValidation(enabled bool) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+
+	s.noValidation = !enabled
+	s.validationSet = true
+	return s
+}
+
+// debugLogger is a logger that tells if it writes debug messages.
+type debugLogger interface {
+	IsDebug() bool
+}
+
+// initPayloadValidation enables payload validation, unless set by
+// SetPayloadValidation, if the logger tells that it writes debug messages.
+func (s *Service) initPayloadValidation() {
+	if s.validationSet {
+		return
+	}
+	l, ok := s.logger.(debugLogger)
+	s.noValidation = !ok || !l.IsDebug()
+}
+
+// invalidEvent handles an event payload that failed validation. Within a
+// request handler, it panics with the error, resulting in a
+// system.internalError response. Otherwise the error is logged, and the
+// event dropped.
+func (r *resource) invalidEvent(event string, err error) {
+	if r.inRequest {
+		panic(err)
+	}
+	r.s.Logf("invalid %s event payload for %s: %s", event, r.rname, err)
+}
+
+// validateModel validates that the JSON encoded model is an object with
+// property values that are primitives or resource references.
+// If allowDelete is true, DeleteAction values are also allowed.
+func validateModel(data []byte, allowDelete bool, errNotObject error) error {
+	var props map[string]json.RawMessage
+	if !isJSONKind(data, '{') || json.Unmarshal(data, &props) != nil {
+		return errNotObject
+	}
+	for k, v := range props {
+		if err := validateJSONValue(v, allowDelete); err != nil {
+			return fmt.Errorf("res: invalid value for property %s: %s", strconv.Quote(k), err)
+		}
+	}
+	return nil
+}
+
+// validateCollection validates that the JSON encoded collection is an array
+// with values that are primitives or resource references.
+func validateCollection(data []byte) error {
+	var values []json.RawMessage
+	if !isJSONKind(data, '[') || json.Unmarshal(data, &values) != nil {
+		return errCollectionNotArray
+	}
+	for i, v := range values {
+		if err := validateJSONValue(v, false); err != nil {
+			return fmt.Errorf("res: invalid value at index %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// validateJSONValue validates that the JSON encoded value is a primitive or
+// a resource reference. If allowDelete is true, a delete action is also
+// allowed.
+func validateJSONValue(data []byte, allowDelete bool) error {
+	switch {
+	case isJSONKind(data, '['):
+		return errors.New("nested arrays are not allowed")
+	case isJSONKind(data, '{'):
+		var o map[string]json.RawMessage
+		if json.Unmarshal(data, &o) != nil || len(o) != 1 {
+			return errors.New("nested objects are not allowed")
+		}
+		if rid, ok := o["rid"]; ok {
+			var s string
+			if json.Unmarshal(rid, &s) != nil || !Ref(s).IsValid() {
+				return errors.New("invalid resource reference")
+			}
+			return nil
+		}
+		if allowDelete && equalJSON(data, DeleteAction) {
+			return nil
+		}
+		return errors.New("nested objects are not allowed")
+	}
+	return nil
+}
+
+// isJSONKind reports whether the first non-whitespace character of the
+// JSON encoded data is c.
+func isJSONKind(data []byte, c byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == c
+}
@@ -0,0 +1,163 @@
+package res
+
+import (
+	"encoding/json"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+)
+
+// The default duration a query event listens for query requests.
+const defaultQueryEventDuration = 3 * time.Second
+
+// QueryRequest has methods for responding to query requests sent on a
+// query event.
+// The ChangeEvent, AddEvent, and RemoveEvent methods adds the events to
+// the response instead of sending them. If none of the other response
+// methods are called, a response with the added events is sent once the
+// callback returns.
+// Model and Collection responds with the full value of the query resource
+// instead of any events, such as when the events are not known.
+type QueryRequest interface {
+	Resource
+	Model(model interface{})
+	Collection(collection interface{})
+	NotFound()
+	Error(err *Error)
+	Timeout(d time.Duration)
+}
+
+// queryListener holds the callback of a query event, listening for query
+// requests on the query event subject.
+type queryListener struct {
+	r   resource
+	cb  func(QueryRequest)
+	sub *nats.Subscription
+}
+
+// SetQueryEventDuration sets the duration for which the service listens
+// for query requests on a query event. Default is 3 seconds.
+// Panics if service is already started.
+func (s *Service) SetQueryEventDuration(d time.Duration) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+
+	s.queryDuration = d
+	return s
+}
+
+// QueryEvent sends a query event.
+func (r *resource) QueryEvent(cb func(QueryRequest)) {
+	s := r.s
+	qsubj := nats.NewInbox()
+	sub, err := s.nc.ChanSubscribe(qsubj, s.inCh)
+	if err != nil {
+		s.Logf("error subscribing to query event for %s: %s", r.rname, err)
+		cb(nil)
+		return
+	}
+
+	ql := &queryListener{
+		r: resource{
+			rname:      r.rname,
+			pathParams: r.pathParams,
+			s:          s,
+			hs:         r.hs,
+		},
+		cb:  cb,
+		sub: sub,
+	}
+
+	s.mu.Lock()
+	s.queries[qsubj] = ql
+	s.mu.Unlock()
+
+	time.AfterFunc(s.queryDuration, func() {
+		s.mu.Lock()
+		delete(s.queries, qsubj)
+		s.mu.Unlock()
+		_ = sub.Unsubscribe()
+		s.runWith(ql.r.hs, ql.r.rname, func() {
+			cb(nil)
+		})
+	})
+
+	r.event("event."+r.rname+".query", queryEvent{Subject: qsubj})
+}
+
+// handleQueryRequest is called by the nats listener on incoming query
+// requests on a query event subject.
+func (s *Service) handleQueryRequest(m *nats.Msg) {
+	s.mu.Lock()
+	ql := s.queries[m.Subject]
+	s.mu.Unlock()
+
+	if ql == nil {
+		s.Debugf("query request on expired query event: %s", m.Subject)
+		return
+	}
+
+	received := time.Now()
+	s.runRequest(m, ql.r.hs, ql.r.rname, func() {
+		s.processQueryRequest(m, ql, received)
+	})
+}
+
+// processQueryRequest is executed by the worker to process an incoming
+// query request.
+func (s *Service) processQueryRequest(m *nats.Msg, ql *queryListener, received time.Time) {
+	rctx := newRequestContext(s.ctx, received, s.requestTimeout)
+	defer rctx.done()
+
+	r := Request{
+		resource: ql.r,
+		rtype:    "query",
+		msg:      m,
+		rctx:     rctx,
+	}
+	r.ctx = rctx
+	r.inRequest = true
+
+	var rc resRequest
+	err := json.Unmarshal(m.Data, &rc)
+	if err != nil {
+		s.Logf("error unmarshaling incoming query request: %s", err)
+		r.error(ToError(err))
+		return
+	}
+	r.query = rc.Query
+
+	r.executeQuery(ql.cb)
+}
+
+// executeQuery calls the query event callback, and responds with the
+// events added during the call, unless another response was sent.
+func (r *Request) executeQuery(cb func(QueryRequest)) {
+	// Recover from panics inside the callback
+	defer func() {
+		r.inQuery = false
+		if v := recover(); v != nil {
+			r.handlePanic(v)
+		}
+	}()
+
+	r.inQuery = true
+	cb(r)
+
+	if !r.replied {
+		evs := r.qEvents
+		if evs == nil {
+			evs = []resEvent{}
+		}
+		if r.s.refs != nil {
+			rid := r.rid()
+			for _, ev := range evs {
+				if data, err := json.Marshal(ev.Data); err == nil {
+					r.s.refs.event(rid, ev.Event, data)
+				}
+			}
+		}
+		r.success(queryResponse{Events: evs})
+	}
+}
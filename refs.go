@@ -0,0 +1,455 @@
+package res
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The maximum number of query resources with tracked references.
+const maxQueryRefs = 1024
+
+// refGraph tracks the resource references contained in the models and
+// collections sent by the service, with the resource ID as key.
+type refGraph struct {
+	mu      sync.Mutex
+	out     map[string]*refNode       // Outgoing references by referring resource ID
+	in      map[string]map[string]int // Reference count by referenced and referring resource ID
+	queries *list.List                // List of tracked query resource IDs, most recently set first
+	qels    map[string]*list.Element  // Elements of the queries list by query resource ID
+}
+
+// refNode holds the outgoing references of a model or collection.
+type refNode struct {
+	collection bool
+	props      map[string]string // Referenced resource IDs by model property
+	values     []string          // Referenced resource IDs by collection index. Empty for non-reference values
+}
+
+// SetReferenceTracking sets whether the service should track the resource
+// references contained in model and collection get responses, and in the
+// events sent for the resources. The tracked references can be retrieved
+// using References and Referrers.
+//
+// Events update the tracked values of the resource without query.
+// Responses to query requests update the tracked values of the query
+// resource. Tracked values are kept until a delete event is sent for the
+// resource, or until a system.reset event is sent matching the resource.
+// Only the values of the 1024 most recently responded query resources are
+// kept.
+//
+// Panics if service is already started.
+func (s *Service) SetReferenceTracking(enabled bool) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+
+	if enabled {
+		s.refs = &refGraph{
+			out:     make(map[string]*refNode),
+			in:      make(map[string]map[string]int),
+			queries: list.New(),
+			qels:    make(map[string]*list.Element),
+		}
+	} else {
+		s.refs = nil
+	}
+	return s
+}
+
+// References returns the sorted resource IDs referenced by the tracked
+// model or collection, rid.
+// Returns nil if reference tracking is disabled, or if the resource is not
+// tracked.
+func (s *Service) References(rid string) []string {
+	g := s.refs
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.out[rid]
+	if n == nil {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, ref := range n.props {
+		m[ref] = true
+	}
+	for _, ref := range n.values {
+		if ref != "" {
+			m[ref] = true
+		}
+	}
+	return sortedKeys(m)
+}
+
+// Referrers returns the sorted resource IDs of the tracked models and
+// collections referencing the resource, rid.
+// Returns nil if reference tracking is disabled, or if the resource is not
+// referenced.
+func (s *Service) Referrers(rid string) []string {
+	g := s.refs
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := make(map[string]bool, len(g.in[rid]))
+	for from := range g.in[rid] {
+		m[from] = true
+	}
+	return sortedKeys(m)
+}
+
+// DanglingReferences returns the sorted resource IDs that are referenced by
+// tracked resources, and belong to the service, but has no matching
+// registered handler.
+// Returns nil if reference tracking is disabled.
+func (s *Service) DanglingReferences() []string {
+	g := s.refs
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	rids := make([]string, 0, len(g.in))
+	for rid := range g.in {
+		rids = append(rids, rid)
+	}
+	g.mu.Unlock()
+
+	var dangling []string
+	prefix := s.Name + "."
+	for _, rid := range rids {
+		rname, _ := parseRID(rid)
+		if !strings.HasPrefix(rname, prefix) {
+			continue
+		}
+		if hs, _ := s.getHandler(rname); hs == nil {
+			dangling = append(dangling, rid)
+		}
+	}
+	sort.Strings(dangling)
+	return dangling
+}
+
+// RemoveReferences sends remove events for all references to the resource,
+// rid, in the tracked collections without query, such as when the resource
+// has been deleted.
+//
+// For each referring collection, the callback is called on the worker
+// goroutine of the collection once for each index holding a reference, in
+// descending order. The callback should remove the value from the
+// collection, and return nil, after which a remove event is sent for the
+// index. If the callback returns an error, no remove event is sent for
+// that index. A nil callback sends the remove events without any call.
+//
+// Does nothing if reference tracking is disabled.
+func (s *Service) RemoveReferences(rid string, cb func(r Resource, idx int) error) {
+	g := s.refs
+	if g == nil {
+		return
+	}
+
+	for _, from := range s.Referrers(rid) {
+		if strings.IndexByte(from, '?') >= 0 || !g.isCollection(from) {
+			continue
+		}
+		err := s.With(from, func(r Resource) {
+			for _, idx := range g.indexes(from, rid) {
+				if cb != nil {
+					if err := cb(r, idx); err != nil {
+						s.Debugf("not removing reference to %s from %s at index %d: %s", rid, from, idx, err)
+						continue
+					}
+				}
+				r.RemoveEvent(idx)
+			}
+		})
+		if err != nil {
+			s.Logf("error removing references to %s from %s: %s", rid, from, err)
+		}
+	}
+}
+
+// setModel sets the tracked references of the JSON encoded model.
+// Does nothing if g is nil.
+func (g *refGraph) setModel(rid string, data []byte) {
+	if g == nil {
+		return
+	}
+	var props map[string]json.RawMessage
+	if json.Unmarshal(data, &props) != nil {
+		return
+	}
+	n := &refNode{props: make(map[string]string)}
+	for k, v := range props {
+		if ref := jsonRef(v); ref != "" {
+			n.props[k] = ref
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.set(rid, n)
+}
+
+// setCollection sets the tracked references of the JSON encoded
+// collection. Does nothing if g is nil.
+func (g *refGraph) setCollection(rid string, data []byte) {
+	if g == nil {
+		return
+	}
+	var values []json.RawMessage
+	if json.Unmarshal(data, &values) != nil {
+		return
+	}
+	n := &refNode{collection: true, values: make([]string, len(values))}
+	for i, v := range values {
+		n.values[i] = jsonRef(v)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.set(rid, n)
+}
+
+// event updates the tracked references of the resource based on the
+// event and its JSON encoded payload. Does nothing if g is nil.
+func (g *refGraph) event(rid, event string, payload []byte) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch event {
+	case "change":
+		n := g.out[rid]
+		if n == nil || n.collection {
+			return
+		}
+		var props map[string]json.RawMessage
+		if json.Unmarshal(payload, &props) != nil {
+			return
+		}
+		for k, v := range props {
+			if old, ok := n.props[k]; ok {
+				g.unlink(rid, old)
+				delete(n.props, k)
+			}
+			if ref := jsonRef(v); ref != "" {
+				n.props[k] = ref
+				g.link(rid, ref)
+			}
+		}
+	case "add":
+		n := g.out[rid]
+		if n == nil || !n.collection {
+			return
+		}
+		var ev struct {
+			Value json.RawMessage `json:"value"`
+			Idx   int             `json:"idx"`
+		}
+		if json.Unmarshal(payload, &ev) != nil || ev.Idx > len(n.values) {
+			// The tracked collection is out of sync
+			g.set(rid, nil)
+			return
+		}
+		ref := jsonRef(ev.Value)
+		n.values = append(n.values, "")
+		copy(n.values[ev.Idx+1:], n.values[ev.Idx:])
+		n.values[ev.Idx] = ref
+		if ref != "" {
+			g.link(rid, ref)
+		}
+	case "remove":
+		n := g.out[rid]
+		if n == nil || !n.collection {
+			return
+		}
+		var ev removeEvent
+		if json.Unmarshal(payload, &ev) != nil || ev.Idx >= len(n.values) {
+			// The tracked collection is out of sync
+			g.set(rid, nil)
+			return
+		}
+		if ref := n.values[ev.Idx]; ref != "" {
+			g.unlink(rid, ref)
+		}
+		n.values = append(n.values[:ev.Idx], n.values[ev.Idx+1:]...)
+	case "delete":
+		g.set(rid, nil)
+		prefix := rid + "?"
+		for from := range g.out {
+			if strings.HasPrefix(from, prefix) {
+				g.set(from, nil)
+			}
+		}
+	}
+}
+
+// reset removes the tracked values of all resources matching any of the
+// subjects, as used in a system.reset event. Does nothing if g is nil.
+func (g *refGraph) reset(subjs []string) {
+	if g == nil || len(subjs) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for rid := range g.out {
+		rname, _ := parseRID(rid)
+		for _, subj := range subjs {
+			if matchSubject(subj, rname) {
+				g.set(rid, nil)
+				break
+			}
+		}
+	}
+}
+
+// isCollection reports whether the tracked resource is a collection.
+func (g *refGraph) isCollection(rid string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.out[rid]
+	return n != nil && n.collection
+}
+
+// indexes returns the indexes, in descending order, of the tracked
+// collection, from, holding a reference to rid.
+func (g *refGraph) indexes(from, rid string) []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.out[from]
+	if n == nil {
+		return nil
+	}
+	var idxs []int
+	for i := len(n.values) - 1; i >= 0; i-- {
+		if n.values[i] == rid {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// set replaces the tracked node of the resource. A nil node removes it.
+// If the number of tracked query resources exceeds maxQueryRefs, the least
+// recently set query resource is removed.
+// The mu lock must be held when calling set.
+func (g *refGraph) set(rid string, n *refNode) {
+	if strings.IndexByte(rid, '?') >= 0 {
+		g.setQuery(rid, n != nil)
+	}
+	if old := g.out[rid]; old != nil {
+		for _, ref := range old.props {
+			g.unlink(rid, ref)
+		}
+		for _, ref := range old.values {
+			if ref != "" {
+				g.unlink(rid, ref)
+			}
+		}
+		delete(g.out, rid)
+	}
+	if n == nil {
+		return
+	}
+	for _, ref := range n.props {
+		g.link(rid, ref)
+	}
+	for _, ref := range n.values {
+		if ref != "" {
+			g.link(rid, ref)
+		}
+	}
+	g.out[rid] = n
+}
+
+// setQuery adds or moves the query resource ID to the front of the queries
+// list, or removes it if tracked is false, evicting the least recently set
+// query resource on overflow.
+// The mu lock must be held when calling setQuery.
+func (g *refGraph) setQuery(rid string, tracked bool) {
+	el, ok := g.qels[rid]
+	if !tracked {
+		if ok {
+			g.queries.Remove(el)
+			delete(g.qels, rid)
+		}
+		return
+	}
+	if ok {
+		g.queries.MoveToFront(el)
+		return
+	}
+	g.qels[rid] = g.queries.PushFront(rid)
+	if g.queries.Len() > maxQueryRefs {
+		g.set(g.queries.Back().Value.(string), nil)
+	}
+}
+
+// link adds a reference from one resource to another.
+// The mu lock must be held when calling link.
+func (g *refGraph) link(from, to string) {
+	m, ok := g.in[to]
+	if !ok {
+		m = make(map[string]int)
+		g.in[to] = m
+	}
+	m[from]++
+}
+
+// unlink removes a reference from one resource to another.
+// The mu lock must be held when calling unlink.
+func (g *refGraph) unlink(from, to string) {
+	m := g.in[to]
+	if m[from] > 1 {
+		m[from]--
+		return
+	}
+	delete(m, from)
+	if len(m) == 0 {
+		delete(g.in, to)
+	}
+}
+
+// jsonRef returns the resource ID of the JSON encoded resource reference,
+// or empty string if the value is not a reference.
+func jsonRef(data []byte) string {
+	if !isJSONKind(data, '{') {
+		return ""
+	}
+	var o map[string]json.RawMessage
+	if json.Unmarshal(data, &o) != nil || len(o) != 1 {
+		return ""
+	}
+	var rid string
+	if json.Unmarshal(o["rid"], &rid) != nil {
+		return ""
+	}
+	return rid
+}
+
+// sortedKeys returns the keys of the map in sorted order, or nil if the
+// map is empty.
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -21,10 +21,13 @@ const (
 // Request represent a RES request
 type Request struct {
 	resource
-	rtype   string
-	method  string
-	msg     *nats.Msg
-	replied bool // Flag telling if a reply has been made
+	rtype     string
+	method    string
+	msg       *nats.Msg
+	replied   bool            // Flag telling if a reply has been made
+	rctx      *requestContext // Context of the request
+	responder *Responder      // Responder of a deferred response
+	ht        *handlerTimeout // Handler timeout. Nil if no timeout is set
 
 	// Fields from the request data
 	cid        string
@@ -47,6 +50,7 @@ type AccessRequest interface {
 	RawToken() json.RawMessage
 	ParseToken(interface{})
 	Timeout(d time.Duration)
+	Defer() *Responder
 }
 
 // ModelRequest has methods for responding to model get requests.
@@ -57,6 +61,7 @@ type ModelRequest interface {
 	NotFound()
 	Error(err *Error)
 	Timeout(d time.Duration)
+	Defer() *Responder
 }
 
 // CollectionRequest has methods for responding to collection get requests.
@@ -67,6 +72,7 @@ type CollectionRequest interface {
 	NotFound()
 	Error(err *Error)
 	Timeout(d time.Duration)
+	Defer() *Responder
 }
 
 // CallRequest has methods for responding to call requests.
@@ -84,6 +90,7 @@ type CallRequest interface {
 	InvalidParams(message string)
 	Error(err *Error)
 	Timeout(d time.Duration)
+	Defer() *Responder
 }
 
 // NewRequest has methods for responding to new call requests.
@@ -95,11 +102,13 @@ type NewRequest interface {
 	ParseParams(interface{})
 	ParseToken(interface{})
 	New(rid Ref)
+	Created(rid Ref, value interface{})
 	NotFound()
 	MethodNotFound()
 	InvalidParams(message string)
 	Error(err *Error)
 	Timeout(d time.Duration)
+	Defer() *Responder
 }
 
 // AuthRequest has methods for responding to auth requests.
@@ -121,6 +130,7 @@ type AuthRequest interface {
 	InvalidParams(message string)
 	Error(err *Error)
 	Timeout(d time.Duration)
+	Defer() *Responder
 	TokenEvent(t interface{})
 }
 
@@ -132,6 +142,7 @@ var (
 	responseMethodNotFound  = []byte(`{"error":{"code":"system.methodNotFound","message":"Method not found"}}`)
 	responseInvalidParams   = []byte(`{"error":{"code":"system.invalidParams","message":"Invalid parameters"}}`)
 	responseMissingResponse = []byte(`{"error":{"code":"system.internalError","message":"Internal error: missing response"}}`)
+	responseTimeout         = []byte(`{"error":{"code":"system.timeout","message":"Request timeout"}}`)
 	responseAccessGranted   = []byte(`{"result":{"get":true,"call":"*"}}`)
 )
 
@@ -148,7 +159,7 @@ var (
 	}
 )
 
-// Type returns the request type. May be "access", "get", "call", or "auth".
+// Type returns the request type. May be "access", "get", "call", "auth", or "query".
 func (r *Request) Type() string {
 	return r.rtype
 }
@@ -269,7 +280,8 @@ func (r *Request) AccessGranted() {
 
 // Model sends a successful model response for the get request.
 // The model must marshal into a JSON object.
-// Only valid for get requests for a model resource.
+// Only valid for get requests for a model resource, and for query requests
+// on a model query event.
 func (r *Request) Model(model interface{}) {
 	r.model(model, "")
 }
@@ -286,13 +298,25 @@ func (r *Request) model(model interface{}, query string) {
 	if query != "" && r.query == "" {
 		panic("res: query model response on non-query request")
 	}
-	// [TODO] Marshal model to a json.RawMessage to see if it is a JSON object
+	if !r.s.noValidation || r.s.refs != nil {
+		data, err := json.Marshal(model)
+		if err == nil && !r.s.noValidation {
+			err = validateModel(data, false, errModelNotObject)
+		}
+		if err != nil {
+			r.invalidPayload(err)
+			return
+		}
+		r.s.refs.setModel(r.rid(), data)
+		model = json.RawMessage(data)
+	}
 	r.success(modelResponse{Model: model, Query: query})
 }
 
 // Collection sends a successful collection response for the get request.
 // The collection must marshal into a JSON array.
-// Only valid for get requests for a collection resource.
+// Only valid for get requests for a collection resource, and for query
+// requests on a collection query event.
 func (r *Request) Collection(collection interface{}) {
 	r.collection(collection, "")
 }
@@ -309,10 +333,28 @@ func (r *Request) collection(collection interface{}, query string) {
 	if query != "" && r.query == "" {
 		panic("res: query collection response on non-query request")
 	}
-	// [TODO] Marshal collection to a json.RawMessage to see if it is a JSON array
+	if !r.s.noValidation || r.s.refs != nil {
+		data, err := json.Marshal(collection)
+		if err == nil && !r.s.noValidation {
+			err = validateCollection(data)
+		}
+		if err != nil {
+			r.invalidPayload(err)
+			return
+		}
+		r.s.refs.setCollection(r.rid(), data)
+		collection = json.RawMessage(data)
+	}
 	r.success(collectionResponse{Collection: collection, Query: query})
 }
 
+// invalidPayload logs the validation error, and sends it as an internal
+// error response.
+func (r *Request) invalidPayload(err error) {
+	r.s.Logf("invalid response payload for %s: %s", r.msg.Subject, err)
+	r.error(ToError(err))
+}
+
 // New sends a successful response for the new call request.
 // Panics if rid is invalid.
 // Only valid for new call requests.
@@ -323,17 +365,46 @@ func (r *Request) New(rid Ref) {
 	r.success(rid)
 }
 
+// Created sends a create event for the new resource, rid, with value being
+// the resource value, followed by a successful response for the new call
+// request, as with New.
+// Panics if rid is invalid, if no handler is registered for the resource,
+// or if the value does not match the resource type.
+// Only valid for new call requests.
+func (r *Request) Created(rid Ref, value interface{}) {
+	if !rid.IsValid() {
+		panic("res: invalid reference RID: " + rid)
+	}
+	rname, q := parseRID(string(rid))
+	hs, params := r.s.getHandler(rname)
+	if hs == nil {
+		panic("res: no handler found for created resource: " + rid)
+	}
+	nr := &resource{
+		rname:      rname,
+		pathParams: params,
+		query:      q,
+		s:          r.s,
+		hs:         hs,
+	}
+	nr.CreateEvent(value)
+	r.success(rid)
+}
+
 // ParseParams unmarshals the JSON encoded parameters and stores the result in p.
-// If the request has no parameters, ParseParams does nothing.
+// If the request has no parameters, p is left unchanged.
+// The result is then validated using ValidateParams.
 // On any error, ParseParams panics with a system.invalidParams *Error.
 // Only valid for call and auth requests.
 func (r *Request) ParseParams(p interface{}) {
-	if len(r.params) == 0 {
-		return
+	if len(r.params) > 0 {
+		err := json.Unmarshal(r.params, p)
+		if err != nil {
+			panic(&Error{Code: CodeInvalidParams, Message: err.Error()})
+		}
 	}
-	err := json.Unmarshal(r.params, p)
-	if err != nil {
-		panic(&Error{Code: CodeInvalidParams, Message: err.Error()})
+	if err := ValidateParams(p); err != nil {
+		panic(err)
 	}
 }
 
@@ -352,13 +423,26 @@ func (r *Request) ParseToken(t interface{}) {
 }
 
 // Timeout attempts to set the timeout duration of the request.
+// The deadline of the request context, and any handler timeout, is
+// extended accordingly.
 // The call has no effect if the requester has already timed out the request.
 func (r *Request) Timeout(d time.Duration) {
+	r.timeout(d)
+	if r.ht != nil {
+		r.ht.extend(d)
+	}
+}
+
+// timeout sends a timeout event to the requester, and extends the deadline
+// of the request context, without extending any handler timeout.
+func (r *Request) timeout(d time.Duration) {
 	if d < 0 {
 		panic("res: negative timeout duration")
 	}
-	out := []byte(`timeout:"` + strconv.FormatInt(d.Nanoseconds()/1000000, 10) + `"`)
-	r.s.rawEvent(r.msg.Reply, out)
+	r.send([]byte(`timeout:"` + strconv.FormatInt(d.Nanoseconds()/1000000, 10) + `"`))
+	if r.rctx != nil {
+		r.rctx.setTimeout(d)
+	}
 }
 
 // TokenEvent sends a connection token event that sets the requester's connection access token,
@@ -395,113 +479,180 @@ func (r *Request) error(e *Error) {
 // reply sends an encoded payload to as a reply.
 // If a reply is already sent, reply will panic.
 func (r *Request) reply(payload []byte) {
+	if r.responder != nil {
+		panic("res: response on deferred request")
+	}
 	if r.replied {
 		panic("res: response already sent on request")
 	}
 	r.replied = true
+	if r.ht != nil && !r.ht.reply() {
+		r.s.Debugf("response on %s ignored after handler timeout", r.msg.Subject)
+		return
+	}
+	r.send(payload)
+}
+
+// send publishes an encoded payload as a reply.
+func (r *Request) send(payload []byte) {
 	r.s.Tracef("<== %s: %s", r.msg.Subject, payload)
-	err := r.s.nc.Publish(r.msg.Reply, payload)
+	err := r.s.publish(r.msg.Reply, payload)
 	if err != nil {
 		r.s.Logf("error sending reply %s: %s", r.msg.Subject, err)
 	}
 }
 
+// startTimeout starts the handler timeout, sending a system.timeout error
+// response if the handler does not respond within the duration d.
+func (r *Request) startTimeout(d time.Duration) {
+	r.ht = r.s.newHandlerTimeout(d, func(deferred bool) {
+		if r.method == "" {
+			r.s.Logf("handler timeout: %s request for %s", r.rtype, r.rname)
+		} else {
+			r.s.Logf("handler timeout: %s request for %s, method %s", r.rtype, r.rname, r.method)
+		}
+		if !deferred {
+			r.send(responseTimeout)
+		}
+	})
+}
+
 func (r *Request) executeHandler() {
 	// Recover from panics inside handlers
 	defer func() {
 		r.inGet = false
-		v := recover()
-		if v == nil {
-			return
-		}
-
-		var str string
-
-		switch e := v.(type) {
-		case *Error:
-			if !r.replied {
-				r.error(e)
-				// Return without logging as panicing with a *Error is considered
-				// a valid way of sending an error response.
-				return
-			}
-			str = e.Message
-		case error:
-			str = e.Error()
-			if !r.replied {
-				r.error(ToError(e))
-			}
-		case string:
-			str = e
-			if !r.replied {
-				r.error(ToError(errors.New(e)))
-			}
-		default:
-			str = fmt.Sprintf("%v", e)
-			if !r.replied {
-				r.error(ToError(errors.New(str)))
-			}
+		if v := recover(); v != nil {
+			r.handlePanic(v)
 		}
-
-		r.s.Logf("error handling request %s: %s", r.msg.Subject, str)
 	}()
 
 	hs := r.hs
 
+	var h RequestHandler
 	switch r.rtype {
 	case "access":
 		if hs.Access == nil {
 			// No handling. Assume the access requests is handled by other services.
 			return
 		}
-		hs.Access(r)
+		h = func(r *Request) { hs.Access(r) }
 	case "get":
 		r.inGet = true
 		switch hs.typ {
 		case rtypeModel:
-			hs.GetModel(r)
+			h = func(r *Request) { hs.GetModel(r) }
 		case rtypeCollection:
-
-			hs.GetCollection(r)
+			h = func(r *Request) { hs.GetCollection(r) }
 		default:
 			r.reply(responseNotFound)
 			return
 		}
 	case "call":
 		if r.method == "new" {
-			h := hs.New
-			if h == nil {
+			if hs.New == nil {
 				r.reply(responseMethodNotFound)
 				return
 			}
-			h(r)
+			h = func(r *Request) { hs.New(r) }
 		} else {
-			var h CallHandler
+			var ch CallHandler
 			if hs.Call != nil {
-				h = hs.Call[r.method]
+				ch = hs.Call[r.method]
 			}
-			if h == nil {
+			if ch == nil {
 				r.reply(responseMethodNotFound)
 				return
 			}
-			h(r)
+			h = func(r *Request) { ch(r) }
 		}
 	case "auth":
-		var h AuthHandler
+		var ah AuthHandler
 		if hs.Auth != nil {
-			h = hs.Auth[r.method]
+			ah = hs.Auth[r.method]
 		}
-		if h == nil {
+		if ah == nil {
 			r.reply(responseMethodNotFound)
 			return
 		}
-		h(r)
+		h = func(r *Request) { ah(r) }
 	default:
 		r.s.Logf("unknown request type: %s", r.Type())
 		return
 	}
 
-	if !r.replied {
+	// Validate parameters against any schema before calling the handler
+	var sch *Schema
+	switch r.rtype {
+	case "call":
+		sch = hs.ParamsSchema[r.method]
+	case "auth":
+		sch = hs.AuthParamsSchema[r.method]
+	}
+	if sch != nil {
+		next := h
+		h = func(r *Request) {
+			if err := sch.Validate(r.params); err != nil {
+				r.error(ToError(err))
+				return
+			}
+			next(r)
+		}
+	}
+
+	r.s.wrapHandler(h, hs.Middleware)(r)
+
+	if !r.replied && r.responder == nil {
 		r.reply(responseMissingResponse)
 	}
 }
+
+// handlePanic sends an error response for a value recovered from a panic
+// inside a handler, unless a response is already sent, and logs the error.
+func (r *Request) handlePanic(v interface{}) {
+	if r.responder != nil {
+		r.responder.panicked(v)
+		return
+	}
+
+	var str string
+
+	switch e := v.(type) {
+	case *Error:
+		if !r.replied {
+			r.error(e)
+			// Return without logging as panicing with a *Error is considered
+			// a valid way of sending an error response.
+			return
+		}
+		str = e.Message
+	case error:
+		str = e.Error()
+		if !r.replied {
+			r.error(ToError(e))
+		}
+	case string:
+		str = e
+		if !r.replied {
+			r.error(ToError(errors.New(e)))
+		}
+	default:
+		str = fmt.Sprintf("%v", e)
+		if !r.replied {
+			r.error(ToError(errors.New(str)))
+		}
+	}
+
+	r.s.Logf("error handling request %s: %s", r.msg.Subject, str)
+}
+
+// done cancels the request context once the handler returns, unless the
+// response is deferred, in which case the context is cancelled once the
+// response is sent.
+func (r *Request) done() {
+	if r.responder == nil {
+		if r.ht != nil {
+			r.ht.stop()
+		}
+		r.rctx.done()
+	}
+}
@@ -1,6 +1,9 @@
 package res
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/url"
 )
 
@@ -9,6 +12,14 @@ type Resource interface {
 	// Service returns the service instance
 	Service() *Service
 
+	// Context returns the context of the resource. For requests, the
+	// context is cancelled when the service is shut down, when the request
+	// handler returns, or when the deadline is exceeded. The deadline is
+	// derived from the request timeout, and is extended by calls to
+	// Timeout. For resources passed to With callbacks, the context is
+	// cancelled when the service is shut down.
+	Context() context.Context
+
 	/// Resource returns the resource name.
 	ResourceName() string
 
@@ -27,16 +38,21 @@ type Resource interface {
 	ParseQuery() url.Values
 
 	// Value gets the resource value as provided from the GetModel or
-	// GetCollection resource handlers.
+	// GetCollection resource handlers, or from the value cache if enabled
+	// with ValueCache.
 	// If it fails to get the resource value, or no get handler is
 	// defined, it returns a nil interface and a *Error type error.
+	// If the get handler defers the response, Value blocks the worker
+	// until the response is sent. The response must then not depend on
+	// callbacks queued for the same resource or group, which would
+	// deadlock.
 	Value() (interface{}, error)
 
 	// Event sends a custom event on the resource.
 	// Will panic if the event is one of the pre-defined or reserved events,
-	// "change", "add", "remove", "reaccess", or "unsubscribe".
-	// For pre-defined events, the matching method, ChangeEvent, AddEvent,
-	// RemoveEvent, or ReaccessEvent should be used instead.
+	// "change", "delete", "create", "add", "remove", "reaccess", or "unsubscribe".
+	// For pre-defined events, the matching method, ChangeEvent, DeleteEvent,
+	// CreateEvent, AddEvent, RemoveEvent, or ReaccessEvent should be used instead.
 	//
 	// See the protocol specification for more information:
 	// https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#events
@@ -47,14 +63,29 @@ type Resource interface {
 	// If props is empty, no event is sent.
 	// Panics if the resource is not a Model.
 	// The values must be serializable into JSON primitives, resource references,
-	// or a delete action objects.
+	// or a delete action objects. When payload validation is enabled,
+	// invalid values causes a panic within a request handler, resulting in a
+	// system.internalError response, and are otherwise logged and dropped.
+	// See Service.SetPayloadValidation.
 	// See the protocol specification for more information:
 	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#model-change-event
 	ChangeEvent(props interface{})
 
+	// ChangeEventDiff compares the old and new model values, and sends a
+	// change event with the properties that has changed, using DiffModel.
+	// The old model must be a copy taken before the model was updated.
+	// If no properties has changed, no event is sent.
+	// Panics if the resource is not a Model, or if either value fails to
+	// marshal into a JSON object.
+	ChangeEventDiff(oldModel, newModel interface{})
+
 	// AddEvent sends an add event, adding the value at index idx.
 	// Panics if the resource is not a Collection, or if idx is less than 0.
 	// The value must be serializable into a JSON primitive or resource reference.
+	// When payload validation is enabled, invalid values causes a panic
+	// within a request handler, resulting in a system.internalError
+	// response, and are otherwise logged and dropped.
+	// See Service.SetPayloadValidation.
 	// See the protocol specification for more information:
 	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#collection-add-event
 	AddEvent(value interface{}, idx int)
@@ -65,11 +96,67 @@ type Resource interface {
 	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#collection-remove-event
 	RemoveEvent(idx int)
 
+	// CollectionDiffEvents compares the old and new collection values, and
+	// sends a minimal sequence of add and remove events transforming the
+	// old collection into the new one. Values are compared by their JSON
+	// encoding. If the changed parts of the collections are very large, the
+	// changed values are instead all removed and the new values added.
+	// Panics if the resource is not a Collection, or if any value fails to
+	// marshal into JSON.
+	CollectionDiffEvents(oldCollection, newCollection []interface{})
+
+	// DeleteEvent sends a delete event to signal that the resource no longer
+	// exists, and should be removed from any cache.
+	// See the protocol specification for more information:
+	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#delete-event
+	DeleteEvent()
+
+	// CreateEvent sends a create event to signal that the resource has been
+	// created, with value being the new resource value.
+	// The value is not included in the event, but must match the resource
+	// type: a model must marshal into a JSON object, and a collection into
+	// a JSON array.
+	// Panics if the value does not match the resource type.
+	// See the protocol specification for more information:
+	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#create-event
+	CreateEvent(value interface{})
+
+	// QueryEvent sends a query event to signal that query resources based on
+	// the resource may have been modified. For each query request received
+	// on the event, the callback is called on the worker goroutine with a
+	// QueryRequest, on which ChangeEvent, AddEvent, and RemoveEvent adds the
+	// events for the normalized query to the response, instead of sending
+	// them. When the query event expires, the callback is called a last time
+	// with nil.
+	// See the protocol specification for more information:
+	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#query-event
+	QueryEvent(cb func(QueryRequest))
+
+	// ResetEvent sends a system.reset event for the resource, to trigger any
+	// gateway to update their cache of the resource.
+	// See the protocol specification for more information:
+	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#system-reset-event
+	ResetEvent()
+
+	// ResetAccess sends a system.reset event for access to the resource, to
+	// trigger any gateway to invalidate cached access responses for the
+	// resource.
+	// See the protocol specification for more information:
+	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#system-reset-event
+	ResetAccess()
+
 	// ReaccessEvent sends a reaccess event to signal that the resource's access permissions has changed.
 	// It will invalidate any previous access response sent for the resource.
 	// See the protocol specification for more information:
 	//    https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#reaccess-event
 	ReaccessEvent()
+
+	// OnRollback registers a function to call if the events sent within a
+	// callback passed to Service.WithTx are discarded, as the callback
+	// returns an error or panics. The functions are called in reverse order
+	// of registration. Outside of a WithTx callback, the function is never
+	// called.
+	OnRollback(f func())
 }
 
 // resource is the internal implementation of the Resource interface
@@ -78,8 +165,21 @@ type resource struct {
 	pathParams map[string]string
 	query      string
 	inGet      bool
+	inTx       bool       // Flag telling if events should be buffered
+	txEvents   []txEvent  // Events buffered during a transaction
+	rollbacks  []func()   // Functions called if a transaction is rolled back
+	inQuery    bool       // Flag telling if events should be added to a query response
+	qEvents    []resEvent // Events added to a query response
 	s          *Service
 	hs         *regHandler
+	ctx        context.Context // Context of the request. Nil to use the service context
+	inRequest  bool            // Flag telling if the resource is handled within a request handler
+}
+
+// txEvent is an event buffered during a transaction.
+type txEvent struct {
+	subj    string
+	payload []byte
 }
 
 // Service returns the service instance
@@ -87,6 +187,17 @@ func (r *resource) Service() *Service {
 	return r.s
 }
 
+// Context returns the context of the resource.
+func (r *resource) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.s.ctx != nil {
+		return r.s.ctx
+	}
+	return context.Background()
+}
+
 // ResourceName returns the resource name.
 func (r *resource) ResourceName() string {
 	return r.rname
@@ -115,8 +226,17 @@ func (r *resource) ParseQuery() url.Values {
 	return v
 }
 
+// rid returns the resource ID, including any query.
+func (r *resource) rid() string {
+	if r.query == "" {
+		return r.rname
+	}
+	return r.rname + "?" + r.query
+}
+
 // Value gets the resource value as provided from the GetModel or
-// GetCollection resource handlers.
+// GetCollection resource handlers, or from the value cache if enabled
+// with ValueCache.
 // If it fails to get the resource value, or no get handler is
 // defined, it returns a nil interface and a *Error type error.
 // Panics if called from within GetModel or GetCollection handler.
@@ -126,8 +246,23 @@ func (r *resource) Value() (interface{}, error) {
 		panic("Value() called from within get handler")
 	}
 
+	c := r.hs.cache
+	if c == nil {
+		gr := &getRequest{resource: r}
+		gr.executeHandler()
+		return gr.value, gr.err
+	}
+
+	rid := r.rid()
+	v, gen, ok := c.get(r.rname, rid)
+	if ok {
+		return v, nil
+	}
 	gr := &getRequest{resource: r}
 	gr.executeHandler()
+	if gr.err == nil {
+		c.set(r.rname, rid, gr.value, gen)
+	}
 	return gr.value, gr.err
 }
 
@@ -145,9 +280,9 @@ func isValidPart(p string) bool {
 
 // Event sends a custom event on the resource.
 // Will panic if the event is one of the pre-defined or reserved events,
-// "change", "delete", "add", "remove", "patch", "reaccess", or "unsubscribe".
-// For pre-defined events, the matching method, ChangeEvent, AddEvent,
-// RemoveEvent, or ReaccessEvent should be used instead.
+// "change", "delete", "create", "add", "remove", "patch", "reaccess", or "unsubscribe".
+// For pre-defined events, the matching method, ChangeEvent, DeleteEvent,
+// CreateEvent, AddEvent, RemoveEvent, or ReaccessEvent should be used instead.
 //
 // This is to ensure compliance with the specifications:
 // https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#events
@@ -156,7 +291,9 @@ func (r *resource) Event(event string, payload interface{}) {
 	case "change":
 		panic("res: use ChangeEvent to send change events")
 	case "delete":
-		panic(`res: "delete" is a reserved event name`)
+		panic("res: use DeleteEvent to send delete events")
+	case "create":
+		panic("res: use CreateEvent to send create events")
 	case "add":
 		panic("res: use AddEvent to send add events")
 	case "remove":
@@ -173,7 +310,7 @@ func (r *resource) Event(event string, payload interface{}) {
 		panic(`res: invalid event name`)
 	}
 
-	r.s.event("event."+r.rname+"."+event, payload)
+	r.event("event."+r.rname+"."+event, payload)
 }
 
 // ChangeEvent sends a change event.
@@ -186,7 +323,37 @@ func (r *resource) ChangeEvent(ev interface{}) {
 	if ev == nil {
 		return
 	}
-	r.s.event("event."+r.rname+".change", ev)
+	if !r.s.noValidation {
+		data, err := json.Marshal(ev)
+		if err == nil {
+			err = validateModel(data, true, errChangeNotObject)
+		}
+		if err != nil {
+			r.invalidEvent("change", err)
+			return
+		}
+		ev = json.RawMessage(data)
+	}
+	r.resEvent("change", ev)
+}
+
+// ChangeEventDiff sends a change event with the properties that differ
+// between the old and new model values.
+// If no properties has changed, no event is sent.
+// Panics if the resource is not a Model, or if either value fails to
+// marshal into a JSON object.
+func (r *resource) ChangeEventDiff(oldModel, newModel interface{}) {
+	if r.hs.typ != rtypeModel {
+		panic("res: change event only allowed on Models")
+	}
+	changed, err := DiffModel(oldModel, newModel)
+	if err != nil {
+		panic(err)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	r.ChangeEvent(changed)
 }
 
 // AddEvent sends an add event, adding the value v at index idx.
@@ -198,7 +365,18 @@ func (r *resource) AddEvent(v interface{}, idx int) {
 	if idx < 0 {
 		panic("res: add event idx less than zero")
 	}
-	r.s.event("event."+r.rname+".add", addEvent{Value: v, Idx: idx})
+	if !r.s.noValidation {
+		data, err := json.Marshal(v)
+		if err == nil {
+			err = validateJSONValue(data, false)
+		}
+		if err != nil {
+			r.invalidEvent("add", fmt.Errorf("res: invalid add event value: %s", err))
+			return
+		}
+		v = json.RawMessage(data)
+	}
+	r.resEvent("add", addEvent{Value: v, Idx: idx})
 }
 
 // RemoveEvent sends an remove event, removing the value at index idx.
@@ -210,10 +388,165 @@ func (r *resource) RemoveEvent(idx int) {
 	if idx < 0 {
 		panic("res: remove event idx less than zero")
 	}
-	r.s.event("event."+r.rname+".remove", removeEvent{Idx: idx})
+	r.resEvent("remove", removeEvent{Idx: idx})
+}
+
+// CollectionDiffEvents sends add and remove events transforming the old
+// collection into the new one.
+// Panics if the resource is not a Collection, or if any value fails to
+// marshal into JSON.
+func (r *resource) CollectionDiffEvents(oldCollection, newCollection []interface{}) {
+	if r.hs.typ != rtypeCollection {
+		panic("res: collection diff events only allowed on Collections")
+	}
+	evs, err := diffCollection(oldCollection, newCollection)
+	if err != nil {
+		panic(err)
+	}
+	for _, ev := range evs {
+		if ev.add {
+			r.AddEvent(ev.value, ev.idx)
+		} else {
+			r.RemoveEvent(ev.idx)
+		}
+	}
+}
+
+// DeleteEvent sends a delete event.
+func (r *resource) DeleteEvent() {
+	r.invalidate()
+	r.rawEvent("event."+r.rname+".delete", nil)
+}
+
+// CreateEvent sends a create event.
+// Panics if the value does not match the resource type.
+func (r *resource) CreateEvent(value interface{}) {
+	switch r.hs.typ {
+	case rtypeModel:
+		if _, err := modelProps(value); value == nil || err != nil {
+			panic("res: create event value must marshal into a JSON object")
+		}
+		if r.s.refs != nil {
+			data, _ := json.Marshal(value)
+			r.s.refs.setModel(r.rname, data)
+		}
+	case rtypeCollection:
+		if _, err := collectionValues(value); err != nil {
+			panic("res: create event value must marshal into a JSON array")
+		}
+		if r.s.refs != nil {
+			data, _ := json.Marshal(value)
+			r.s.refs.setCollection(r.rname, data)
+		}
+	}
+	r.invalidate()
+	r.rawEvent("event."+r.rname+".create", nil)
+}
+
+// ResetEvent sends a system.reset event for the resource.
+func (r *resource) ResetEvent() {
+	r.invalidate()
+	r.event("system.reset", resetEvent{Resources: []string{r.rname}})
+}
+
+// ResetAccess sends a system.reset event for access to the resource.
+func (r *resource) ResetAccess() {
+	r.event("system.reset", resetEvent{Access: []string{r.rname}})
 }
 
 // ReaccessEvent sends a reaccess event.
 func (r *resource) ReaccessEvent() {
-	r.s.rawEvent("event."+r.rname+".reaccess", nil)
+	r.rawEvent("event."+r.rname+".reaccess", nil)
+}
+
+// resEvent sends a model or collection event, or adds it to the response
+// if the resource is handling a query request.
+func (r *resource) resEvent(event string, data interface{}) {
+	r.invalidate()
+	if r.inQuery {
+		r.qEvents = append(r.qEvents, resEvent{Event: event, Data: data})
+		return
+	}
+	r.event("event."+r.rname+"."+event, data)
+}
+
+// invalidate removes any cached values of the resource.
+func (r *resource) invalidate() {
+	if r.hs != nil && r.hs.cache != nil {
+		r.hs.cache.invalidate(r.rname)
+	}
+}
+
+// event marshals the data and publishes it on a subject, or buffers it
+// if the resource is in a transaction.
+func (r *resource) event(subj string, data interface{}) {
+	if !r.inTx {
+		r.s.event(subj, data)
+		return
+	}
+	var payload []byte
+	if data != nil {
+		var err error
+		payload, err = json.Marshal(data)
+		if err != nil {
+			r.s.Logf("error sending event %s: %s", subj, err)
+			return
+		}
+	}
+	r.rawEvent(subj, payload)
+}
+
+// rawEvent publishes the payload on a subject, or buffers it if the
+// resource is in a transaction.
+func (r *resource) rawEvent(subj string, payload []byte) {
+	if !r.inTx {
+		r.s.rawEvent(subj, payload)
+		return
+	}
+	r.txEvents = append(r.txEvents, txEvent{subj: subj, payload: payload})
+}
+
+// runTx calls the callback with events buffered. The buffered events are
+// published once the callback returns nil, or discarded if it returns an
+// error or panics.
+func (r *resource) runTx(cb func(r Resource) error) {
+	var err error
+	r.inTx = true
+	defer func() {
+		evs := r.txEvents
+		rbs := r.rollbacks
+		r.inTx = false
+		r.txEvents = nil
+		r.rollbacks = nil
+
+		if v := recover(); v != nil {
+			r.s.Logf("error in transaction for %s, discarding %d event(s): %v", r.rname, len(evs), v)
+			rollback(rbs)
+			return
+		}
+		if err != nil {
+			r.s.Debugf("transaction for %s failed, discarding %d event(s): %s", r.rname, len(evs), err)
+			rollback(rbs)
+			return
+		}
+		for _, ev := range evs {
+			r.s.rawEvent(ev.subj, ev.payload)
+		}
+	}()
+
+	err = cb(r)
+}
+
+// OnRollback registers a function to call if the transaction is rolled back.
+func (r *resource) OnRollback(f func()) {
+	if r.inTx {
+		r.rollbacks = append(r.rollbacks, f)
+	}
+}
+
+// rollback calls the rollback functions in reverse order.
+func rollback(rbs []func()) {
+	for i := len(rbs) - 1; i >= 0; i-- {
+		rbs[i]()
+	}
 }
@@ -0,0 +1,141 @@
+package res
+
+// A Router holds a set of resource patterns and their handlers that may be
+// mounted onto a Service, or onto another Router, under a pattern prefix.
+//
+// A Router allows a service to be assembled from multiple packages, each
+// registering its own patterns without knowing the final resource names.
+// Handlers must be registered before the Router is mounted.
+type Router struct {
+	patterns   patterns         // pattern store with all handlers
+	middleware []MiddlewareFunc // Middleware wrapping the handlers of the router
+	access     AccessHandler    // Default access handler
+	group      string           // Default group
+	mounted    bool             // Flag telling if the router has been mounted
+}
+
+// NewRouter creates a new Router.
+func NewRouter() *Router {
+	return &Router{
+		patterns: patterns{root: &node{}},
+	}
+}
+
+// Handle registers the handler functions for the given resource pattern.
+// The pattern is relative to the prefix the router is mounted under, and
+// may contain placeholders and full wildcards as described for
+// Service.Handle. An empty pattern matches the prefix itself.
+//
+// If the pattern is already registered, if there are conflicts among
+// the handlers, or if the router is already mounted, Handle panics.
+func (r *Router) Handle(pattern string, hf ...HandlerOption) {
+	var h Handler
+	for _, f := range hf {
+		f(&h)
+	}
+	r.AddHandler(pattern, h)
+}
+
+// AddHandler register a handler for the given resource pattern.
+// The pattern used is the same as described for Handle.
+func (r *Router) AddHandler(pattern string, hs Handler) {
+	r.assertNotMounted()
+	r.patterns.add(pattern, newRegHandler(hs))
+}
+
+// Use adds middleware to the router. The middleware wraps all handlers
+// of the router, including those of any mounted routers.
+//
+// Router middleware is called after the middleware of the Service or Router
+// it is mounted onto, and before any pattern middleware.
+//
+// Panics if the router is already mounted.
+func (r *Router) Use(mw ...MiddlewareFunc) *Router {
+	r.assertNotMounted()
+	r.middleware = append(r.middleware, mw...)
+	return r
+}
+
+// SetAccess sets the access handler used for patterns in the router
+// that has no Access handler of their own.
+//
+// Panics if the router is already mounted.
+func (r *Router) SetAccess(h AccessHandler) *Router {
+	r.assertNotMounted()
+	r.access = h
+	return r
+}
+
+// SetGroup sets the group used for patterns in the router that has no
+// Group of their own.
+//
+// Panics if the router is already mounted.
+func (r *Router) SetGroup(group string) *Router {
+	r.assertNotMounted()
+	r.group = group
+	return r
+}
+
+// Mount adds all patterns of the router, sub, to the router under the
+// prefix. The prefix may contain placeholders, but no full wildcard.
+//
+// If any pattern is already registered, Mount panics.
+func (r *Router) Mount(prefix string, sub *Router) {
+	r.assertNotMounted()
+	sub.mount(prefix, r.AddHandler)
+}
+
+// Mount adds all patterns of the router, r, to the service under the
+// prefix. The prefix may contain placeholders, but no full wildcard.
+//
+// If any pattern is already registered, Mount panics.
+func (s *Service) Mount(prefix string, r *Router) {
+	r.mount(prefix, s.AddHandler)
+}
+
+// assertNotMounted panics if the router is already mounted, as changes
+// would not affect the mounted handlers.
+func (r *Router) assertNotMounted() {
+	if r.mounted {
+		panic("res: router already mounted")
+	}
+}
+
+// mount calls add for each registered pattern, with the prefix prepended
+// and the router settings applied to the handlers.
+func (r *Router) mount(prefix string, add func(pattern string, hs Handler)) {
+	if prefix == "" && r.patterns.root.hs != nil {
+		panic("res: router with empty pattern must be mounted with a prefix")
+	}
+	r.mounted = true
+	r.patterns.walk(func(pattern string, h *regHandler) {
+		add(joinPattern(prefix, pattern), r.apply(h.Handler))
+	})
+}
+
+// apply returns a copy of the handler with the router settings applied.
+func (r *Router) apply(hs Handler) Handler {
+	if hs.Access == nil {
+		hs.Access = r.access
+	}
+	if hs.Group == "" {
+		hs.Group = r.group
+	}
+	if len(r.middleware) > 0 {
+		mw := make([]MiddlewareFunc, 0, len(r.middleware)+len(hs.Middleware))
+		hs.Middleware = append(append(mw, r.middleware...), hs.Middleware...)
+	}
+	return hs
+}
+
+// joinPattern joins a prefix and a pattern with a dot separator.
+// If either is empty, the other is returned.
+func joinPattern(prefix, pattern string) string {
+	if prefix == "" {
+		return pattern
+	}
+	if pattern == "" {
+		return prefix
+	}
+	return prefix + "." + pattern
+}
@@ -0,0 +1,300 @@
+package res
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a parsed JSON Schema document used to validate parameters.
+//
+// Only a subset of JSON Schema is supported, with the keywords:
+//  type, enum, properties, required, additionalProperties (boolean only),
+//  items, minItems, maxItems, minimum, maximum, minLength, maxLength, pattern
+// Other keywords are ignored.
+type Schema struct {
+	root *schemaNode
+}
+
+// schemaNode is a schema or subschema of a JSON Schema document.
+type schemaNode struct {
+	Type                 schemaType             `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*schemaNode `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *schemaNode            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaType is the type keyword value, which may either be a single
+// type name or a list of type names.
+type schemaType []string
+
+// UnmarshalJSON makes schemaType implement the json.Unmarshaler interface.
+func (st *schemaType) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*st = schemaType{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	*st = l
+	return nil
+}
+
+// NewSchema parses a JSON Schema document.
+// The document, doc, may either be a []byte, string, or json.RawMessage
+// containing JSON, or any other value that marshals into a JSON Schema
+// document.
+func NewSchema(doc interface{}) (*Schema, error) {
+	var data []byte
+	switch v := doc.(type) {
+	case []byte:
+		data = v
+	case json.RawMessage:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var n schemaNode
+	err := json.Unmarshal(data, &n)
+	if err != nil {
+		return nil, err
+	}
+	err = n.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{root: &n}, nil
+}
+
+// compile compiles the pattern of the schema and its subschemas.
+func (sch *schemaNode) compile() error {
+	if sch.Pattern != "" {
+		p, err := regexp.Compile(sch.Pattern)
+		if err != nil {
+			return err
+		}
+		sch.pattern = p
+	}
+	for _, t := range sch.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("unknown type %#v", t)
+		}
+	}
+	for _, p := range sch.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if sch.Items != nil {
+		return sch.Items.compile()
+	}
+	return nil
+}
+
+// Validate validates the JSON encoded parameters, params, against the
+// schema. Empty params are validated as an empty JSON object.
+// It returns nil if the parameters are valid, otherwise a
+// system.invalidParams *Error with a []ValidationError as Data.
+func (sch *Schema) Validate(params json.RawMessage) error {
+	if len(params) == 0 {
+		params = json.RawMessage(`{}`)
+	}
+	var v interface{}
+	err := json.Unmarshal(params, &v)
+	if err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+
+	var errs []ValidationError
+	sch.root.validate(v, "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &Error{Code: CodeInvalidParams, Message: "Invalid parameters", Data: errs}
+}
+
+// validate validates the decoded JSON value, v, appending any validation
+// errors to errs.
+func (sch *schemaNode) validate(v interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, ValidationError{Field: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if len(sch.Type) > 0 {
+		t := jsonType(v)
+		ok := false
+		for _, st := range sch.Type {
+			if st == t || (st == "number" && t == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("must be of type %s", strings.Join(sch.Type, " or "))
+			return
+		}
+	}
+
+	if sch.Enum != nil {
+		found := false
+		for _, e := range sch.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the enumerated values")
+		}
+	}
+
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for _, name := range sch.Required {
+			if _, ok := tv[name]; !ok {
+				*errs = append(*errs, ValidationError{Field: joinField(path, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(tv))
+		for name := range tv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pv := tv[name]
+			if ps, ok := sch.Properties[name]; ok {
+				ps.validate(pv, joinField(path, name), errs)
+			} else if sch.AdditionalProperties != nil && !*sch.AdditionalProperties {
+				*errs = append(*errs, ValidationError{Field: joinField(path, name), Message: "is not allowed"})
+			}
+		}
+	case []interface{}:
+		if sch.MinItems != nil && len(tv) < *sch.MinItems {
+			fail("must have at least %d items", *sch.MinItems)
+		}
+		if sch.MaxItems != nil && len(tv) > *sch.MaxItems {
+			fail("must have at most %d items", *sch.MaxItems)
+		}
+		if sch.Items != nil {
+			for i, iv := range tv {
+				sch.Items.validate(iv, joinField(path, strconv.Itoa(i)), errs)
+			}
+		}
+	case string:
+		l := utf8.RuneCountInString(tv)
+		if sch.MinLength != nil && l < *sch.MinLength {
+			fail("must have a length of at least %d", *sch.MinLength)
+		}
+		if sch.MaxLength != nil && l > *sch.MaxLength {
+			fail("must have a length of at most %d", *sch.MaxLength)
+		}
+		if sch.pattern != nil && !sch.pattern.MatchString(tv) {
+			fail("must match pattern %s", sch.Pattern)
+		}
+	case float64:
+		if sch.Minimum != nil && tv < *sch.Minimum {
+			fail("must be at least %v", *sch.Minimum)
+		}
+		if sch.Maximum != nil && tv > *sch.Maximum {
+			fail("must be at most %v", *sch.Maximum)
+		}
+	}
+}
+
+// jsonType returns the JSON Schema type name of a decoded JSON value.
+func jsonType(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if tv == math.Trunc(tv) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// ParamsSchema sets a JSON Schema document used to validate the
+// parameters of call requests with the given method. Use the method "new"
+// for new call requests.
+// If validation fails, a system.invalidParams error is sent without
+// calling the handler.
+// The document, doc, is parsed with NewSchema.
+//
+// Panics if the document is not a valid schema, or if a schema is
+// already set for the method.
+func ParamsSchema(method string, doc interface{}) HandlerOption {
+	sch, err := NewSchema(doc)
+	if err != nil {
+		panic("res: invalid params schema for method " + method + ": " + err.Error())
+	}
+	return func(hs *Handler) {
+		if hs.ParamsSchema == nil {
+			hs.ParamsSchema = make(map[string]*Schema)
+		}
+		if _, ok := hs.ParamsSchema[method]; ok {
+			panic("res: multiple params schemas for method " + method)
+		}
+		hs.ParamsSchema[method] = sch
+	}
+}
+
+// AuthParamsSchema sets a JSON Schema document used to validate the
+// parameters of auth requests with the given method.
+// If validation fails, a system.invalidParams error is sent without
+// calling the handler.
+// The document, doc, is parsed with NewSchema.
+//
+// Panics if the document is not a valid schema, or if a schema is
+// already set for the method.
+func AuthParamsSchema(method string, doc interface{}) HandlerOption {
+	sch, err := NewSchema(doc)
+	if err != nil {
+		panic("res: invalid auth params schema for method " + method + ": " + err.Error())
+	}
+	return func(hs *Handler) {
+		if hs.AuthParamsSchema == nil {
+			hs.AuthParamsSchema = make(map[string]*Schema)
+		}
+		if _, ok := hs.AuthParamsSchema[method]; ok {
+			panic("res: multiple auth params schemas for method " + method)
+		}
+		hs.AuthParamsSchema[method] = sch
+	}
+}
@@ -1,21 +1,23 @@
 package res
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jirenius/resgate/logger"
 	nats "github.com/nats-io/go-nats"
 )
 
-// The size of the in channel receiving messages from NATS Server.
-const inChannelSize = 256
+// The default size of the in channel receiving messages from NATS Server.
+const defaultInChannelSize = 256
 
-// The number of default workers handling resource requests.
-const workerCount = 32
+// The default number of workers handling resource requests.
+const defaultWorkerCount = 32
 
 var (
 	errNotStopped      = errors.New("res: service is not stopped")
@@ -64,6 +66,31 @@ type Handler struct {
 	// Auth handler for auth requests
 	Auth map[string]AuthHandler
 
+	// Middleware wrapping the handlers of the resource pattern.
+	Middleware []MiddlewareFunc
+
+	// ParamsSchema contains schemas used to validate the parameters of
+	// call and new requests, with the method as key.
+	ParamsSchema map[string]*Schema
+
+	// AuthParamsSchema contains schemas used to validate the parameters of
+	// auth requests, with the method as key.
+	AuthParamsSchema map[string]*Schema
+
+	// ValueCacheSize is the maximum number of values returned by
+	// Resource.Value to cache for the resources. If zero, values are not
+	// cached.
+	ValueCacheSize int
+
+	// ValueCacheTTL is the duration a cached value is kept. If zero,
+	// cached values are kept until invalidated or evicted.
+	ValueCacheTTL time.Duration
+
+	// HandlerTimeout is the duration a handler has to respond, overriding
+	// the timeout set by Service.SetHandlerTimeout. If zero, the service
+	// setting is used.
+	HandlerTimeout time.Duration
+
 	// Group is the identifier of the group the resource belongs to.
 	// All resources of the same group will be handled on the same
 	// goroutine.
@@ -73,7 +100,20 @@ type Handler struct {
 
 type regHandler struct {
 	Handler
-	typ rtype
+	typ   rtype
+	cache *valueCache // Cache of resource values. Nil if not enabled
+}
+
+// newRegHandler creates a registered handler, validating the handlers.
+func newRegHandler(hs Handler) *regHandler {
+	h := &regHandler{
+		Handler: hs,
+		typ:     validateGetHandlers(hs),
+	}
+	if hs.ValueCacheSize > 0 {
+		h.cache = newValueCache(hs.ValueCacheSize, hs.ValueCacheTTL)
+	}
+	return h
 }
 
 const (
@@ -81,8 +121,12 @@ const (
 	stateStarting
 	stateStarted
 	stateStopping
+	stateDraining
 )
 
+// The interval at which ShutdownContext checks if all work is done.
+const drainInterval = 10 * time.Millisecond
+
 // A Service handles incoming requests from NATS Server and calls the
 // appropriate callback on the resource handlers.
 type Service struct {
@@ -97,13 +141,36 @@ type Service struct {
 	patterns       patterns                      // pattern store with all handlers
 	inCh           chan *nats.Msg                // Channel for incoming nats messages
 	rwork          map[string]*work              // map of resource work
+	deferred       map[*Responder]bool           // Responders of deferred responses not yet sent
+	timeouts       map[*handlerTimeout]bool      // Handler timeouts not yet done
+	queries        map[string]*queryListener     // map of query event listeners, with the query subject as key
 	workCh         chan *work                    // Resource work channel, listened to by the workers
 	wg             sync.WaitGroup                // WaitGroup for all workers
-	mu             sync.Mutex                    // Mutex to protect rwork map
+	mu             sync.Mutex                    // Mutex to protect rwork, deferred, timeouts, and queries map
+	nmu            sync.RWMutex                  // Mutex to protect nc from being cleared while publishing
+	pmu            sync.RWMutex                  // Mutex to protect patterns and withAccess
 	logger         logger.Logger                 // Logger
 	withAccess     bool                          // Flag that is true if there are patterns with Access handlers
 	resetResources []string                      // List of resource name patterns used on system.reset for resources. Defaults to serviceName+">"
 	resetAccess    []string                      // List of resource name patterns used system.reset for access. Defaults to serviceName+">"
+	middleware     []MiddlewareFunc              // Middleware wrapping the handlers of all patterns
+	queryDuration  time.Duration                 // Duration to listen for query requests on a query event
+	outbox         *outbox                       // Outbox holding unpublished events. Nil if not enabled
+	noValidation   bool                          // Flag telling if payload validation is disabled
+	validationSet  bool                          // Flag telling if payload validation is set by SetPayloadValidation
+	refs           *refGraph                     // Tracked resource references. Nil if not enabled
+	workerCount    int                           // Number of workers handling resource requests
+	inChannelSize  int                           // Size of the in channel
+	queueLimit     int                           // Maximum number of queued requests per worker ID. Zero means no limit
+	overload       OverloadPolicy                // Policy for requests exceeding the queue limit
+	busyErr        *Error                        // Error response used by the OverloadBusy policy
+	queueCond      *sync.Cond                    // Condition signaled when a queued callback is dequeued
+	requestTimeout time.Duration                 // Duration before a requester times out a request
+	handlerTimeout time.Duration                 // Duration before a handler times out. Zero means no timeout
+	onServe        func(*Service)                // Called in place of the initial reset once the service has started
+	ctx            context.Context               // Context cancelled when the service is shut down
+	drained        chan struct{}                 // Closed by the listener once the in channel is drained
+	cancel         context.CancelFunc            // Cancels ctx
 }
 
 // NewService creates a new Service given a service name.
@@ -111,9 +178,14 @@ type Service struct {
 func NewService(name string) *Service {
 	// [TODO] panic on invalid name
 	return &Service{
-		Name:     name,
-		patterns: patterns{root: &node{}},
-		logger:   logger.NewStdLogger(false, false),
+		Name:           name,
+		patterns:       patterns{root: &node{}},
+		logger:         logger.NewStdLogger(false, false),
+		queryDuration:  defaultQueryEventDuration,
+		workerCount:    defaultWorkerCount,
+		inChannelSize:  defaultInChannelSize,
+		busyErr:        errBusy,
+		requestTimeout: defaultRequestTimeout,
 	}
 }
 
@@ -164,6 +236,16 @@ func (s *Service) Tracef(format string, v ...interface{}) {
 // A placeholder is a resource name part starting with a dollar ($) character:
 //  s.Handle("user.$id", handlers) // Will match "user.10", "user.foo", etc.
 //
+// A pattern may end with a full wildcard that matches one or more remaining
+// tokens. It is either a single greater than (>) character, or a placeholder
+// followed by one, storing the remaining tokens in the PathParams map:
+//  s.Handle("file.$path>", handlers) // Will match "file.a", "file.a.b.c", etc.
+//
+// Exact token matches take precedence over placeholders, which in turn take
+// precedence over full wildcards.
+//
+// Handle may be called while the service is serving requests.
+//
 // If the pattern is already registered, or if there are conflicts among
 // the handlers, Handle panics.
 func (s *Service) Handle(pattern string, hf ...HandlerOption) {
@@ -177,14 +259,87 @@ func (s *Service) Handle(pattern string, hf ...HandlerOption) {
 // AddHandler register a handler for the given resource pattern.
 // The pattern used is the same as described for Handle.
 func (s *Service) AddHandler(pattern string, hs Handler) {
-	if hs.Access != nil {
-		s.withAccess = true
+	h := newRegHandler(hs)
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	s.patterns.add(s.Name+"."+pattern, h)
+	s.setAccess(hs.Access != nil)
+}
+
+// Remove unregisters the handlers for the given resource pattern, and
+// sends a system.reset event for the resources matching the pattern.
+// Requests already being handled by the removed handlers are allowed to
+// complete.
+//
+// Remove may be called while the service is serving requests.
+// Remove returns an error if the pattern is not registered.
+func (s *Service) Remove(pattern string) error {
+	s.pmu.Lock()
+	h := s.patterns.remove(s.Name + "." + pattern)
+	s.pmu.Unlock()
+	if h == nil {
+		return errHandlerNotFound
 	}
-	h := regHandler{
-		Handler: hs,
-		typ:     validateGetHandlers(hs),
+
+	s.resetPattern(pattern)
+	return nil
+}
+
+// Replace replaces the handlers for the given resource pattern, and
+// sends a system.reset event for the resources matching the pattern.
+// Requests already being handled by the replaced handlers are allowed to
+// complete, while any new requests are handled by the new handlers.
+//
+// Replace may be called while the service is serving requests.
+// Replace returns an error if the pattern is not registered, and panics
+// if there are conflicts among the handlers.
+func (s *Service) Replace(pattern string, hs Handler) error {
+	h := newRegHandler(hs)
+	rname := s.Name + "." + pattern
+
+	s.pmu.Lock()
+	old := s.patterns.remove(rname)
+	if old == nil {
+		s.pmu.Unlock()
+		return errHandlerNotFound
+	}
+	s.patterns.add(rname, h)
+	s.setAccess(hs.Access != nil)
+	s.pmu.Unlock()
+
+	s.resetPattern(pattern)
+	return nil
+}
+
+// setAccess sets the withAccess flag if access is true. If the service is
+// started without access subscription, the access requests are subscribed
+// to. The pmu lock must be held when calling setAccess.
+func (s *Service) setAccess(access bool) {
+	if !access || s.withAccess {
+		return
+	}
+	s.withAccess = true
+	if atomic.LoadInt32(&s.state) == stateStarted {
+		if err := s.subscribeType(RequestTypeAccess); err != nil {
+			s.Logf("Failed to subscribe to access requests: %s", err)
+		}
 	}
-	s.patterns.add(s.Name+"."+pattern, &h)
+}
+
+// resetPattern sends a system.reset event for the resources matching the
+// pattern, if the service is started.
+func (s *Service) resetPattern(pattern string) {
+	if atomic.LoadInt32(&s.state) != stateStarted {
+		return
+	}
+	subj := patternSubject(s.Name + "." + pattern)
+	ev := resetEvent{Resources: []string{subj}}
+	s.pmu.RLock()
+	if s.withAccess {
+		ev.Access = []string{subj}
+	}
+	s.pmu.RUnlock()
+	s.event("system.reset", ev)
 }
 
 // Access sets a handler for resource access requests
@@ -269,6 +424,18 @@ func (s *Service) SetReset(resources, access []string) {
 	s.resetAccess = access
 }
 
+// SetOnServe sets a function to call once the service has started, in
+// place of sending the initial system reset event for all resources. The
+// function is then responsible for resetting any resources that gateways
+// may hold stale copies of, such as by calling Reset or ResetAll.
+// Panics if service is already started.
+func (s *Service) SetOnServe(f func(*Service)) {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	s.onServe = f
+}
+
 // ListenAndServe connects to the NATS server at the url. Once connected,
 // it subscribes to incoming requests and serves them on a single goroutine
 // in the order they are received. For each request, it calls the appropriate
@@ -323,16 +490,24 @@ func (s *Service) serve(nc Conn) error {
 	s.Logf("Starting service: %s", s.Name)
 
 	// Initialize fields
-	inCh := make(chan *nats.Msg, inChannelSize)
+	inCh := make(chan *nats.Msg, s.inChannelSize)
 	workCh := make(chan *work, 1)
+	s.nmu.Lock()
 	s.nc = nc
+	s.nmu.Unlock()
 	s.inCh = inCh
 	s.workCh = workCh
 	s.rwork = make(map[string]*work)
+	s.deferred = make(map[*Responder]bool)
+	s.timeouts = make(map[*handlerTimeout]bool)
+	s.queries = make(map[string]*queryListener)
+	s.queueCond = sync.NewCond(&s.mu)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.initPayloadValidation()
 
 	// Start workers
-	s.wg.Add(workerCount)
-	for i := 0; i < workerCount; i++ {
+	s.wg.Add(s.workerCount)
+	for i := 0; i < s.workerCount; i++ {
 		go s.startWorker(s.workCh)
 	}
 
@@ -343,8 +518,14 @@ func (s *Service) serve(nc Conn) error {
 		s.Logf("Failed to subscribe: %s", err)
 		s.close()
 	} else {
-		// Always start with a reset
-		s.ResetAll()
+		// Publish any events left in the outbox log
+		s.loadOutbox()
+		// Start with a reset, unless replaced by the onServe callback
+		if s.onServe != nil {
+			s.onServe(s)
+		} else {
+			s.ResetAll()
+		}
 
 		s.Logf("Listening for requests")
 		s.startListener(inCh)
@@ -355,6 +536,7 @@ func (s *Service) serve(nc Conn) error {
 
 	// Wait for all workers to be done
 	s.wg.Wait()
+	s.cancel()
 	return nil
 }
 
@@ -366,20 +548,157 @@ func (s *Service) Shutdown() error {
 	}
 
 	s.Logf("Stopping service...")
+	s.stop()
+	return nil
+}
+
+// ShutdownContext gracefully shuts down the service. It unsubscribes from
+// all request subjects, and waits for any received requests and queued
+// callbacks to be handled, and their responses and events to be
+// published, before closing the connection to NATS Server. Any deferred
+// responses not yet sent are waited for as well.
+//
+// If the context is done before all work is handled, any remaining queued
+// requests and callbacks are abandoned, and the connection is closed. The
+// number of abandoned requests and callbacks is returned together with
+// the context error.
+//
+// Returns an error if service is not started.
+func (s *Service) ShutdownContext(ctx context.Context) (int, error) {
+	if !atomic.CompareAndSwapInt32(&s.state, stateStarted, stateDraining) {
+		return 0, errNotStarted
+	}
+
+	s.Logf("Draining service...")
+	s.unsubscribe()
+	err := s.drain(ctx)
+	atomic.StoreInt32(&s.state, stateStopping)
+
+	abandoned := 0
+	if err != nil {
+		abandoned = s.abandon()
+		s.Logf("Failed to drain service, abandoning %d request(s): %s", abandoned, err)
+	}
+
+	s.Logf("Stopping service...")
+	s.stop()
+	return abandoned, err
+}
+
+// stop cancels the service context, closes the connection, waits for the
+// workers to be done, and stops any handler timeouts and the timers of any
+// deferred responses. The state must be set to stateStopping when calling
+// stop.
+func (s *Service) stop() {
+	s.cancel()
 	s.close()
 
 	// Wait for all workers to be done
 	s.wg.Wait()
+	s.stopHandlerTimeouts()
+	s.stopResponders()
 
 	s.inCh = nil
+	s.nmu.Lock()
 	s.nc = nil
+	s.nmu.Unlock()
 	s.subs = nil
 	s.workCh = nil
 
 	atomic.StoreInt32(&s.state, stateStopped)
 
 	s.Logf("Stopped")
-	return nil
+}
+
+// unsubscribe unsubscribes from all request subjects, and from the
+// subjects of any active query events.
+func (s *Service) unsubscribe() {
+	s.pmu.Lock()
+	for t, sub := range s.subs {
+		if err := sub.Unsubscribe(); err != nil {
+			s.Debugf("error unsubscribing to %s requests: %s", t, err)
+		}
+	}
+	s.pmu.Unlock()
+
+	s.mu.Lock()
+	for _, ql := range s.queries {
+		_ = ql.sub.Unsubscribe()
+	}
+	s.mu.Unlock()
+}
+
+// drain waits for all requests in the in channel to be queued, for all
+// queued work to be done, and for all deferred responses to be sent.
+// Returns the context error if the context is done first.
+func (s *Service) drain(ctx context.Context) error {
+	// Pass a nil message to the listener, which closes the drained
+	// channel once all prior messages are handled.
+	s.drained = make(chan struct{})
+	select {
+	case s.inCh <- nil:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.rwork) + len(s.deferred)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// abandon clears all work queues, and returns the number of requests and
+// callbacks that are abandoned, including those in the in channel and
+// those with a deferred response not yet sent.
+func (s *Service) abandon() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.inCh) + len(s.deferred)
+	for _, w := range s.rwork {
+		n += len(w.queue)
+		w.queue = nil
+	}
+	if s.queueLimit > 0 {
+		s.queueCond.Broadcast()
+	}
+	return n
+}
+
+// stopResponders stops the timeout extension of any deferred responses not
+// yet sent.
+func (s *Service) stopResponders() {
+	s.mu.Lock()
+	ps := make([]*Responder, 0, len(s.deferred))
+	for p := range s.deferred {
+		ps = append(ps, p)
+	}
+	s.mu.Unlock()
+	for _, p := range ps {
+		p.stop()
+	}
+}
+
+// serving reports whether the service is started or draining, handling
+// queued work and sending events.
+func (s *Service) serving() bool {
+	state := atomic.LoadInt32(&s.state)
+	return state == stateStarted || state == stateDraining
 }
 
 // close calls Close on the NATS connection, and closes the incoming channel
@@ -391,10 +710,17 @@ func (s *Service) close() {
 // ResetAll will send a system.reset to trigger any gateway to update their cache
 // for all resources owned by the service
 func (s *Service) ResetAll() {
-	if atomic.LoadInt32(&s.state) != stateStarted {
+	if !s.serving() {
 		s.Logf("failed to reset: service not started")
 		return
 	}
+	s.clearValueCaches()
+	s.event("system.reset", s.resetAllEvent())
+}
+
+// resetAllEvent returns the system.reset event used to reset all resources
+// owned by the service.
+func (s *Service) resetAllEvent() resetEvent {
 	var ev resetEvent
 	if s.resetResources == nil {
 		ev.Resources = []string{s.Name + ".>"}
@@ -403,11 +729,42 @@ func (s *Service) ResetAll() {
 	}
 
 	// Only reset access if there are access handlers
-	if s.resetAccess == nil && s.withAccess {
+	s.pmu.RLock()
+	withAccess := s.withAccess
+	s.pmu.RUnlock()
+	if s.resetAccess == nil && withAccess {
 		ev.Access = []string{s.Name + ".>"}
 	} else {
 		ev.Access = s.resetAccess
 	}
+	return ev
+}
+
+// Reset sends a system.reset event to trigger any gateway to update their
+// cache for the resources and access matching the resource name patterns.
+// The patterns are full resource names, including the service name, and
+// may contain wildcards (* and >), or placeholders as used when registering
+// handlers, such as "example.model.$id", which are translated into
+// wildcards.
+// If both resources and access are empty, no event is sent.
+//
+// For more details on system reset, see:
+// https://github.com/jirenius/resgate/blob/master/docs/res-service-protocol.md#system-reset-event
+func (s *Service) Reset(resources, access []string) {
+	if !s.serving() {
+		s.Logf("failed to reset: service not started")
+		return
+	}
+	ev := resetEvent{
+		Resources: patternSubjects(resources),
+		Access:    patternSubjects(access),
+	}
+	if len(ev.Resources) == 0 && len(ev.Access) == 0 {
+		return
+	}
+	if len(ev.Resources) > 0 {
+		s.clearValueCaches()
+	}
 	s.event("system.reset", ev)
 }
 
@@ -424,23 +781,38 @@ func (s *Service) TokenEvent(cid string, token interface{}) {
 
 // subscribe makes a nats subscription for each required request type.
 func (s *Service) subscribe() error {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
 	s.subs = make(map[string]*nats.Subscription, 4)
 	for _, t := range []string{RequestTypeAccess, RequestTypeGet, RequestTypeCall, RequestTypeAuth} {
 		if t == RequestTypeAccess && !s.withAccess {
 			continue
 		}
-		sub, err := s.nc.QueueSubscribeSyncWithChan(t+"."+s.Name+".>", s.Name, s.inCh)
-		if err != nil {
+		if err := s.subscribeType(t); err != nil {
 			return err
 		}
-		s.subs[t] = sub
 	}
 	return nil
 }
 
+// subscribeType makes a nats subscription for the request type.
+// The pmu lock must be held when calling subscribeType.
+func (s *Service) subscribeType(t string) error {
+	sub, err := s.nc.QueueSubscribeSyncWithChan(t+"."+s.Name+".>", s.Name, s.inCh)
+	if err != nil {
+		return err
+	}
+	s.subs[t] = sub
+	return nil
+}
+
 // startListener listens for nats messages and passes them on to a worker.
 func (s *Service) startListener(ch chan *nats.Msg) {
 	for m := range ch {
+		if m == nil {
+			close(s.drained)
+			continue
+		}
 		s.handleRequest(m)
 	}
 }
@@ -456,6 +828,12 @@ func (s *Service) handleRequest(m *nats.Msg) {
 		return
 	}
 
+	// Query requests are sent on query event inbox subjects
+	if strings.HasPrefix(subj, nats.InboxPrefix) {
+		s.handleQueryRequest(m)
+		return
+	}
+
 	// Get request type
 	idx := strings.IndexByte(subj, '.')
 	if idx < 0 {
@@ -479,10 +857,11 @@ func (s *Service) handleRequest(m *nats.Msg) {
 		rname = rname[:idx]
 	}
 
-	hs, params := s.patterns.get(rname)
+	hs, params := s.getHandler(rname)
+	received := time.Now()
 
-	s.runWith(hs, rname, func() {
-		s.processRequest(m, rtype, rname, method, hs, params)
+	s.runRequest(m, hs, rname, func() {
+		s.processRequest(m, rtype, rname, method, hs, params, received)
 	})
 }
 
@@ -490,7 +869,20 @@ func (s *Service) handleRequest(m *nats.Msg) {
 // The worker ID of the worker is the hs.wid value, if one is set.
 // Otherwise the worker ID will fall back to rname.
 func (s *Service) runWith(hs *regHandler, rname string, cb func()) {
-	if atomic.LoadInt32(&s.state) != stateStarted {
+	s.enqueue(nil, hs, rname, cb)
+}
+
+// runRequest enqueues the callback, cb, for the incoming request, m, in the
+// same way as runWith, but applies the overload policy if the work queue
+// has reached the queue limit.
+func (s *Service) runRequest(m *nats.Msg, hs *regHandler, rname string, cb func()) {
+	s.enqueue(m, hs, rname, cb)
+}
+
+// enqueue enqueues the callback, cb, to be called by the worker goroutine.
+// If m is not nil, the queue limit and overload policy is applied.
+func (s *Service) enqueue(m *nats.Msg, hs *regHandler, rname string, cb func()) {
+	if !s.serving() {
 		return
 	}
 
@@ -502,6 +894,23 @@ func (s *Service) runWith(hs *regHandler, rname string, cb func()) {
 	s.mu.Lock()
 	// Get current work queue for the resource
 	w, ok := s.rwork[wid]
+	if m != nil && s.queueLimit > 0 {
+		for ok && len(w.queue) >= s.queueLimit {
+			if s.overload != OverloadBlock {
+				s.mu.Unlock()
+				s.overloaded(m, wid)
+				return
+			}
+			s.queueCond.Wait()
+			if !s.serving() {
+				s.mu.Unlock()
+				s.Debugf("service stopped, rejecting request %s", m.Subject)
+				(&Request{resource: resource{s: s}, msg: m}).error(errShutdown)
+				return
+			}
+			w, ok = s.rwork[wid]
+		}
+	}
 	if !ok {
 		// Create a new work queue and pass it to a worker
 		w = &work{
@@ -526,7 +935,7 @@ func (s *Service) runWith(hs *regHandler, rname string, cb func()) {
 // no matching handlers found.
 func (s *Service) With(rid string, cb func(r Resource)) error {
 	rname, q := parseRID(rid)
-	hs, params := s.patterns.get(rname)
+	hs, params := s.getHandler(rname)
 	if hs == nil {
 		return errHandlerNotFound
 	}
@@ -546,6 +955,46 @@ func (s *Service) With(rid string, cb func(r Resource)) error {
 	return nil
 }
 
+// WithTx matches the resource ID, rid, with the registered Handlers
+// before calling the callback, cb, on the worker goroutine for the
+// resource name, in the same way as With.
+//
+// Any events sent on the resource within the callback are buffered,
+// and only published once the callback returns. If the callback returns
+// an error, or panics, the buffered events are discarded.
+//
+// WithTx will return an error and not call the callback if there are no
+// no matching handlers found.
+func (s *Service) WithTx(rid string, cb func(r Resource) error) error {
+	rname, q := parseRID(rid)
+	hs, params := s.getHandler(rname)
+	if hs == nil {
+		return errHandlerNotFound
+	}
+
+	r := &resource{
+		rname:      rname,
+		pathParams: params,
+		query:      q,
+		s:          s,
+		hs:         hs,
+	}
+
+	s.runWith(hs, rname, func() {
+		r.runTx(cb)
+	})
+
+	return nil
+}
+
+// getHandler gets the registered handlers and path params for the
+// resource name. Returns nil, nil if there is no match.
+func (s *Service) getHandler(rname string) (*regHandler, map[string]string) {
+	s.pmu.RLock()
+	defer s.pmu.RUnlock()
+	return s.patterns.get(rname)
+}
+
 // event marshals the data and publishes it on a subject,
 // and logs it as an outgoing event.
 func (s *Service) event(subj string, data interface{}) {
@@ -555,36 +1004,51 @@ func (s *Service) event(subj string, data interface{}) {
 	}
 
 	payload, err := json.Marshal(data)
-	if err == nil {
-		s.Tracef("<-- %s: %s", subj, payload)
-		err = s.nc.Publish(subj, payload)
-	}
 	if err != nil {
 		s.Logf("error sending event %s: %s", subj, err)
+		return
 	}
+	s.rawEvent(subj, payload)
 }
 
 // rawEvent publishes the payload on a subject,
-// and logs it as an outgoing event.
+// and logs it as an outgoing event. Any tracked references are updated
+// by the event, including system.reset events.
 func (s *Service) rawEvent(subj string, payload []byte) {
 	s.Tracef("<-- %s: %s", subj, payload)
-	err := s.nc.Publish(subj, payload)
+	if s.refs != nil {
+		if rname := eventResource(subj); rname != "" {
+			s.refs.event(rname, subj[len("event.")+len(rname)+1:], payload)
+		} else if subj == "system.reset" {
+			var ev resetEvent
+			if json.Unmarshal(payload, &ev) == nil {
+				s.refs.reset(ev.Resources)
+			}
+		}
+	}
+	err := s.publish(subj, payload)
 	if err != nil {
 		s.Logf("error sending event %s: %s", subj, err)
 	}
 }
 
 // handleReconnect is called when nats has reconnected.
-// It calls a system.reset to have the resgates update their caches.
+// It flushes the outbox, if enabled, or otherwise calls a system.reset
+// to have the resgates update their caches.
 func (s *Service) handleReconnect(_ *nats.Conn) {
+	if s.setOutboxOffline(false) {
+		s.Logf("Reconnected to NATS. Flushed outbox.")
+		return
+	}
 	s.Logf("Reconnected to NATS. Sending reset event.")
 	s.ResetAll()
 }
 
 // handleDisconnect is called when nats is disconnected.
-// It calls a system.reset to have the resgates update their caches.
+// It sets the outbox, if enabled, to hold any events until reconnected.
 func (s *Service) handleDisconnect(_ *nats.Conn) {
 	s.Logf("Lost connection to NATS.")
+	s.setOutboxOffline(true)
 }
 
 func (s *Service) handleClosed(_ *nats.Conn) {
@@ -622,23 +1086,31 @@ func parseRID(rid string) (rname string, q string) {
 }
 
 // processRequest is executed by the worker to process an incoming request.
-func (s *Service) processRequest(m *nats.Msg, rtype, rname, method string, hs *regHandler, pathParams map[string]string) {
+func (s *Service) processRequest(m *nats.Msg, rtype, rname, method string, hs *regHandler, pathParams map[string]string, received time.Time) {
+	rctx := newRequestContext(s.ctx, received, s.requestTimeout)
 	r := Request{
 		resource: resource{
 			rname:      rname,
 			pathParams: pathParams,
 			s:          s,
 			hs:         hs,
+			ctx:        rctx,
+			inRequest:  true,
 		},
 		rtype:  rtype,
 		method: method,
 		msg:    m,
+		rctx:   rctx,
 	}
+	defer r.done()
 
 	if hs == nil {
 		r.reply(responseNotFound)
 		return
 	}
+	if d := s.handlerTimeoutFor(hs); d > 0 {
+		r.startTimeout(d)
+	}
 
 	var rc resRequest
 	err := json.Unmarshal(m.Data, &rc)
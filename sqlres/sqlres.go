@@ -0,0 +1,670 @@
+/*
+Package sqlres provides an adapter that serves the rows of a database/sql
+table as RES models, and the table itself as a collection of references to
+those models.
+
+Each row is served as a model with the key column and the configured
+columns as properties. The collection contains references to the models,
+ordered by key, and may be queried to filter, order, and limit the result.
+Changes made through the set, new, and delete call methods are written to
+the database, and the matching events are sent, followed by a query event
+for the collection to have gateways update any queried collections.
+
+Usage
+
+Create a table adapter, and register its handlers:
+
+	t := sqlres.NewTable(db, sqlres.Config{
+		Table:      "book",
+		Columns:    []string{"title", "author"},
+		Model:      "library.book",
+		Collection: "library.books",
+	})
+	s.Handle("book.$id",
+		res.Access(res.AccessGranted),
+		t.GetModel(),
+		t.Set(),
+	)
+	s.Handle("books",
+		res.Access(res.AccessGranted),
+		t.GetCollection(),
+		t.New(),
+		t.Delete(),
+	)
+
+Queries
+
+The collection may be requested with a query, such as:
+
+	library.books?author=George+Orwell&order=-title&limit=10
+
+A query consists of any of the following parameters:
+
+	<column>  Only include rows where the column equals the value.
+	order     Order by the column, or in descending order if prefixed with "-".
+	limit     Maximum number of rows to include.
+	offset    Number of rows to skip. Requires limit to be set.
+
+The query is parsed with url.ParseQuery. Unlike Resource.ParseQuery, which
+silently discards malformed pairs, a malformed query results in a
+system.invalidQuery error, as does any other parameter.
+*/
+package sqlres
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Query parameters with special meaning
+const (
+	QueryOrder  = "order"
+	QueryLimit  = "limit"
+	QueryOffset = "offset"
+)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config describes how a table is mapped to resources.
+type Config struct {
+	// Table is the name of the database table.
+	Table string
+
+	// Key is the name of the primary key column. Defaults to "id".
+	Key string
+
+	// StringKey tells that the key column holds strings, such as a TEXT
+	// column. By default, the key column holds integers, and a model
+	// resource name with a key not in its canonical integer form, such as
+	// "library.book.007", is not found.
+	StringKey bool
+
+	// Columns are the names of the columns, other than the key, served as
+	// model properties.
+	Columns []string
+
+	// Model is the resource name prefix of the models, such as
+	// "library.book". The resource name of a model is the prefix, a dot,
+	// and the key of the row, such as "library.book.42".
+	Model string
+
+	// Collection is the resource name of the collection, such as
+	// "library.books". Optional if the collection handlers are not used.
+	Collection string
+
+	// Placeholder returns the parameter placeholder for the n:th argument of
+	// a statement, starting at 1. Defaults to returning "?".
+	// Use Dollar for drivers such as PostgreSQL.
+	Placeholder func(n int) string
+}
+
+// request is a request that may be responded to with an error.
+type request interface {
+	res.Resource
+	Error(err *res.Error)
+}
+
+// Table serves the rows of a database table as models, and the table as a
+// collection of model references.
+type Table struct {
+	db      *sql.DB
+	c       Config
+	columns map[string]bool
+}
+
+// Dollar returns a placeholder on the form $n, as used by PostgreSQL.
+func Dollar(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// NewTable creates a new table adapter using the database and config.
+// Panics if a table, key, or column name is not a valid identifier, or if
+// the model resource name prefix is missing.
+func NewTable(db *sql.DB, c Config) *Table {
+	if c.Key == "" {
+		c.Key = "id"
+	}
+	if c.Placeholder == nil {
+		c.Placeholder = func(int) string { return "?" }
+	}
+	if c.Model == "" {
+		panic("sqlres: missing model resource name prefix")
+	}
+	validateIdentifier(c.Table)
+	validateIdentifier(c.Key)
+
+	columns := make(map[string]bool, len(c.Columns))
+	for _, col := range c.Columns {
+		validateIdentifier(col)
+		if col == c.Key {
+			panic("sqlres: key column " + strconv.Quote(col) + " listed in columns")
+		}
+		if col == QueryOrder || col == QueryLimit || col == QueryOffset {
+			panic("sqlres: column name " + strconv.Quote(col) + " is reserved")
+		}
+		if columns[col] {
+			panic("sqlres: duplicate column " + strconv.Quote(col))
+		}
+		columns[col] = true
+	}
+	c.Columns = append([]string{}, c.Columns...)
+
+	return &Table{db: db, c: c, columns: columns}
+}
+
+// GetModel returns a handler option that responds to model get requests
+// with the row matching the key of the resource name, or with
+// system.notFound if there is no such row.
+func (t *Table) GetModel() res.HandlerOption {
+	return res.GetModel(func(r res.ModelRequest) {
+		key, ok := t.modelKey(r)
+		if !ok {
+			r.NotFound()
+			return
+		}
+		m, err := t.row(key)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		if m == nil {
+			r.NotFound()
+			return
+		}
+		r.Model(m)
+	})
+}
+
+// Set returns a handler option that handles set call requests on models.
+// The parameters must be an object with column names as keys. The row is
+// updated, a change event is sent with the properties that changed, and a
+// query event is sent for the collection.
+func (t *Table) Set() res.HandlerOption {
+	return res.Set(func(r res.CallRequest) {
+		cols, args, err := t.parseValues(r.RawParams(), false)
+		if err != nil {
+			r.InvalidParams(err.Error())
+			return
+		}
+
+		key, ok := t.modelKey(r)
+		if !ok {
+			r.NotFound()
+			return
+		}
+		old, err := t.row(key)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		if old == nil {
+			r.NotFound()
+			return
+		}
+
+		if len(cols) > 0 {
+			var b strings.Builder
+			b.WriteString("UPDATE " + t.c.Table + " SET ")
+			for i, col := range cols {
+				if i > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteString(col + " = " + t.c.Placeholder(i+1))
+			}
+			b.WriteString(" WHERE " + t.c.Key + " = " + t.c.Placeholder(len(cols)+1))
+			if _, err := t.db.Exec(b.String(), append(args, key)...); err != nil {
+				t.error(r, err)
+				return
+			}
+
+			m, err := t.row(key)
+			if err != nil {
+				t.error(r, err)
+				return
+			}
+			if m == nil {
+				r.NotFound()
+				return
+			}
+			r.ChangeEventDiff(old, m)
+			t.queryEvent(r)
+		}
+		r.OK(nil)
+	})
+}
+
+// GetCollection returns a handler option that responds to collection get
+// requests with references to the models of the rows, ordered by key
+// unless the query specifies another order.
+func (t *Table) GetCollection() res.HandlerOption {
+	return res.GetCollection(func(r res.CollectionRequest) {
+		q := r.Query()
+		stmt, args, norm, err := t.parseQuery(q)
+		if err != nil {
+			r.Error(&res.Error{Code: res.CodeInvalidQuery, Message: err.Error()})
+			return
+		}
+		refs, err := t.refs(stmt, args)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		if q == "" {
+			r.Collection(refs)
+		} else {
+			r.QueryCollection(refs, norm)
+		}
+	})
+}
+
+// New returns a handler option that handles new call requests on the
+// collection. The parameters must be an object with column names as keys,
+// optionally including the key column. If no key is given, the key is
+// taken from the id generated by the database. The key is required if
+// StringKey is set. The row is inserted, and an
+// add event followed by a query event is sent on the collection.
+func (t *Table) New() res.HandlerOption {
+	return res.New(func(r res.NewRequest) {
+		cols, args, err := t.parseValues(r.RawParams(), true)
+		if err != nil {
+			r.InvalidParams(err.Error())
+			return
+		}
+
+		var key interface{}
+		phs := make([]string, len(cols))
+		for i, col := range cols {
+			phs[i] = t.c.Placeholder(i + 1)
+			if col == t.c.Key {
+				key = args[i]
+			}
+		}
+		if key == nil && t.c.StringKey {
+			r.InvalidParams("missing " + t.c.Key)
+			return
+		}
+		stmt := "INSERT INTO " + t.c.Table + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(phs, ", ") + ")"
+		result, err := t.db.Exec(stmt, args...)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		if key == nil {
+			id, err := result.LastInsertId()
+			if err != nil {
+				t.error(r, err)
+				return
+			}
+			key = id
+		}
+
+		idx, err := t.index(key)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		ref := t.modelRef(keyString(key))
+		r.AddEvent(ref, idx)
+		r.QueryEvent(t.query)
+		r.New(ref)
+	})
+}
+
+// Delete returns a handler option that handles delete call requests on the
+// collection. The parameters must be an object with the key of the row to
+// delete, such as {"id":42}. The row is deleted, a remove event followed
+// by a query event is sent on the collection, and a delete event is sent
+// on the model.
+func (t *Table) Delete() res.HandlerOption {
+	return res.Call("delete", func(r res.CallRequest) {
+		var p map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(r.RawParams()))
+		dec.UseNumber()
+		if dec.Decode(&p) != nil || p[t.c.Key] == nil {
+			r.InvalidParams("missing " + t.c.Key)
+			return
+		}
+		key, ok := t.jsonKey(p[t.c.Key])
+		if !ok {
+			r.InvalidParams("invalid " + t.c.Key)
+			return
+		}
+
+		idx, err := t.index(key)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		result, err := t.db.Exec("DELETE FROM "+t.c.Table+" WHERE "+t.c.Key+" = "+t.c.Placeholder(1), key)
+		if err != nil {
+			t.error(r, err)
+			return
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			r.NotFound()
+			return
+		}
+
+		r.RemoveEvent(idx)
+		r.QueryEvent(t.query)
+		rid := string(t.modelRef(keyString(key)))
+		if err := r.Service().With(rid, func(m res.Resource) {
+			m.DeleteEvent()
+		}); err != nil {
+			r.Service().Logf("sqlres: error sending delete event on %s: %s", rid, err)
+		}
+		r.OK(nil)
+	})
+}
+
+// row returns the row with the key as a model, or nil if there is no such
+// row.
+func (t *Table) row(key interface{}) (map[string]interface{}, error) {
+	cols := append([]string{t.c.Key}, t.c.Columns...)
+	stmt := "SELECT " + strings.Join(cols, ", ") + " FROM " + t.c.Table + " WHERE " + t.c.Key + " = " + t.c.Placeholder(1)
+	rows, err := t.db.Query(stmt, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	vs := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vs {
+		ptrs[i] = &vs[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(cols))
+	for i, col := range cols {
+		m[col] = modelValue(vs[i])
+	}
+	return m, rows.Err()
+}
+
+// refs returns the references to the models of the rows selected by the
+// statement.
+func (t *Table) refs(stmt string, args []interface{}) ([]res.Ref, error) {
+	rows, err := t.db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []res.Ref{}
+	for rows.Next() {
+		var v interface{}
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		refs = append(refs, t.modelRef(keyString(v)))
+	}
+	return refs, rows.Err()
+}
+
+// index returns the index in the unqueried collection of the row with the
+// key.
+func (t *Table) index(key interface{}) (int, error) {
+	var n int
+	err := t.db.QueryRow("SELECT COUNT(*) FROM "+t.c.Table+" WHERE "+t.c.Key+" < "+t.c.Placeholder(1), key).Scan(&n)
+	return n, err
+}
+
+// parseQuery parses the collection query, and returns the select
+// statement, its arguments, and the normalized query.
+func (t *Table) parseQuery(q string) (string, []interface{}, string, error) {
+	vals, err := url.ParseQuery(q)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("malformed query: %s", err)
+	}
+
+	norm := url.Values{}
+	var where []string
+	var args []interface{}
+	order := t.c.Key + " ASC"
+	limit, offset := -1, -1
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	// Sort the keys to get a deterministic statement
+	sort.Strings(keys)
+	for _, k := range keys {
+		vs := vals[k]
+		if len(vs) > 1 {
+			return "", nil, "", fmt.Errorf("multiple values for %s", k)
+		}
+		v := vs[0]
+		switch {
+		case k == QueryOrder:
+			col := strings.TrimPrefix(v, "-")
+			if col != t.c.Key && !t.columns[col] {
+				return "", nil, "", fmt.Errorf("invalid order column %s", strconv.Quote(col))
+			}
+			order = col + " ASC"
+			if col != v {
+				order = col + " DESC"
+			}
+			if col != t.c.Key {
+				order += ", " + t.c.Key
+			}
+		case k == QueryLimit || k == QueryOffset:
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return "", nil, "", fmt.Errorf("invalid %s %s", k, strconv.Quote(v))
+			}
+			if k == QueryLimit {
+				limit = n
+			} else {
+				offset = n
+			}
+		case k == t.c.Key || t.columns[k]:
+			where = append(where, k+" = "+t.c.Placeholder(len(args)+1))
+			args = append(args, v)
+		default:
+			return "", nil, "", fmt.Errorf("invalid query parameter %s", strconv.Quote(k))
+		}
+		norm.Set(k, v)
+	}
+	if offset >= 0 && limit < 0 {
+		return "", nil, "", fmt.Errorf("offset requires limit")
+	}
+
+	stmt := "SELECT " + t.c.Key + " FROM " + t.c.Table
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY " + order
+	if limit >= 0 {
+		stmt += " LIMIT " + t.c.Placeholder(len(args)+1)
+		args = append(args, limit)
+		if offset >= 0 {
+			stmt += " OFFSET " + t.c.Placeholder(len(args)+1)
+			args = append(args, offset)
+		}
+	}
+	return stmt, args, norm.Encode(), nil
+}
+
+// parseValues parses the JSON object of column values, and returns the
+// column names in config order, and the matching arguments. If allowKey is
+// true, the key column may be included first.
+func (t *Table) parseValues(params json.RawMessage, allowKey bool) ([]string, []interface{}, error) {
+	var p map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	if len(params) > 0 {
+		if err := dec.Decode(&p); err != nil {
+			return nil, nil, fmt.Errorf("parameters must be an object")
+		}
+	}
+
+	for k := range p {
+		if !t.columns[k] && !(allowKey && k == t.c.Key) {
+			return nil, nil, fmt.Errorf("unknown column %s", strconv.Quote(k))
+		}
+	}
+
+	var cols []string
+	var args []interface{}
+	add := func(col string) error {
+		v, ok := p[col]
+		if !ok {
+			return nil
+		}
+		arg, ok := jsonArg(v)
+		if col == t.c.Key {
+			arg, ok = t.jsonKey(v)
+		}
+		if !ok {
+			return fmt.Errorf("invalid value for column %s", strconv.Quote(col))
+		}
+		cols = append(cols, col)
+		args = append(args, arg)
+		return nil
+	}
+	if allowKey {
+		if err := add(t.c.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, col := range t.c.Columns {
+		if err := add(col); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cols, args, nil
+}
+
+// modelKey returns the key argument taken from the resource name of the
+// model. Returns false if the key is not a valid key of the key column.
+func (t *Table) modelKey(r res.Resource) (interface{}, bool) {
+	key := strings.TrimPrefix(r.ResourceName(), t.c.Model+".")
+	if t.c.StringKey {
+		return key, true
+	}
+	n, err := strconv.ParseInt(key, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != key {
+		return nil, false
+	}
+	return n, true
+}
+
+// jsonKey converts a decoded JSON value to a key argument. Returns false
+// if the value is not a string for a string key, or an integer otherwise.
+func (t *Table) jsonKey(v interface{}) (interface{}, bool) {
+	if t.c.StringKey {
+		s, ok := v.(string)
+		return s, ok
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+// modelRef returns a reference to the model with the key.
+func (t *Table) modelRef(key string) res.Ref {
+	return res.Ref(t.c.Model + "." + key)
+}
+
+// queryEvent sends a query event for the collection, if set, so that
+// gateways update any queried collections.
+func (t *Table) queryEvent(r res.Resource) {
+	if t.c.Collection == "" {
+		return
+	}
+	if err := r.Service().With(t.c.Collection, func(c res.Resource) {
+		c.QueryEvent(t.query)
+	}); err != nil {
+		r.Service().Logf("sqlres: error sending query event on %s: %s", t.c.Collection, err)
+	}
+}
+
+// query responds to a query request on a query event for the collection
+// with the queried collection, as the events transforming the previous
+// result are not known.
+func (t *Table) query(r res.QueryRequest) {
+	if r == nil {
+		return
+	}
+	stmt, args, _, err := t.parseQuery(r.Query())
+	if err != nil {
+		r.Error(&res.Error{Code: res.CodeInvalidQuery, Message: err.Error()})
+		return
+	}
+	refs, err := t.refs(stmt, args)
+	if err != nil {
+		t.error(r, err)
+		return
+	}
+	r.Collection(refs)
+}
+
+// error logs the database error and responds with an internal error,
+// without exposing the error to the client.
+func (t *Table) error(r request, err error) {
+	r.Service().Logf("sqlres: error on %s: %s", r.ResourceName(), err)
+	r.Error(res.ErrInternalError)
+}
+
+// validateIdentifier panics if name is not a valid SQL identifier.
+func validateIdentifier(name string) {
+	if !identifierPattern.MatchString(name) {
+		panic("sqlres: invalid identifier " + strconv.Quote(name))
+	}
+}
+
+// keyString returns the string representation of a key value.
+func keyString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonArg converts a decoded JSON primitive to a statement argument.
+// Returns false if the value is an object or an array.
+func jsonArg(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, true
+		}
+		f, err := v.Float64()
+		return f, err == nil
+	case string, bool, nil:
+		return v, true
+	}
+	return nil, false
+}
+
+// modelValue converts a scanned column value to a model property value.
+func modelValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The default number of log records written before a snapshot is made.
+const defaultSnapshotLimit = 1000
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+)
+
+// FilePersister is a Persister storing the values in a directory on local
+// disk. Each change is appended to a log file. Once the log grows beyond
+// the snapshot limit, a snapshot of all values is written, and the log is
+// truncated.
+type FilePersister struct {
+	mu      sync.Mutex
+	dir     string
+	log     *os.File
+	logSize int // Number of records in the log file
+	limit   int // Number of records in the log file before a snapshot is made
+	records map[string]*fileRecord
+}
+
+// fileRecord is a persisted value, with the version of the last saved and
+// the last published change.
+type fileRecord struct {
+	Version    uint64          `json:"version"`
+	Published  uint64          `json:"published"`
+	Collection bool            `json:"collection,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+// logRecord is a record in the log file.
+type logRecord struct {
+	Op         string          `json:"op"`
+	RID        string          `json:"rid"`
+	Version    uint64          `json:"version"`
+	Collection bool            `json:"collection,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+// Log record operations
+const (
+	opSave      = "save"
+	opPublished = "published"
+)
+
+// OpenFile creates a new store persisted in the directory, dir, using a
+// FilePersister. Any values previously persisted in the directory are
+// restored. The directory is created if it does not exist.
+func OpenFile(dir string) (*Store, error) {
+	p, err := NewFilePersister(dir)
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewWithPersister(p)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// NewFilePersister creates a FilePersister storing values in the
+// directory, dir, reading any snapshot and log file in it.
+// The directory is created if it does not exist.
+func NewFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	p := &FilePersister{
+		dir:     dir,
+		limit:   defaultSnapshotLimit,
+		records: make(map[string]*fileRecord),
+	}
+	if err := p.readSnapshot(); err != nil {
+		return nil, err
+	}
+	complete, err := p.readLog()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.log = f
+
+	// Replace an incomplete log with a snapshot, so that new records are
+	// not appended after the incomplete record.
+	if !complete {
+		if err := p.snapshot(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// SetSnapshotLimit sets the number of records written to the log file
+// before a snapshot is made. Default is 1000.
+func (p *FilePersister) SetSnapshotLimit(limit int) *FilePersister {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+	return p
+}
+
+// Load returns all persisted values, sorted by resource name.
+func (p *FilePersister) Load() ([]Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	recs := make([]Record, 0, len(p.records))
+	for rname, fr := range p.records {
+		recs = append(recs, Record{
+			ResourceName: rname,
+			Collection:   fr.Collection,
+			Value:        fr.Value,
+			Published:    fr.Published == fr.Version,
+		})
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ResourceName < recs[j].ResourceName })
+	return recs, nil
+}
+
+// Save appends the value to the log file as a new unpublished version.
+func (p *FilePersister) Save(rname string, collection bool, value json.RawMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fr := p.records[rname]
+	var version uint64 = 1
+	if fr != nil {
+		version = fr.Version + 1
+	}
+	lr := logRecord{Op: opSave, RID: rname, Version: version, Collection: collection, Value: value}
+	if err := p.append(lr); err != nil {
+		return err
+	}
+	p.apply(lr)
+	return p.snapshotIfNeeded()
+}
+
+// Published appends a record to the log file, marking the last saved
+// version as published.
+func (p *FilePersister) Published(rname string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fr := p.records[rname]
+	if fr == nil || fr.Published == fr.Version {
+		return nil
+	}
+	lr := logRecord{Op: opPublished, RID: rname, Version: fr.Version}
+	if err := p.append(lr); err != nil {
+		return err
+	}
+	p.apply(lr)
+	return p.snapshotIfNeeded()
+}
+
+// Close closes the log file.
+func (p *FilePersister) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.log.Close()
+}
+
+// apply applies a log record to the persisted records.
+func (p *FilePersister) apply(lr logRecord) {
+	fr := p.records[lr.RID]
+	if fr == nil {
+		fr = &fileRecord{}
+		p.records[lr.RID] = fr
+	}
+	switch lr.Op {
+	case opSave:
+		fr.Version = lr.Version
+		fr.Collection = lr.Collection
+		fr.Value = lr.Value
+	case opPublished:
+		fr.Published = lr.Version
+	}
+	// Published deletions need not be remembered
+	if fr.Value == nil && fr.Published == fr.Version {
+		delete(p.records, lr.RID)
+	}
+}
+
+// append writes a record to the log file, and syncs it to stable storage.
+func (p *FilePersister) append(lr logRecord) error {
+	data, err := json.Marshal(lr)
+	if err != nil {
+		return err
+	}
+	if _, err = p.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	p.logSize++
+	return p.log.Sync()
+}
+
+// snapshotIfNeeded writes a snapshot, and truncates the log file, if the
+// log has reached the snapshot limit.
+func (p *FilePersister) snapshotIfNeeded() error {
+	if p.logSize < p.limit {
+		return nil
+	}
+	return p.snapshot()
+}
+
+// snapshot writes a snapshot of all records, and truncates the log file.
+func (p *FilePersister) snapshot() error {
+	data, err := json.Marshal(p.records)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(p.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(p.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err = p.log.Truncate(0); err != nil {
+		return err
+	}
+	p.logSize = 0
+	return nil
+}
+
+// readSnapshot reads the snapshot file, if it exists.
+func (p *FilePersister) readSnapshot() error {
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.records)
+}
+
+// readLog reads and applies the records of the log file, if it exists.
+// An incomplete last record, caused by an interrupted write, is ignored,
+// and false is returned.
+func (p *FilePersister) readLog() (bool, error) {
+	f, err := os.Open(filepath.Join(p.dir, logFile))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<26)
+	for sc.Scan() {
+		var lr logRecord
+		if json.Unmarshal(sc.Bytes(), &lr) != nil {
+			return false, nil
+		}
+		p.apply(lr)
+		p.logSize++
+	}
+	return true, sc.Err()
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Persister persists the values of a store, so that they may be restored
+// after a restart.
+//
+// Each change is saved before the matching events are sent, and marked as
+// published once they are sent. A change that is saved but never marked as
+// published, such as when the service stops in between, means that
+// gateways may hold a stale copy of the resource.
+type Persister interface {
+	// Load returns all persisted values.
+	Load() ([]Record, error)
+
+	// Save persists the value of a resource as unpublished.
+	// A nil value means the resource is deleted.
+	Save(rname string, collection bool, value json.RawMessage) error
+
+	// Published marks the last saved value of a resource as published.
+	Published(rname string) error
+}
+
+// Record is a persisted value of a resource.
+type Record struct {
+	// ResourceName is the name of the resource.
+	ResourceName string
+
+	// Collection is true if the value is a collection, otherwise false.
+	Collection bool
+
+	// Value is the JSON encoded model or collection.
+	// Nil if the resource is deleted.
+	Value json.RawMessage
+
+	// Published is true if the events of the last change of the value
+	// has been sent.
+	Published bool
+}
+
+// NewWithPersister creates a new store, restoring the values loaded from
+// the persister. Any changes made to the store are saved using the
+// persister.
+func NewWithPersister(p Persister) (*Store, error) {
+	recs, err := p.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	st := New()
+	st.p = p
+	st.pending = make(map[string]bool)
+	for _, rec := range recs {
+		if !rec.Published {
+			st.pending[rec.ResourceName] = true
+		}
+		if rec.Value == nil {
+			continue
+		}
+		e := &entry{collection: rec.Collection}
+		if rec.Collection {
+			err = json.Unmarshal(rec.Value, &e.values)
+		} else {
+			e.model = rec.Value
+		}
+		if err != nil {
+			return nil, err
+		}
+		st.entries[rec.ResourceName] = e
+	}
+	return st, nil
+}
+
+// ResetResources returns the sorted names of the resources that had
+// changes not marked as published when the store was restored. Gateways
+// may hold stale copies of these resources, which should be reset once
+// the service is started. See ResetPending.
+func (st *Store) ResetResources() []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	rnames := make([]string, 0, len(st.pending))
+	for rname := range st.pending {
+		rnames = append(rnames, rname)
+	}
+	sort.Strings(rnames)
+	return rnames
+}
+
+// ResetPending sends a system reset event for the resources returned by
+// ResetResources, and clears the list of resources. No event is sent if
+// there are no such resources. Access is not reset.
+//
+// It is meant to replace the initial reset of all resources sent when the
+// service is started, using Service.SetOnServe, so that gateways only
+// refetch the resources that may be stale:
+//
+//  s.SetOnServe(st.ResetPending)
+func (st *Store) ResetPending(s *res.Service) {
+	rnames := st.ResetResources()
+	if len(rnames) == 0 {
+		return
+	}
+	s.Reset(rnames, nil)
+	st.mu.Lock()
+	for _, rname := range rnames {
+		delete(st.pending, rname)
+	}
+	st.mu.Unlock()
+}
+
+// Close closes the persister, if it implements io.Closer.
+func (st *Store) Close() error {
+	if c, ok := st.p.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// save persists the entry for the resource name, if the store has a
+// persister. A nil entry means the resource is deleted.
+func (st *Store) save(rname string, e *entry) error {
+	if st.p == nil {
+		return nil
+	}
+	var value json.RawMessage
+	var collection bool
+	if e != nil {
+		collection = e.collection
+		if collection {
+			data, err := json.Marshal(e.values)
+			if err != nil {
+				return err
+			}
+			value = data
+		} else {
+			value = e.model
+		}
+	}
+	return st.p.Save(rname, collection, value)
+}
+
+// published marks the last saved entry for the resource name as
+// published, if the store has a persister.
+func (st *Store) published(rname string) error {
+	if st.p == nil {
+		return nil
+	}
+	return st.p.Published(rname)
+}
@@ -0,0 +1,455 @@
+/*
+Package store provides an in-memory store of models and collections, keyed by
+resource name, that serves get requests and sends events on updates.
+
+The store keeps the JSON encoding of each value, so that values passed to the
+store may be modified afterwards without affecting the stored state. Updates
+are made through methods that take the res.Resource being updated, and send
+the events matching the change. This ensures that the events always match the
+state served by the get handlers.
+
+Usage
+
+Create a store and use it to handle get requests:
+
+	st := store.New()
+	s.Handle("book.$id",
+		res.Access(res.AccessGranted),
+		st.GetModel(),
+	)
+	s.Handle("books",
+		res.Access(res.AccessGranted),
+		st.GetCollection(),
+	)
+
+Load initial values without sending any events:
+
+	st.LoadModel("library.book.1", Book{ID: 1, Title: "Animal Farm"})
+	st.LoadCollection("library.books", []interface{}{res.Ref("library.book.1")})
+
+Update values from within a handler, or by using Service.With:
+
+	s.With("library.book.1", func(r res.Resource) {
+		st.SetModel(r, Book{ID: 1, Title: "1984"})
+	})
+
+Persistence
+
+A store may persist its values using a Persister, restoring them on restart.
+OpenFile creates a store persisted in a directory on local disk. Instead of
+resetting all resources when the service is started, only the resources with
+changes that may not have reached the gateways before the restart can be
+reset:
+
+	st, err := store.OpenFile("./data")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer st.Close()
+	s.SetOnServe(st.ResetPending)
+*/
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Store errors
+var (
+	ErrNotFound        = errors.New("store: resource not found")
+	ErrWrongType       = errors.New("store: resource is of another type")
+	ErrIndexOutOfRange = errors.New("store: index out of range")
+	ErrNotObject       = errors.New("store: model does not marshal into a JSON object")
+	ErrInvalidValue    = errors.New("store: value is not a primitive or a resource reference")
+)
+
+// Store is an in-memory store of models and collections, keyed by
+// resource name. It is safe for concurrent use.
+type Store struct {
+	mu      sync.RWMutex
+	entries map[string]*entry
+	p       Persister       // Optional persister of the values
+	pending map[string]bool // Resources with unpublished changes when loaded
+}
+
+// entry is a stored model or collection.
+type entry struct {
+	collection bool
+	model      json.RawMessage   // JSON encoded model
+	values     []json.RawMessage // JSON encoded collection values
+}
+
+// New creates a new empty store.
+func New() *Store {
+	return &Store{
+		entries: make(map[string]*entry),
+	}
+}
+
+// GetModel returns a handler option that responds to model get requests
+// with the stored model, or with system.notFound if no model is stored
+// for the resource name.
+func (st *Store) GetModel() res.HandlerOption {
+	return res.GetModel(func(r res.ModelRequest) {
+		m, err := st.Model(r.ResourceName())
+		if err != nil {
+			r.NotFound()
+			return
+		}
+		r.Model(m)
+	})
+}
+
+// GetCollection returns a handler option that responds to collection get
+// requests with the stored collection, or with system.notFound if no
+// collection is stored for the resource name.
+func (st *Store) GetCollection() res.HandlerOption {
+	return res.GetCollection(func(r res.CollectionRequest) {
+		c, err := st.Collection(r.ResourceName())
+		if err != nil {
+			r.NotFound()
+			return
+		}
+		r.Collection(c)
+	})
+}
+
+// Model returns the JSON encoded model stored for the resource name.
+// Returns ErrNotFound if there is no stored value, or ErrWrongType if the
+// stored value is a collection.
+func (st *Store) Model(rname string) (json.RawMessage, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	e, err := st.get(rname, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.model, nil
+}
+
+// Collection returns the JSON encoded values of the collection stored for
+// the resource name.
+// Returns ErrNotFound if there is no stored value, or ErrWrongType if the
+// stored value is a model.
+func (st *Store) Collection(rname string) ([]json.RawMessage, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	e, err := st.get(rname, true)
+	if err != nil {
+		return nil, err
+	}
+	return append([]json.RawMessage{}, e.values...), nil
+}
+
+// LoadModel stores the model for the resource name without sending any
+// events. It may be used to populate the store before the service is
+// started, or to store a newly created resource before responding to a new
+// call request.
+func (st *Store) LoadModel(rname string, model interface{}) error {
+	data, err := marshalModel(model)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.load(rname, &entry{model: data})
+}
+
+// LoadCollection stores the collection for the resource name without
+// sending any events. It may be used to populate the store before the
+// service is started, or to store a newly created resource before
+// responding to a new call request.
+func (st *Store) LoadCollection(rname string, collection []interface{}) error {
+	values, err := marshalValues(collection)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.load(rname, &entry{collection: true, values: values})
+}
+
+// SetModel stores the model for the resource, and sends a change event
+// with the properties that differ from the previously stored model. If no
+// model was stored, a create event is sent instead.
+// Returns ErrWrongType if a collection is stored for the resource.
+func (st *Store) SetModel(r res.Resource, model interface{}) error {
+	data, err := marshalModel(model)
+	if err != nil {
+		return err
+	}
+	e := &entry{model: data}
+	st.mu.Lock()
+	prev, err := st.get(r.ResourceName(), false)
+	st.mu.Unlock()
+	switch err {
+	case nil:
+		return st.update(r, prev, e, func() {
+			r.ChangeEventDiff(prev.model, data)
+		})
+	case ErrNotFound:
+		return st.update(r, nil, e, func() {
+			r.CreateEvent(data)
+		})
+	}
+	return err
+}
+
+// SetCollection stores the collection for the resource, and sends the add
+// and remove events that transforms the previously stored collection into
+// the new one. If no collection was stored, a create event is sent instead.
+// Returns ErrWrongType if a model is stored for the resource.
+func (st *Store) SetCollection(r res.Resource, collection []interface{}) error {
+	values, err := marshalValues(collection)
+	if err != nil {
+		return err
+	}
+	e := &entry{collection: true, values: values}
+	st.mu.Lock()
+	prev, err := st.get(r.ResourceName(), true)
+	st.mu.Unlock()
+	switch err {
+	case nil:
+		return st.update(r, prev, e, func() {
+			r.CollectionDiffEvents(rawValues(prev.values), rawValues(values))
+		})
+	case ErrNotFound:
+		return st.update(r, nil, e, func() {
+			r.CreateEvent(rawValues(values))
+		})
+	}
+	return err
+}
+
+// AddValue inserts the value at index idx of the collection stored for the
+// resource, and sends an add event.
+// Returns ErrNotFound if no collection is stored, ErrWrongType if a model
+// is stored, or ErrIndexOutOfRange if idx is less than 0 or greater than
+// the length of the collection.
+func (st *Store) AddValue(r res.Resource, value interface{}, idx int) error {
+	data, err := marshalValue(value)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	prev, err := st.get(r.ResourceName(), true)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx > len(prev.values) {
+		return ErrIndexOutOfRange
+	}
+	values := make([]json.RawMessage, len(prev.values)+1)
+	copy(values, prev.values[:idx])
+	values[idx] = data
+	copy(values[idx+1:], prev.values[idx:])
+	return st.update(r, prev, &entry{collection: true, values: values}, func() {
+		r.AddEvent(data, idx)
+	})
+}
+
+// RemoveValue removes the value at index idx of the collection stored for
+// the resource, and sends a remove event.
+// Returns ErrNotFound if no collection is stored, ErrWrongType if a model
+// is stored, or ErrIndexOutOfRange if idx is not a valid index.
+func (st *Store) RemoveValue(r res.Resource, idx int) error {
+	st.mu.Lock()
+	prev, err := st.get(r.ResourceName(), true)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(prev.values) {
+		return ErrIndexOutOfRange
+	}
+	values := make([]json.RawMessage, len(prev.values)-1)
+	copy(values, prev.values[:idx])
+	copy(values[idx:], prev.values[idx+1:])
+	return st.update(r, prev, &entry{collection: true, values: values}, func() {
+		r.RemoveEvent(idx)
+	})
+}
+
+// Delete removes the model or collection stored for the resource, and
+// sends a delete event.
+// Returns ErrNotFound if no value is stored.
+func (st *Store) Delete(r res.Resource) error {
+	st.mu.Lock()
+	prev, ok := st.entries[r.ResourceName()]
+	st.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return st.update(r, prev, nil, func() {
+		r.DeleteEvent()
+	})
+}
+
+// load sets the entry for the resource name, persisting it as published
+// as no events are sent. A nil entry deletes the value.
+// The mu lock must be held when calling load.
+func (st *Store) load(rname string, e *entry) error {
+	if err := st.save(rname, e); err != nil {
+		return err
+	}
+	st.set(rname, e)
+	return st.published(rname)
+}
+
+// update replaces the previous entry, prev, of the resource with the
+// entry e, and calls the callback to send the matching events. The entry
+// is persisted before the events are sent, and set and marked as published
+// once they are sent. A nil entry deletes the value.
+//
+// If sending the events panics, the previous entry is restored and an
+// error is returned. If the events are discarded by a rolled back
+// transaction, the previous entry is restored.
+//
+// The mu lock must not be held when calling update, as it is not held
+// while sending the events. Updates of a resource are expected to be made
+// on the worker goroutine of the resource.
+func (st *Store) update(r res.Resource, prev, e *entry, sendEvents func()) (err error) {
+	rname := r.ResourceName()
+	st.mu.Lock()
+	err = st.save(rname, e)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			st.restore(rname, e, prev)
+			err = fmt.Errorf("store: failed to send events for %s: %v", rname, v)
+		}
+	}()
+	sendEvents()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.set(rname, e)
+	r.OnRollback(func() {
+		st.restore(rname, e, prev)
+	})
+	return st.published(rname)
+}
+
+// restore sets the previous entry, prev, for the resource name, unless the
+// entry has been replaced by another than e. The previous entry is
+// persisted as published.
+func (st *Store) restore(rname string, e, prev *entry) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if cur := st.entries[rname]; cur != e && cur != prev {
+		return
+	}
+	if st.save(rname, prev) == nil {
+		_ = st.published(rname)
+	}
+	st.set(rname, prev)
+}
+
+// set sets the entry for the resource name. A nil entry deletes the value.
+// The mu lock must be held when calling set.
+func (st *Store) set(rname string, e *entry) {
+	if e == nil {
+		delete(st.entries, rname)
+	} else {
+		st.entries[rname] = e
+	}
+}
+
+// get returns the entry for the resource name.
+// The mu lock must be held when calling get.
+func (st *Store) get(rname string, collection bool) (*entry, error) {
+	e, ok := st.entries[rname]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if e.collection != collection {
+		return nil, ErrWrongType
+	}
+	return e, nil
+}
+
+// marshalModel marshals the model, and validates that it is a JSON object
+// with values that are primitives or resource references.
+func marshalModel(model interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	var props map[string]json.RawMessage
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &props) != nil {
+		return nil, ErrNotObject
+	}
+	for _, v := range props {
+		if !isValidValue(v) {
+			return nil, ErrInvalidValue
+		}
+	}
+	return data, nil
+}
+
+// marshalValues marshals and validates each value of the collection.
+func marshalValues(collection []interface{}) ([]json.RawMessage, error) {
+	values := make([]json.RawMessage, len(collection))
+	for i, v := range collection {
+		data, err := marshalValue(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = data
+	}
+	return values, nil
+}
+
+// marshalValue marshals the value, and validates that it is a primitive or
+// a resource reference.
+func marshalValue(v interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidValue(data) {
+		return nil, ErrInvalidValue
+	}
+	return data, nil
+}
+
+// isValidValue reports whether the JSON encoded value is a primitive or a
+// resource reference.
+func isValidValue(data json.RawMessage) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return false
+	}
+	switch data[0] {
+	case '[':
+		return false
+	case '{':
+		var o map[string]json.RawMessage
+		if json.Unmarshal(data, &o) != nil || len(o) != 1 {
+			return false
+		}
+		var rid string
+		return json.Unmarshal(o["rid"], &rid) == nil && res.Ref(rid).IsValid()
+	}
+	return true
+}
+
+// rawValues converts JSON encoded values to a slice of empty interfaces.
+func rawValues(values []json.RawMessage) []interface{} {
+	vs := make([]interface{}, len(values))
+	for i, v := range values {
+		vs[i] = v
+	}
+	return vs
+}
@@ -67,3 +67,41 @@ func TestPanicOnSameParamPlaceholder(t *testing.T) {
 		s.Handle("model.$id.type.$id")
 	}, nil)
 }
+
+// Test that registering an invalid full wildcard pattern results in a panic
+func TestPanicOnInvalidFullWildcardPattern(t *testing.T) {
+	tbl := []string{
+		"model.>.foo",
+		"model.$path>.foo",
+		"model.$>",
+		"model.foo>",
+		"model.$id.$id>",
+	}
+
+	for _, l := range tbl {
+		func() {
+			defer func() {
+				v := recover()
+				if v == nil {
+					t.Errorf("expected pattern %#v to panic, but nothing happened", l)
+				}
+			}()
+
+			res.NewService("test").Handle(l)
+		}()
+	}
+}
+
+// Test that registering the same full wildcard twice results in a panic
+func TestPanicOnDuplicateFullWildcardPattern(t *testing.T) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatalf("expected a panic, but nothing happened")
+		}
+	}()
+
+	s := res.NewService("test")
+	s.Handle("model.>")
+	s.Handle("model.$path>")
+}
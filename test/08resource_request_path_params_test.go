@@ -15,6 +15,10 @@ var resourceRequestPathParamsTestTbl = []struct {
 	{"model.$id", "test.model.42", map[string]string{"id": "42"}},
 	{"model.$type.$id.foo", "test.model.user.42.foo", map[string]string{"type": "user", "id": "42"}},
 	{"model.$id.bar", "test.model.foo.bar", map[string]string{"id": "foo"}},
+	{"model.>", "test.model.foo.bar", nil},
+	{"model.$path>", "test.model.foo", map[string]string{"path": "foo"}},
+	{"model.$path>", "test.model.foo.bar.baz", map[string]string{"path": "foo.bar.baz"}},
+	{"model.$type.$path>", "test.model.user.foo.bar", map[string]string{"type": "user", "path": "foo.bar"}},
 }
 
 // Test PathParams method returns parameters derived from the resource ID.
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+var collectionDiffEventsTestTbl = []struct {
+	Old    []interface{}
+	New    []interface{}
+	Events int
+}{
+	{[]interface{}{}, []interface{}{}, 0},
+	{[]interface{}{"a", "b", "c"}, []interface{}{"a", "b", "c"}, 0},
+	{[]interface{}{}, []interface{}{"a", "b"}, 2},
+	{[]interface{}{"a", "b"}, []interface{}{}, 2},
+	{[]interface{}{"a", "b", "c"}, []interface{}{"a", "c"}, 1},
+	{[]interface{}{"a", "c"}, []interface{}{"a", "b", "c"}, 1},
+	{[]interface{}{"a", "b", "c"}, []interface{}{"c", "b", "a"}, 4},
+	{[]interface{}{"a", "b", "c", "d"}, []interface{}{"b", "x", "d", "e"}, 4},
+	{[]interface{}{1, 2, 3, 4, 5}, []interface{}{0, 1, 3, 5, 6}, 4},
+	{[]interface{}{nil, true, 42.0}, []interface{}{42, nil, false}, 4},
+	{
+		[]interface{}{res.Ref("test.model.a"), res.Ref("test.model.b")},
+		[]interface{}{res.Ref("test.model.b"), "test.model.a"},
+		2,
+	},
+	// Too large to compare, replacing all values
+	{intValues(0, 1), intValues(1024, -1), 2050},
+	{
+		append(append([]interface{}{"a"}, intValues(0, 1)...), "z"),
+		append(append([]interface{}{"a"}, intValues(1024, -1)...), "z"),
+		2050,
+	},
+}
+
+// intValues returns a collection of 1025 integers, starting from start
+// and increasing by step.
+func intValues(start, step int) []interface{} {
+	vs := make([]interface{}, 1025)
+	for i := range vs {
+		vs[i] = start + i*step
+	}
+	return vs
+}
+
+// Test that CollectionDiffEvents sends a minimal sequence of add and remove events
+// transforming the old collection into the new one.
+func TestCollectionDiffEvents(t *testing.T) {
+	for i, l := range collectionDiffEventsTestTbl {
+		runTest(t, func(s *Session) {
+			s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }))
+		}, func(s *Session) {
+			AssertNoError(t, s.With("test.collection", func(r res.Resource) {
+				r.CollectionDiffEvents(l.Old, l.New)
+				r.Event("done", nil)
+			}))
+
+			// Apply events to a copy of the old collection
+			var col []interface{}
+			_, oj := jsonMap(t, l.Old)
+			AssertNoError(t, json.Unmarshal(oj, &col))
+			c := 0
+			for {
+				m := s.GetMsg(t)
+				if m.Subject == "event.test.collection.done" {
+					break
+				}
+				c++
+				ev := m.Payload.(map[string]interface{})
+				idx := int(ev["idx"].(float64))
+				switch m.Subject {
+				case "event.test.collection.add":
+					col = append(col, nil)
+					copy(col[idx+1:], col[idx:])
+					col[idx] = ev["value"]
+				case "event.test.collection.remove":
+					col = append(col[:idx], col[idx+1:]...)
+				default:
+					t.Fatalf("unexpected event %#v", m.Subject)
+				}
+			}
+			if !AssertEqual(t, "collection", col, l.New) {
+				t.Logf("failed on test %d", i)
+			}
+			AssertEqual(t, "event count", c, l.Events)
+		})
+	}
+}
+
+// Test that CollectionDiffEvents panics if the resource is a model.
+func TestCollectionDiffEventsPanicsOnModel(t *testing.T) {
+	runTestAsync(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+	}, func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					t.Errorf("expected CollectionDiffEvents to panic, but nothing happened")
+				}
+				done()
+			}()
+			r.CollectionDiffEvents([]interface{}{"a"}, []interface{}{"b"})
+		}))
+	})
+}
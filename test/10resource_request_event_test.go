@@ -85,13 +85,14 @@ func TestEventUsingWith(t *testing.T) {
 }
 
 // Test method Event panic if the event is one of the pre-defined or reserved events,
-// "change", "delete", "add", "remove", "patch", "reaccess", or "unsubscribe". Or if the event name is invalid.
+// "change", "delete", "create", "add", "remove", "patch", "reaccess", or "unsubscribe". Or if the event name is invalid.
 func TestEventPanicsOnInvalid(t *testing.T) {
 	tbl := []struct {
 		Event string
 	}{
 		{"change"},
 		{"delete"},
+		{"create"},
 		{"add"},
 		{"remove"},
 		{"patch"},
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that service middleware wraps handlers of all request types.
+func TestServiceMiddleware(t *testing.T) {
+	tbl := []struct {
+		Subject string
+		Type    string
+		Method  string
+	}{
+		{"access.test.model", "access", ""},
+		{"get.test.model", "get", ""},
+		{"call.test.model.method", "call", "method"},
+		{"call.test.model.new", "call", "new"},
+		{"auth.test.model.method", "auth", "method"},
+	}
+
+	for _, l := range tbl {
+		var called int
+		runTest(t, func(s *Session) {
+			s.Use(func(next res.RequestHandler) res.RequestHandler {
+				return func(r *res.Request) {
+					called++
+					AssertEqual(t, "Type", r.Type(), l.Type)
+					AssertEqual(t, "Method", r.Method(), l.Method)
+					next(r)
+				}
+			})
+			s.Handle("model",
+				res.Access(res.AccessGranted),
+				res.GetModel(func(r res.ModelRequest) { r.NotFound() }),
+				res.Call("method", func(r res.CallRequest) { r.NotFound() }),
+				res.New(func(r res.NewRequest) { r.NotFound() }),
+				res.Auth("method", func(r res.AuthRequest) { r.NotFound() }),
+			)
+		}, func(s *Session) {
+			inb := s.Request(l.Subject, newDefaultRequest())
+			m := s.GetMsg(t).AssertSubject(t, inb)
+			if l.Type != "access" {
+				m.AssertError(t, res.ErrNotFound)
+			}
+			AssertEqual(t, "called", called, 1)
+		})
+	}
+}
+
+// Test that pattern middleware only wraps handlers of its own pattern.
+func TestPatternMiddleware(t *testing.T) {
+	var called int
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.Middleware(func(next res.RequestHandler) res.RequestHandler {
+				return func(r *res.Request) {
+					called++
+					next(r)
+				}
+			}),
+			res.Call("method", func(r res.CallRequest) { r.OK(nil) }),
+		)
+		s.Handle("other", res.Call("method", func(r res.CallRequest) { r.OK(nil) }))
+	}, func(s *Session) {
+		inb := s.Request("call.test.other.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":null}`))
+		AssertEqual(t, "called", called, 0)
+		inb = s.Request("call.test.model.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":null}`))
+		AssertEqual(t, "called", called, 1)
+	})
+}
+
+// Test that service middleware is called before pattern middleware, each in the order added.
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) res.MiddlewareFunc {
+		return func(next res.RequestHandler) res.RequestHandler {
+			return func(r *res.Request) {
+				order = append(order, name)
+				next(r)
+			}
+		}
+	}
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.Middleware(mw("pattern1"), mw("pattern2")),
+			res.Call("method", func(r res.CallRequest) {
+				order = append(order, "handler")
+				r.OK(nil)
+			}),
+		)
+		s.Use(mw("service1"))
+		s.Use(mw("service2"))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		AssertEqual(t, "order", order, []string{"service1", "service2", "pattern1", "pattern2", "handler"})
+	})
+}
+
+// Test that middleware may short-circuit a request by responding with an error.
+func TestMiddlewareShortCircuit(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Use(func(next res.RequestHandler) res.RequestHandler {
+			return func(r *res.Request) {
+				r.Error(res.ErrAccessDenied)
+			}
+		})
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			t.Errorf("expected handler not to be called, but it was")
+			r.OK(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrAccessDenied)
+	})
+}
+
+// Test that middleware may short-circuit a request by panicking with an *Error.
+func TestMiddlewarePanicWithError(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.Middleware(func(next res.RequestHandler) res.RequestHandler {
+				return func(r *res.Request) {
+					panic(res.ErrAccessDenied)
+				}
+			}),
+			res.Call("method", func(r res.CallRequest) {
+				t.Errorf("expected handler not to be called, but it was")
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrAccessDenied)
+	})
+}
+
+// Test that middleware is not called when there is no matching handler.
+func TestMiddlewareOnMethodNotFound(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Use(func(next res.RequestHandler) res.RequestHandler {
+			return func(r *res.Request) {
+				t.Errorf("expected middleware not to be called, but it was")
+				next(r)
+			}
+		})
+		s.Handle("model", res.Call("method", func(r res.CallRequest) { r.OK(nil) }))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.foo", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrMethodNotFound)
+	})
+}
+
+// Test that Use panics if the service is already started.
+func TestUsePanicsWhenStarted(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				t.Fatalf("expected a panic, but nothing happened")
+			}
+		}()
+		s.Use(func(next res.RequestHandler) res.RequestHandler { return next })
+	})
+}
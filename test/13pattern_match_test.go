@@ -0,0 +1,54 @@
+package test
+
+import (
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+var patternMatchTestTbl = []struct {
+	Patterns     []string
+	ResourceName string
+	Expected     string
+}{
+	{[]string{"model.foo", "model.$id", "model.>"}, "test.model.foo", "model.foo"},
+	{[]string{"model.foo", "model.$id", "model.>"}, "test.model.bar", "model.$id"},
+	{[]string{"model.foo", "model.$id", "model.>"}, "test.model.foo.bar", "model.>"},
+	{[]string{"model.$id.bar", "model.$path>"}, "test.model.foo.bar", "model.$id.bar"},
+	{[]string{"model.$id.bar", "model.$path>"}, "test.model.foo.baz", "model.$path>"},
+	{[]string{"model.foo.>", "model.>"}, "test.model.foo.bar", "model.foo.>"},
+	{[]string{"model.foo.>", "model.>"}, "test.model.bar.baz", "model.>"},
+	{[]string{"model.foo.>", "model.>"}, "test.model.foo", "model.>"},
+	{[]string{">"}, "test.model.foo", ">"},
+}
+
+// Test that resource names are matched with the pattern with highest precedence.
+func TestPatternMatchPrecedence(t *testing.T) {
+	for _, l := range patternMatchTestTbl {
+		runTest(t, func(s *Session) {
+			for _, p := range l.Patterns {
+				pattern := p
+				s.Handle(pattern, res.GetModel(func(r res.ModelRequest) {
+					r.Model(map[string]string{"pattern": pattern})
+				}))
+			}
+		}, func(s *Session) {
+			inb := s.Request("get."+l.ResourceName, newRequest())
+			s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, map[string]interface{}{
+				"model": map[string]string{"pattern": l.Expected},
+			})
+		})
+	}
+}
+
+// Test that a full wildcard does not match the pattern without any remaining tokens.
+func TestFullWildcardRequiresToken(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model.>", res.GetModel(func(r res.ModelRequest) {
+			r.Model(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", newRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
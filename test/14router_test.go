@@ -0,0 +1,179 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that a mounted router serves its patterns under the prefix.
+func TestRouterMount(t *testing.T) {
+	tbl := []struct {
+		Prefix       string
+		Pattern      string
+		ResourceName string
+		Expected     map[string]string
+	}{
+		{"admin", "model", "test.admin.model", nil},
+		{"admin", "", "test.admin", nil},
+		{"", "model", "test.model", nil},
+		{"admin.sub", "model.$id", "test.admin.sub.model.42", map[string]string{"id": "42"}},
+		{"tenant.$tid", "model.$id", "test.tenant.foo.model.42", map[string]string{"tid": "foo", "id": "42"}},
+		{"admin", "$path>", "test.admin.foo.bar", map[string]string{"path": "foo.bar"}},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			r := res.NewRouter()
+			r.Handle(l.Pattern, res.GetModel(func(r res.ModelRequest) {
+				AssertEqual(t, "PathParams", r.PathParams(), l.Expected)
+				r.NotFound()
+			}))
+			s.Mount(l.Prefix, r)
+		}, func(s *Session) {
+			inb := s.Request("get."+l.ResourceName, newRequest())
+			s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		})
+	}
+}
+
+// Test that a router mounted onto another router serves its patterns
+// under both prefixes.
+func TestRouterMountOnRouter(t *testing.T) {
+	runTest(t, func(s *Session) {
+		sub := res.NewRouter()
+		sub.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.OK(r.ResourceName())
+		}))
+		r := res.NewRouter()
+		r.Mount("sub", sub)
+		s.Mount("admin", r)
+	}, func(s *Session) {
+		inb := s.Request("call.test.admin.sub.model.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":"test.admin.sub.model"}`))
+	})
+}
+
+// Test that router middleware is called in order between service and pattern middleware.
+func TestRouterMiddleware(t *testing.T) {
+	var order []string
+	mw := func(name string) res.MiddlewareFunc {
+		return func(next res.RequestHandler) res.RequestHandler {
+			return func(r *res.Request) {
+				order = append(order, name)
+				next(r)
+			}
+		}
+	}
+	runTest(t, func(s *Session) {
+		sub := res.NewRouter().Use(mw("sub"))
+		sub.Handle("model",
+			res.Middleware(mw("pattern")),
+			res.Call("method", func(r res.CallRequest) { r.OK(nil) }),
+		)
+		r := res.NewRouter().Use(mw("router"))
+		r.Mount("sub", sub)
+		s.Use(mw("service"))
+		s.Mount("admin", r)
+	}, func(s *Session) {
+		inb := s.Request("call.test.admin.sub.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		AssertEqual(t, "order", order, []string{"service", "router", "sub", "pattern"})
+	})
+}
+
+// Test that the router default access handler is used for patterns without one.
+func TestRouterSetAccess(t *testing.T) {
+	runTest(t, func(s *Session) {
+		r := res.NewRouter().SetAccess(res.AccessGranted)
+		r.Handle("model")
+		r.Handle("denied", res.Access(res.AccessDenied))
+		s.Mount("admin", r)
+	}, func(s *Session) {
+		s.AssertSubscription(t, "access.test.>")
+		inb := s.Request("access.test.admin.model", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"get":true,"call":"*"}}`))
+		inb = s.Request("access.test.admin.denied", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrAccessDenied)
+	})
+}
+
+// Test that the router default group is used for patterns without one.
+func TestRouterSetGroup(t *testing.T) {
+	runTestAsync(t, func(s *Session) {
+		r := res.NewRouter().SetGroup("admin")
+		r.Handle("foo")
+		r.Handle("bar")
+		s.Mount("admin", r)
+	}, func(s *Session, done func()) {
+		ch := make(chan bool)
+		AssertNoError(t, s.With("test.admin.foo", func(r res.Resource) {
+			// Block the group worker until the bar callback has been queued
+			<-ch
+		}))
+		called := false
+		AssertNoError(t, s.With("test.admin.bar", func(r res.Resource) {
+			called = true
+		}))
+		ch <- true
+		AssertNoError(t, s.With("test.admin.foo", func(r res.Resource) {
+			if !called {
+				t.Errorf("expected callbacks to be called in order on the same group, but they weren't")
+			}
+			done()
+		}))
+	})
+}
+
+// Test that registering a pattern on a mounted router results in a panic.
+func TestRouterHandlePanicsWhenMounted(t *testing.T) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatalf("expected a panic, but nothing happened")
+		}
+	}()
+
+	r := res.NewRouter()
+	res.NewService("test").Mount("admin", r)
+	r.Handle("model")
+}
+
+// Test that changing the settings of a mounted router results in a panic.
+func TestRouterSettingsPanicWhenMounted(t *testing.T) {
+	tbl := []func(r *res.Router){
+		func(r *res.Router) { r.Use(func(next res.RequestHandler) res.RequestHandler { return next }) },
+		func(r *res.Router) { r.SetAccess(res.AccessGranted) },
+		func(r *res.Router) { r.SetGroup("foo") },
+		func(r *res.Router) { r.Mount("sub", res.NewRouter()) },
+	}
+	for i, f := range tbl {
+		func() {
+			defer func() {
+				if v := recover(); v != "res: router already mounted" {
+					t.Errorf("expected test %d to panic with %#v, but got %#v", i, "res: router already mounted", v)
+				}
+			}()
+			r := res.NewRouter()
+			res.NewService("test").Mount("admin", r)
+			f(r)
+		}()
+	}
+}
+
+// Test that mounting a router with a pattern already registered results in a panic.
+func TestRouterMountPanicsOnDuplicatePattern(t *testing.T) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatalf("expected a panic, but nothing happened")
+		}
+	}()
+
+	s := res.NewService("test")
+	s.Handle("admin.model")
+	r := res.NewRouter()
+	r.Handle("model")
+	s.Mount("admin", r)
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+type typedParams struct {
+	Value int `json:"value"`
+}
+
+type typedResult struct {
+	Double int `json:"double"`
+}
+
+// Test that TypedCall unmarshals parameters and responds with the result.
+func TestTypedCall(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *typedParams) (*typedResult, error) {
+			return &typedResult{Double: p.Value * 2}, nil
+		}))
+	}, func(s *Session) {
+		req := newRequest()
+		req.Params = json.RawMessage(`{"value":21}`)
+		inb := s.Request("call.test.model.method", req)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"double":42}}`))
+	})
+}
+
+// Test that TypedCall accepts non-pointer parameter and result types.
+func TestTypedCallWithValueTypes(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p typedParams) (int, error) {
+			return p.Value * 2, nil
+		}))
+	}, func(s *Session) {
+		req := newRequest()
+		req.Params = json.RawMessage(`{"value":21}`)
+		inb := s.Request("call.test.model.method", req)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":42}`))
+	})
+}
+
+// Test that TypedCall responds with the returned error.
+func TestTypedCallWithError(t *testing.T) {
+	tbl := []struct {
+		Err      error
+		Expected *res.Error
+	}{
+		{res.ErrNotFound, res.ErrNotFound},
+		{&res.Error{Code: "test.custom", Message: "Custom"}, &res.Error{Code: "test.custom", Message: "Custom"}},
+		{errors.New("foo"), res.InternalError(errors.New("foo"))},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *typedParams) (*typedResult, error) {
+				return nil, l.Err
+			}))
+		}, func(s *Session) {
+			inb := s.Request("call.test.model.method", nil)
+			s.GetMsg(t).AssertSubject(t, inb).AssertError(t, l.Expected)
+		})
+	}
+}
+
+// Test that TypedCall responds with system.invalidParams if parameters fail to unmarshal.
+func TestTypedCallWithInvalidParams(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *typedParams) (*typedResult, error) {
+			t.Errorf("expected handler not to be called, but it was")
+			return nil, nil
+		}))
+	}, func(s *Session) {
+		req := newRequest()
+		req.Params = json.RawMessage(`{"value":"foo"}`)
+		inb := s.Request("call.test.model.method", req)
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+	})
+}
+
+// Test that TypedCall ignores the returned values if a response is already sent.
+func TestTypedCallWithResponseSent(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *typedParams) (*typedResult, error) {
+			r.NotFound()
+			return nil, nil
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
+
+// Test that TypedNew responds with the returned reference.
+func TestTypedNew(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("collection", res.TypedNew(func(r res.NewRequest, p *typedParams) (res.Ref, error) {
+			AssertEqual(t, "value", p.Value, 42)
+			return res.Ref("test.model.42"), nil
+		}))
+	}, func(s *Session) {
+		req := newRequest()
+		req.Params = json.RawMessage(`{"value":42}`)
+		inb := s.Request("call.test.collection.new", req)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"rid":"test.model.42"}}`))
+	})
+}
+
+// Test that TypedAuth unmarshals parameters and responds with the result.
+func TestTypedAuth(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedAuth("method", func(r res.AuthRequest, p *typedParams) (*typedResult, error) {
+			return &typedResult{Double: p.Value * 2}, nil
+		}))
+	}, func(s *Session) {
+		req := newAuthRequest()
+		req.Params = json.RawMessage(`{"value":21}`)
+		inb := s.Request("auth.test.model.method", req)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"double":42}}`))
+	})
+}
+
+// Test that typed handler options panic on invalid function types.
+func TestTypedHandlerPanicsOnInvalidFunction(t *testing.T) {
+	tbl := []func(){
+		func() { res.TypedCall("method", nil) },
+		func() { res.TypedCall("method", 42) },
+		func() { res.TypedCall("method", func(r res.CallRequest) error { return nil }) },
+		func() { res.TypedCall("method", func(r res.CallRequest, p *typedParams) error { return nil }) },
+		func() {
+			res.TypedCall("method", func(r res.AuthRequest, p *typedParams) (int, error) { return 0, nil })
+		},
+		func() {
+			res.TypedCall("method", func(r res.CallRequest, p *typedParams) (int, bool) { return 0, false })
+		},
+		func() { res.TypedNew(func(r res.NewRequest, p *typedParams) (string, error) { return "", nil }) },
+		func() {
+			res.TypedAuth("method", func(r res.CallRequest, p *typedParams) (int, error) { return 0, nil })
+		},
+	}
+
+	for i, l := range tbl {
+		func() {
+			defer func() {
+				v := recover()
+				if v == nil {
+					t.Errorf("expected test %d to panic, but nothing happened", i)
+				}
+			}()
+			l()
+		}()
+	}
+}
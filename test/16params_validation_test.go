@@ -0,0 +1,229 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+type validatedParams struct {
+	Title  string   `json:"title" res:"required,maxlen=10"`
+	Rating *int     `json:"rating,omitempty" res:"min=1,max=5"`
+	Genre  string   `json:"genre,omitempty" res:"omitempty,enum=fiction|poetry"`
+	ISBN   string   `json:"isbn,omitempty" res:"omitempty,pattern=^[0-9]{3,}$"`
+	Tags   []string `json:"tags,omitempty" res:"maxlen=2"`
+	Author *struct {
+		Name string `json:"name" res:"required"`
+	} `json:"author,omitempty"`
+}
+
+var validateParamsTestTbl = []struct {
+	Params   string
+	Expected []res.ValidationError
+}{
+	{`{"title":"foo"}`, nil},
+	{`{"title":"foo","rating":5,"genre":"poetry","isbn":"123","tags":["a","b"],"author":{"name":"bar"}}`, nil},
+	{`{}`, []res.ValidationError{{Field: "title", Message: "is required"}}},
+	{`{"title":"foo bar baz qux"}`, []res.ValidationError{{Field: "title", Message: "must have a length of at most 10"}}},
+	{`{"title":"foo","rating":0}`, []res.ValidationError{{Field: "rating", Message: "must be at least 1"}}},
+	{`{"title":"foo","rating":6}`, []res.ValidationError{{Field: "rating", Message: "must be at most 5"}}},
+	{`{"title":"foo","genre":"drama"}`, []res.ValidationError{{Field: "genre", Message: "must be one of: fiction, poetry"}}},
+	{`{"title":"foo","isbn":"12"}`, []res.ValidationError{{Field: "isbn", Message: "must match pattern ^[0-9]{3,}$"}}},
+	{`{"title":"foo","tags":["a","b","c"]}`, []res.ValidationError{{Field: "tags", Message: "must have a length of at most 2"}}},
+	{`{"title":"foo","author":{}}`, []res.ValidationError{{Field: "author.name", Message: "is required"}}},
+	{`{"rating":6}`, []res.ValidationError{
+		{Field: "title", Message: "is required"},
+		{Field: "rating", Message: "must be at most 5"},
+	}},
+}
+
+var paramsSchemaTestTbl = []struct {
+	Params   string
+	Expected []res.ValidationError
+}{
+	{`{"title":"foo"}`, nil},
+	{`{"title":"foo","rating":5,"tags":["a"]}`, nil},
+	{``, []res.ValidationError{{Field: "title", Message: "is required"}}},
+	{`[]`, []res.ValidationError{{Field: "", Message: "must be of type object"}}},
+	{`{"title":42}`, []res.ValidationError{{Field: "title", Message: "must be of type string"}}},
+	{`{"title":""}`, []res.ValidationError{{Field: "title", Message: "must have a length of at least 1"}}},
+	{`{"title":"foo","rating":1.5}`, []res.ValidationError{{Field: "rating", Message: "must be of type integer"}}},
+	{`{"title":"foo","rating":6}`, []res.ValidationError{{Field: "rating", Message: "must be at most 5"}}},
+	{`{"title":"foo","tags":["a","b","c"]}`, []res.ValidationError{{Field: "tags", Message: "must have at most 2 items"}}},
+	{`{"title":"foo","tags":[42]}`, []res.ValidationError{{Field: "tags.0", Message: "must be of type string"}}},
+	{`{"title":"foo","genre":"drama"}`, []res.ValidationError{{Field: "genre", Message: "must be one of the enumerated values"}}},
+	{`{"title":"foo","isbn":"12"}`, []res.ValidationError{{Field: "isbn", Message: "must match pattern ^[0-9]{3,}$"}}},
+	{`{"title":"foo","foo":"bar"}`, []res.ValidationError{{Field: "foo", Message: "is not allowed"}}},
+}
+
+var paramsSchema = `{
+	"type": "object",
+	"properties": {
+		"title": {"type": "string", "minLength": 1},
+		"rating": {"type": "integer", "minimum": 1, "maximum": 5},
+		"genre": {"enum": ["fiction", "poetry"]},
+		"isbn": {"type": "string", "pattern": "^[0-9]{3,}$"},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	},
+	"required": ["title"],
+	"additionalProperties": false
+}`
+
+func assertValidationResponse(t *testing.T, m *Msg, expected []res.ValidationError) {
+	if expected == nil {
+		m.AssertResult(t, nil)
+	} else {
+		m.AssertError(t, &res.Error{Code: res.CodeInvalidParams, Message: "Invalid parameters", Data: expected})
+	}
+}
+
+// Test that ParseParams validates the parameters using struct tags.
+func TestParseParamsValidation(t *testing.T) {
+	for _, l := range validateParamsTestTbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model", res.Call("method", func(r res.CallRequest) {
+				var p validatedParams
+				r.ParseParams(&p)
+				r.OK(nil)
+			}))
+		}, func(s *Session) {
+			req := newRequest()
+			req.Params = json.RawMessage(l.Params)
+			inb := s.Request("call.test.model.method", req)
+			assertValidationResponse(t, s.GetMsg(t).AssertSubject(t, inb), l.Expected)
+		})
+	}
+}
+
+// Test that ValidateParams validates zero values, unless the field is a nil
+// pointer or has the omitempty rule, and that other tags are ignored.
+func TestValidateParamsZeroValues(t *testing.T) {
+	var p struct {
+		Age     int    `json:"age" res:"min=18"`
+		Limit   *int   `json:"limit" res:"min=1"`
+		Name    string `json:"name" res:"omitempty,minlen=2"`
+		Genre   string `json:"genre" res:"enum=fiction|poetry"`
+		Comment string `json:"comment" validate:"gte=0,foo"`
+	}
+	err := res.ValidateParams(&p)
+	AssertEqual(t, "err", err, &res.Error{Code: res.CodeInvalidParams, Message: "Invalid parameters", Data: []res.ValidationError{
+		{Field: "age", Message: "must be at least 18"},
+		{Field: "genre", Message: "must be one of: fiction, poetry"},
+	}})
+}
+
+// Test that TypedCall validates the parameters using struct tags.
+func TestTypedCallValidation(t *testing.T) {
+	for _, l := range validateParamsTestTbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *validatedParams) (interface{}, error) {
+				return nil, nil
+			}))
+		}, func(s *Session) {
+			req := newRequest()
+			req.Params = json.RawMessage(l.Params)
+			inb := s.Request("call.test.model.method", req)
+			assertValidationResponse(t, s.GetMsg(t).AssertSubject(t, inb), l.Expected)
+		})
+	}
+}
+
+// Test that ParamsSchema validates call parameters before calling the handler.
+func TestParamsSchemaOnCall(t *testing.T) {
+	for _, l := range paramsSchemaTestTbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model",
+				res.ParamsSchema("method", paramsSchema),
+				res.Call("method", func(r res.CallRequest) {
+					r.OK(nil)
+				}),
+			)
+		}, func(s *Session) {
+			req := newRequest()
+			req.Params = json.RawMessage(l.Params)
+			inb := s.Request("call.test.model.method", req)
+			assertValidationResponse(t, s.GetMsg(t).AssertSubject(t, inb), l.Expected)
+		})
+	}
+}
+
+// Test that ParamsSchema validates new and auth parameters before calling the handler.
+func TestParamsSchemaOnNewAndAuth(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.ParamsSchema("new", paramsSchema),
+			res.AuthParamsSchema("login", paramsSchema),
+			res.New(func(r res.NewRequest) {
+				t.Errorf("expected new handler not to be called, but it was")
+				r.New(res.Ref("test.model.42"))
+			}),
+			res.Auth("login", func(r res.AuthRequest) {
+				t.Errorf("expected auth handler not to be called, but it was")
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.new", newRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("auth.test.model.login", newAuthRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+	})
+}
+
+// Test that ParamsSchema does not validate parameters of other methods.
+func TestParamsSchemaOnOtherMethod(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.ParamsSchema("method", paramsSchema),
+			res.Call("other", func(r res.CallRequest) {
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.other", newRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+	})
+}
+
+// Test that call and auth methods with the same name use separate schemas.
+func TestParamsSchemaSeparateForCallAndAuth(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.ParamsSchema("method", paramsSchema),
+			res.Call("method", func(r res.CallRequest) {
+				r.OK(nil)
+			}),
+			res.Auth("method", func(r res.AuthRequest) {
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", newRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("auth.test.model.method", newAuthRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+	})
+}
+
+// Test that ParamsSchema panics on invalid schema documents.
+func TestParamsSchemaPanicsOnInvalidSchema(t *testing.T) {
+	tbl := []interface{}{
+		`{"type":"foo"}`,
+		`{"pattern":"["}`,
+		`{"properties":{"foo":{"type":42}}}`,
+		`[]`,
+	}
+
+	for _, l := range tbl {
+		func() {
+			defer func() {
+				v := recover()
+				if v == nil {
+					t.Errorf("expected schema %s to panic, but nothing happened", l)
+				}
+			}()
+			res.ParamsSchema("method", l)
+		}()
+	}
+}
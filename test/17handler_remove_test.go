@@ -0,0 +1,141 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that Remove unregisters the pattern and sends a system.reset event.
+func TestRemove(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id", res.GetModel(func(r res.ModelRequest) {
+			r.Model(nil)
+		}))
+	}, func(s *Session) {
+		AssertNoError(t, s.Remove("model.$id"))
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{"resources": []string{"test.model.*"}})
+		inb := s.Request("get.test.model.42", newRequest())
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
+
+// Test that Remove matches the pattern regardless of placeholder names.
+func TestRemoveWithOtherPlaceholderNames(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id.$path>", res.Access(res.AccessGranted))
+	}, func(s *Session) {
+		AssertNoError(t, s.Remove("model.$foo.>"))
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{
+				"resources": []string{"test.model.*.>"},
+				"access":    []string{"test.model.*.>"},
+			})
+	})
+}
+
+// Test that Remove returns an error if the pattern is not registered.
+func TestRemoveWithUnregisteredPattern(t *testing.T) {
+	tbl := []string{"model", "model.foo", "model.$id", "model.>", "foo"}
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model.bar.baz")
+			s.Handle("model.$id.bar")
+		}, func(s *Session) {
+			if err := s.Remove(l); err == nil {
+				t.Errorf("expected Remove(%#v) to return an error, but it didn't", l)
+			}
+		})
+	}
+}
+
+// Test that Replace replaces the handlers and sends a system.reset event.
+func TestReplace(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.OK("old")
+		}))
+	}, func(s *Session) {
+		AssertNoError(t, s.Replace("model", res.Handler{
+			Call: map[string]res.CallHandler{
+				"method": func(r res.CallRequest) { r.OK("new") },
+			},
+		}))
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{"resources": []string{"test.model"}})
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":"new"}`))
+	})
+}
+
+// Test that Replace returns an error if the pattern is not registered.
+func TestReplaceWithUnregisteredPattern(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model")
+	}, func(s *Session) {
+		if err := s.Replace("foo", res.Handler{}); err == nil {
+			t.Errorf("expected Replace to return an error, but it didn't")
+		}
+	})
+}
+
+// Test that requests being handled by a replaced handler are allowed to complete.
+func TestReplaceWithRequestInProgress(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			close(started)
+			<-release
+			r.OK("old")
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		<-started
+		AssertNoError(t, s.Replace("model", res.Handler{
+			Call: map[string]res.CallHandler{
+				"method": func(r res.CallRequest) { r.OK("new") },
+			},
+		}))
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		close(release)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":"old"}`))
+		inb = s.Request("call.test.model.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":"new"}`))
+	})
+}
+
+// Test that adding an access handler while serving subscribes to access requests.
+func TestReplaceWithAccessSubscribes(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model")
+	}, func(s *Session) {
+		s.AssertNoSubscription(t, "access.test.>")
+		AssertNoError(t, s.Replace("model", res.Handler{Access: res.AccessGranted}))
+		s.AssertSubscription(t, "access.test.>")
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{
+				"resources": []string{"test.model"},
+				"access":    []string{"test.model"},
+			})
+		inb := s.Request("access.test.model", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"get":true,"call":"*"}}`))
+	})
+}
+
+// Test that Handle may be called while serving requests.
+func TestHandleWhileServing(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.OK(nil)
+		}))
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":null}`))
+	})
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that Patterns returns information on all registered patterns.
+func TestPatterns(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.AddHandler("model.$id", res.Handler{
+			Access:   res.AccessGranted,
+			GetModel: func(r res.ModelRequest) { r.NotFound() },
+			Call: map[string]res.CallHandler{
+				"set":    func(r res.CallRequest) { r.OK(nil) },
+				"delete": func(r res.CallRequest) { r.OK(nil) },
+			},
+			Group: "models",
+		})
+		s.Handle("collection",
+			res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }),
+			res.New(func(r res.NewRequest) { r.NotFound() }),
+		)
+		s.Handle("auth", res.Auth("login", func(r res.AuthRequest) { r.OK(nil) }))
+		s.Handle("file.$type.$path>")
+	}, func(s *Session) {
+		AssertEqual(t, "Patterns", s.Patterns(), []res.PatternInfo{
+			{Pattern: "test.auth", Auth: []string{"login"}},
+			{Pattern: "test.collection", Type: "collection", New: true},
+			{Pattern: "test.file.$type.$path>", Params: []string{"type", "path"}},
+			{Pattern: "test.model.$id", Type: "model", Params: []string{"id"}, Group: "models", Access: true, Call: []string{"delete", "set"}},
+		})
+	})
+}
+
+// Test that Patterns returns an empty list when no patterns are registered.
+func TestPatternsWithoutHandlers(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		if pis := s.Patterns(); len(pis) != 0 {
+			t.Errorf("expected Patterns to return an empty list, but got %d patterns", len(pis))
+		}
+	})
+}
+
+// Test that Patterns reflects removed patterns.
+func TestPatternsAfterRemove(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("foo")
+		s.Handle("bar")
+	}, func(s *Session) {
+		AssertNoError(t, s.Remove("foo"))
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		AssertEqual(t, "Patterns", s.Patterns(), []res.PatternInfo{{Pattern: "test.bar"}})
+	})
+}
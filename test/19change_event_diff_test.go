@@ -0,0 +1,144 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+type diffBook struct {
+	ID     int     `json:"id"`
+	Title  string  `json:"title"`
+	Author *string `json:"author,omitempty"`
+	Shelf  res.Ref `json:"shelf"`
+	secret string
+}
+
+func strPtr(s string) *string { return &s }
+
+var diffModelTestTbl = []struct {
+	Old      interface{}
+	New      interface{}
+	Expected json.RawMessage
+}{
+	{map[string]interface{}{"foo": 42}, map[string]interface{}{"foo": 42}, json.RawMessage(`{}`)},
+	{map[string]interface{}{"foo": 42}, map[string]interface{}{"foo": 12}, json.RawMessage(`{"foo":12}`)},
+	{map[string]interface{}{"foo": 42}, map[string]interface{}{}, json.RawMessage(`{"foo":{"action":"delete"}}`)},
+	{map[string]interface{}{}, map[string]interface{}{"foo": "bar"}, json.RawMessage(`{"foo":"bar"}`)},
+	{map[string]interface{}{"foo": nil}, map[string]interface{}{"foo": false}, json.RawMessage(`{"foo":false}`)},
+	{map[string]interface{}{"foo": 42.0}, map[string]int{"foo": 42}, json.RawMessage(`{}`)},
+	{map[string]int64{"foo": 9007199254740992}, map[string]int64{"foo": 9007199254740993}, json.RawMessage(`{"foo":9007199254740993}`)},
+	{map[string]int64{"foo": 9007199254740993}, map[string]int64{"foo": 9007199254740993}, json.RawMessage(`{}`)},
+	{map[string]interface{}{"foo": []int64{9007199254740992}}, map[string]interface{}{"foo": []int64{9007199254740993}}, json.RawMessage(`{"foo":[9007199254740993]}`)},
+	{nil, map[string]interface{}{"foo": 42}, json.RawMessage(`{"foo":42}`)},
+	{map[string]interface{}{"foo": 42}, nil, json.RawMessage(`{"foo":{"action":"delete"}}`)},
+	{
+		map[string]interface{}{"ref": res.Ref("test.model.a")},
+		map[string]interface{}{"ref": res.Ref("test.model.a")},
+		json.RawMessage(`{}`),
+	},
+	{
+		map[string]interface{}{"ref": res.Ref("test.model.a")},
+		map[string]interface{}{"ref": res.Ref("test.model.b")},
+		json.RawMessage(`{"ref":{"rid":"test.model.b"}}`),
+	},
+	{
+		map[string]interface{}{"ref": "test.model.a"},
+		map[string]interface{}{"ref": res.Ref("test.model.a")},
+		json.RawMessage(`{"ref":{"rid":"test.model.a"}}`),
+	},
+	{
+		diffBook{ID: 1, Title: "Coraline", Author: strPtr("Neil Gaiman"), Shelf: "test.shelf.1", secret: "foo"},
+		&diffBook{ID: 1, Title: "Coraline", Author: strPtr("Neil Gaiman"), Shelf: "test.shelf.1", secret: "bar"},
+		json.RawMessage(`{}`),
+	},
+	{
+		diffBook{ID: 1, Title: "Coraline", Author: strPtr("Neil Gaiman"), Shelf: "test.shelf.1"},
+		diffBook{ID: 1, Title: "Stardust", Shelf: "test.shelf.2"},
+		json.RawMessage(`{"title":"Stardust","author":{"action":"delete"},"shelf":{"rid":"test.shelf.2"}}`),
+	},
+}
+
+// Test that DiffModel returns the changed properties.
+func TestDiffModel(t *testing.T) {
+	for i, l := range diffModelTestTbl {
+		changed, err := res.DiffModel(l.Old, l.New)
+		if err != nil {
+			t.Errorf("expected test %d to return no error, but got: %s", i, err)
+			continue
+		}
+		AssertEqual(t, "changed", changed, l.Expected)
+	}
+}
+
+// Test that DiffModel returns an error on values not marshaling into JSON objects.
+func TestDiffModelWithInvalidModel(t *testing.T) {
+	tbl := []struct {
+		Old interface{}
+		New interface{}
+	}{
+		{[]int{1, 2}, map[string]interface{}{}},
+		{map[string]interface{}{}, "foo"},
+		{map[string]interface{}{}, map[string]interface{}{"foo": make(chan int)}},
+	}
+
+	for i, l := range tbl {
+		if _, err := res.DiffModel(l.Old, l.New); err == nil {
+			t.Errorf("expected test %d to return an error, but it didn't", i)
+		}
+	}
+}
+
+// Test that ChangeEventDiff sends a change event with the changed properties.
+func TestChangeEventDiff(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.GetModel(func(r res.ModelRequest) { r.NotFound() }),
+			res.Call("method", func(r res.CallRequest) {
+				r.ChangeEventDiff(
+					diffBook{ID: 1, Title: "Coraline", Shelf: "test.shelf.1"},
+					diffBook{ID: 1, Title: "Stardust", Shelf: "test.shelf.1"},
+				)
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.model.change").
+			AssertPayload(t, json.RawMessage(`{"title":"Stardust"}`))
+		s.GetMsg(t).AssertSubject(t, inb)
+	})
+}
+
+// Test that ChangeEventDiff sends no event if no properties has changed.
+func TestChangeEventDiffWithoutChange(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+	}, func(s *Session) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			r.ChangeEventDiff(map[string]int{"foo": 42}, map[string]int{"foo": 42})
+			r.Event("done", nil)
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.model.done")
+	})
+}
+
+// Test that ChangeEventDiff panics if the resource is a collection.
+func TestChangeEventDiffPanicsOnCollection(t *testing.T) {
+	runTestAsync(t, func(s *Session) {
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }))
+	}, func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.collection", func(r res.Resource) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					t.Errorf("expected ChangeEventDiff to panic, but nothing happened")
+				}
+				done()
+			}()
+			r.ChangeEventDiff(map[string]int{"foo": 42}, map[string]int{"foo": 12})
+		}))
+	})
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that WithTx publishes buffered events in order when the callback returns nil.
+func TestWithTx(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }))
+	}, func(s *Session) {
+		AssertNoError(t, s.WithTx("test.model", func(r res.Resource) error {
+			r.ChangeEvent(map[string]interface{}{"foo": 42})
+			r.Event("custom", map[string]interface{}{"bar": true})
+			r.ReaccessEvent()
+			return nil
+		}))
+		s.GetMsg(t).Equals(t, "event.test.model.change", map[string]interface{}{"foo": 42})
+		s.GetMsg(t).Equals(t, "event.test.model.custom", map[string]interface{}{"bar": true})
+		s.GetMsg(t).Equals(t, "event.test.model.reaccess", nil)
+
+		AssertNoError(t, s.WithTx("test.collection", func(r res.Resource) error {
+			r.AddEvent("foo", 0)
+			r.RemoveEvent(1)
+			return nil
+		}))
+		s.GetMsg(t).Equals(t, "event.test.collection.add", map[string]interface{}{"value": "foo", "idx": 0})
+		s.GetMsg(t).Equals(t, "event.test.collection.remove", map[string]interface{}{"idx": 1})
+	})
+}
+
+// Test that WithTx buffers events until the callback returns.
+func TestWithTxBuffersEvents(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+		s.Handle("other")
+	}, func(s *Session) {
+		AssertNoError(t, s.WithTx("test.model", func(r res.Resource) error {
+			r.ChangeEvent(map[string]interface{}{"foo": 42})
+			// Events on other resources are not part of the transaction
+			s.Service.TokenEvent(defaultCID, nil)
+			return nil
+		}))
+		s.GetMsg(t).AssertSubject(t, "conn."+defaultCID+".token")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.change")
+	})
+}
+
+// Test that WithTx discards buffered events when the callback returns an error.
+func TestWithTxOnError(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+	}, func(s *Session) {
+		AssertNoError(t, s.WithTx("test.model", func(r res.Resource) error {
+			r.ChangeEvent(map[string]interface{}{"foo": 42})
+			return errors.New("failed")
+		}))
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			r.Event("done", nil)
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.model.done")
+	})
+}
+
+// Test that WithTx discards buffered events when the callback panics.
+func TestWithTxOnPanic(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+	}, func(s *Session) {
+		AssertNoError(t, s.WithTx("test.model", func(r res.Resource) error {
+			r.ChangeEvent(map[string]interface{}{"foo": 42})
+			panic("failed")
+		}))
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			r.Event("done", nil)
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.model.done")
+	})
+}
+
+// Test that WithTx returns an error if there is no registered pattern matching the resource.
+func TestWithTxWithNoMatchingPattern(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		err := s.WithTx("test.model", func(r res.Resource) error { return nil })
+		if err == nil {
+			t.Errorf("expected WithTx to return an error, but it didn't")
+		}
+	})
+}
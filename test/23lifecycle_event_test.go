@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test DeleteEvent sends a delete event.
+func TestDeleteEvent(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.DeleteEvent()
+			r.OK(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, "event.test.model.delete").AssertPayload(t, nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+	})
+}
+
+// Test DeleteEvent sends a delete event, using With.
+func TestDeleteEventUsingWith(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+			r.NotFound()
+		}))
+	}, func(s *Session) {
+		AssertNoError(t, s.With("test.collection", func(r res.Resource) {
+			r.DeleteEvent()
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.delete").AssertPayload(t, nil)
+	})
+}
+
+// Test CreateEvent sends a create event for valid resource values.
+func TestCreateEvent(t *testing.T) {
+	tbl := []struct {
+		Pattern string
+		Handler res.HandlerOption
+		Value   interface{}
+	}{
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), json.RawMessage(resource["test.model"])},
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), map[string]interface{}{}},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), json.RawMessage(resource["test.collection"])},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), []interface{}{}},
+		{"untyped", res.Access(res.AccessGranted), 42},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle(l.Pattern, l.Handler)
+		}, func(s *Session) {
+			AssertNoError(t, s.With("test."+l.Pattern, func(r res.Resource) {
+				r.CreateEvent(l.Value)
+			}))
+			s.GetMsg(t).AssertSubject(t, "event.test."+l.Pattern+".create").AssertPayload(t, nil)
+		})
+	}
+}
+
+// Test CreateEvent panics if the value does not match the resource type.
+func TestCreateEventPanicsOnInvalidValue(t *testing.T) {
+	tbl := []struct {
+		Pattern string
+		Handler res.HandlerOption
+		Value   interface{}
+	}{
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), nil},
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), json.RawMessage(resource["test.collection"])},
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), "foo"},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), nil},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), json.RawMessage(resource["test.model"])},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), 42},
+	}
+
+	for _, l := range tbl {
+		runTestAsync(t, func(s *Session) {
+			s.Handle(l.Pattern, l.Handler)
+		}, func(s *Session, done func()) {
+			AssertNoError(t, s.With("test."+l.Pattern, func(r res.Resource) {
+				defer func() {
+					v := recover()
+					if v == nil {
+						t.Errorf("expected CreateEvent(%#v) to panic, but nothing happened", l.Value)
+					}
+					done()
+				}()
+				r.CreateEvent(l.Value)
+			}))
+		})
+	}
+}
+
+// Test Created sends a create event for the new resource before the new response.
+func TestNewCreated(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+		s.Handle("collection", res.New(func(r res.NewRequest) {
+			r.Created(res.Ref("test.model.42"), json.RawMessage(resource["test.model"]))
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.collection.new", nil)
+		s.GetMsg(t).AssertSubject(t, "event.test.model.42.create").AssertPayload(t, nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"rid":"test.model.42"}}`))
+	})
+}
+
+// Test Created responds with an internal error, without sending any event,
+// if the value does not match the resource type, or no handler is registered.
+func TestNewCreatedWithInvalidResource(t *testing.T) {
+	tbl := []struct {
+		RID   string
+		Value interface{}
+	}{
+		{"test.model.42", json.RawMessage(resource["test.collection"])},
+		{"test.foo", json.RawMessage(resource["test.model"])},
+		{"", json.RawMessage(resource["test.model"])},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model.$id", res.GetModel(func(r res.ModelRequest) { r.NotFound() }))
+			s.Handle("collection", res.New(func(r res.NewRequest) {
+				r.Created(res.Ref(l.RID), l.Value)
+			}))
+		}, func(s *Session) {
+			inb := s.Request("call.test.collection.new", nil)
+			s.GetMsg(t).
+				AssertSubject(t, inb).
+				AssertErrorCode(t, "system.internalError")
+		})
+	}
+}
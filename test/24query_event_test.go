@@ -0,0 +1,156 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// queryEventSubject sends a query event on the resource using With, and
+// returns the query subject of the event.
+func queryEventSubject(t *testing.T, s *Session, rid string, cb func(r res.QueryRequest)) string {
+	AssertNoError(t, s.With(rid, func(r res.Resource) {
+		r.QueryEvent(cb)
+	}))
+	m := s.GetMsg(t).AssertSubject(t, "event."+rid+".query")
+	qsubj, ok := m.PathPayload(t, "subject").(string)
+	if !ok || qsubj == "" {
+		t.Fatalf("expected query event to have a subject, but got payload %s", m.RawPayload)
+	}
+	s.AssertSubscription(t, qsubj)
+	return qsubj
+}
+
+// Test that QueryEvent sends a query event, and responds to query requests
+// with model change events.
+func TestQueryEventWithChangeEvent(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.QueryModel(nil, r.Query())
+		}))
+	}, func(s *Session) {
+		qsubj := queryEventSubject(t, s, "test.model", func(r res.QueryRequest) {
+			if r != nil {
+				r.ChangeEvent(map[string]interface{}{"query": r.Query()})
+			}
+		})
+		inb := s.Request(qsubj, json.RawMessage(`{"query":"foo=bar"}`))
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"events":[{"event":"change","data":{"query":"foo=bar"}}]}}`))
+	})
+}
+
+// Test that QueryEvent responds to query requests with collection add and
+// remove events.
+func TestQueryEventWithCollectionEvents(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+			r.QueryCollection(nil, r.Query())
+		}))
+	}, func(s *Session) {
+		qsubj := queryEventSubject(t, s, "test.collection", func(r res.QueryRequest) {
+			if r != nil {
+				r.RemoveEvent(1)
+				r.AddEvent("foo", 0)
+			}
+		})
+		inb := s.Request(qsubj, json.RawMessage(`{"query":"limit=2"}`))
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"events":[{"event":"remove","data":{"idx":1}},{"event":"add","data":{"value":"foo","idx":0}}]}}`))
+	})
+}
+
+// Test that QueryEvent responds to query requests with the full model or
+// collection, when set instead of events.
+func TestQueryEventWithFullValue(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.QueryModel(nil, r.Query())
+		}))
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+			r.QueryCollection(nil, r.Query())
+		}))
+	}, func(s *Session) {
+		qsubj := queryEventSubject(t, s, "test.model", func(r res.QueryRequest) {
+			if r != nil {
+				r.Model(map[string]interface{}{"query": r.Query()})
+			}
+		})
+		inb := s.Request(qsubj, json.RawMessage(`{"query":"foo=bar"}`))
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"query":"foo=bar"}}}`))
+
+		qsubj = queryEventSubject(t, s, "test.collection", func(r res.QueryRequest) {
+			if r != nil {
+				r.Collection([]interface{}{"foo", res.Ref("test.model")})
+			}
+		})
+		inb = s.Request(qsubj, json.RawMessage(`{"query":"limit=2"}`))
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":["foo",{"rid":"test.model"}]}}`))
+	})
+}
+
+// Test that QueryEvent responds with an empty list of events if no events
+// are added, and with an error if an error response is sent.
+func TestQueryEventResponses(t *testing.T) {
+	tbl := []struct {
+		Callback func(r res.QueryRequest)
+		Expected interface{}
+	}{
+		{func(r res.QueryRequest) {}, json.RawMessage(`{"result":{"events":[]}}`)},
+		{func(r res.QueryRequest) { r.NotFound() }, json.RawMessage(`{"error":{"code":"system.notFound","message":"Not found"}}`)},
+		{func(r res.QueryRequest) { r.Error(&res.Error{Code: "custom.error", Message: "Custom error"}) }, json.RawMessage(`{"error":{"code":"custom.error","message":"Custom error"}}`)},
+		{func(r res.QueryRequest) { panic(&res.Error{Code: "custom.error", Message: "Custom error"}) }, json.RawMessage(`{"error":{"code":"custom.error","message":"Custom error"}}`)},
+		{func(r res.QueryRequest) { panic("panic") }, json.RawMessage(`{"error":{"code":"system.internalError","message":"Internal error: panic"}}`)},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+				r.QueryModel(nil, r.Query())
+			}))
+		}, func(s *Session) {
+			qsubj := queryEventSubject(t, s, "test.model", func(r res.QueryRequest) {
+				if r != nil {
+					l.Callback(r)
+				}
+			})
+			inb := s.Request(qsubj, json.RawMessage(`{"query":"foo=bar"}`))
+			s.GetMsg(t).Equals(t, inb, l.Expected)
+		})
+	}
+}
+
+// Test that the query event callback is called with nil once the query
+// event expires.
+func TestQueryEventExpires(t *testing.T) {
+	expired := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueryEventDuration(time.Millisecond)
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.QueryModel(nil, r.Query())
+		}))
+	}, func(s *Session) {
+		queryEventSubject(t, s, "test.model", func(r res.QueryRequest) {
+			if r == nil {
+				close(expired)
+			}
+		})
+		select {
+		case <-expired:
+		case <-time.After(timeoutDuration):
+			t.Fatalf("expected query event callback to be called with nil, but it wasn't")
+		}
+	})
+}
+
+// Test that SetQueryEventDuration panics if the service is started.
+func TestSetQueryEventDurationPanicsWhenStarted(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		defer func() {
+			if v := recover(); v == nil {
+				t.Errorf("expected SetQueryEventDuration to panic, but nothing happened")
+			}
+		}()
+		s.SetQueryEventDuration(time.Second)
+	})
+}
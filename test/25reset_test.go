@@ -0,0 +1,66 @@
+package test
+
+import (
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that Reset sends a system.reset event with the patterns translated
+// into wildcards.
+func TestReset(t *testing.T) {
+	tbl := []struct {
+		Resources []string
+		Access    []string
+		Expected  interface{}
+	}{
+		{[]string{"test.model"}, nil, map[string]interface{}{"resources": []string{"test.model"}}},
+		{nil, []string{"test.model"}, map[string]interface{}{"access": []string{"test.model"}}},
+		{[]string{"test.model.$id"}, []string{"test.>"}, map[string]interface{}{"resources": []string{"test.model.*"}, "access": []string{"test.>"}}},
+		{[]string{"test.$tenant.model.$id", "test.$tenant.$path>"}, []string{}, map[string]interface{}{"resources": []string{"test.*.model.*", "test.*.>"}}},
+	}
+
+	for _, l := range tbl {
+		runTest(t, nil, func(s *Session) {
+			s.Reset(l.Resources, l.Access)
+			s.GetMsg(t).AssertSubject(t, "system.reset").AssertPayload(t, l.Expected)
+		})
+	}
+}
+
+// Test that Reset sends no event if both resources and access are empty.
+func TestResetWithNoPatterns(t *testing.T) {
+	runTest(t, nil, func(s *Session) {
+		s.Reset(nil, []string{})
+		s.Reset([]string{"test.model"}, nil)
+		s.GetMsg(t).AssertSubject(t, "system.reset").AssertPayload(t, map[string]interface{}{"resources": []string{"test.model"}})
+	})
+}
+
+// Test that ResetEvent and ResetAccess sends a system.reset event for the resource.
+func TestResetEventAndResetAccess(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id", res.Call("method", func(r res.CallRequest) {
+			r.ResetEvent()
+			r.ResetAccess()
+			r.OK(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.42.method", nil)
+		s.GetMsg(t).AssertSubject(t, "system.reset").AssertPayload(t, map[string]interface{}{"resources": []string{"test.model.42"}})
+		s.GetMsg(t).AssertSubject(t, "system.reset").AssertPayload(t, map[string]interface{}{"access": []string{"test.model.42"}})
+		s.GetMsg(t).AssertSubject(t, inb)
+	})
+}
+
+// Test that ResetEvent sends a system.reset event for the resource, using With.
+func TestResetEventUsingWith(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model")
+	}, func(s *Session) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			r.ResetEvent()
+		}))
+		s.GetMsg(t).AssertSubject(t, "system.reset").AssertPayload(t, map[string]interface{}{"resources": []string{"test.model"}})
+	})
+}
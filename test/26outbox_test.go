@@ -0,0 +1,240 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+var errPublish = errors.New("publish failed")
+
+// handleGroupedModels registers a model handler for "test.model.$id",
+// where all models belong to the same group.
+func handleGroupedModels(s *Session) {
+	s.AddHandler("model.$id", res.Handler{
+		GetModel: func(r res.ModelRequest) { r.NotFound() },
+		Group:    "models",
+	})
+}
+
+// withChangeEvents sends a change event on each resource, in order, and
+// waits for the events to be sent.
+func withChangeEvents(t *testing.T, s *Session, rids ...string) {
+	done := make(chan struct{})
+	for i, rid := range rids {
+		last := i == len(rids)-1
+		AssertNoError(t, s.With(rid, func(r res.Resource) {
+			r.ChangeEvent(map[string]interface{}{"rid": r.ResourceName()})
+			if last {
+				close(done)
+			}
+		}))
+	}
+	select {
+	case <-done:
+	case <-time.After(timeoutDuration):
+		t.Fatal("expected events to be sent, but timed out")
+	}
+}
+
+// Test that events failing to publish are held in the outbox, and
+// published in order once publishing succeeds.
+func TestOutboxHoldsEventsOnPublishError(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetOutbox(10, nil)
+		handleGroupedModels(s)
+	}, func(s *Session) {
+		s.SetPublishError(errPublish)
+		withChangeEvents(t, s, "test.model.a", "test.model.b")
+		s.SetPublishError(nil)
+		withChangeEvents(t, s, "test.model.c")
+		for _, rid := range []string{"test.model.a", "test.model.b", "test.model.c"} {
+			s.GetMsg(t).
+				AssertSubject(t, "event."+rid+".change").
+				AssertPayload(t, map[string]interface{}{"rid": rid})
+		}
+	})
+}
+
+// Test that events of resources with dropped events are replaced by a
+// system.reset event when the outbox overflows.
+func TestOutboxOverflowResetsResources(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetOutbox(2, nil)
+		handleGroupedModels(s)
+	}, func(s *Session) {
+		s.SetPublishError(errPublish)
+		withChangeEvents(t, s, "test.model.a", "test.model.b", "test.model.a")
+		s.SetPublishError(nil)
+		withChangeEvents(t, s, "test.model.c")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.b.change")
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{"resources": []string{"test.model.a"}})
+		s.GetMsg(t).AssertSubject(t, "event.test.model.c.change")
+	})
+}
+
+// Test that a dropped system.reset event results in a full reset when the
+// outbox overflows.
+func TestOutboxOverflowWithDroppedResetResetsAll(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetOutbox(1, nil)
+		handleGroupedModels(s)
+	}, func(s *Session) {
+		s.SetPublishError(errPublish)
+		s.Reset([]string{"test.model.a"}, nil)
+		withChangeEvents(t, s, "test.model.b")
+		s.SetPublishError(nil)
+		withChangeEvents(t, s, "test.model.c")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.b.change")
+		s.GetMsg(t).
+			AssertSubject(t, "system.reset").
+			AssertPayload(t, map[string]interface{}{"resources": []string{"test.>"}})
+		s.GetMsg(t).AssertSubject(t, "event.test.model.c.change")
+	})
+}
+
+// Test that request replies, including timeout replies, and connection
+// token events are not held in the outbox when the publish fails.
+func TestOutboxDoesNotHoldRepliesAndTokenEvents(t *testing.T) {
+	done := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetOutbox(10, nil)
+		handleGroupedModels(s)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.Timeout(time.Second)
+			r.OK(nil)
+			close(done)
+		}))
+	}, func(s *Session) {
+		s.SetPublishError(errPublish)
+		s.Request("call.test.model.method", nil)
+		select {
+		case <-done:
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected call handler to be called, but timed out")
+		}
+		s.TokenEvent(defaultCID, nil)
+		s.SetPublishError(nil)
+		withChangeEvents(t, s, "test.model.a")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.a.change")
+	})
+}
+
+// Test that SetOutbox panics on invalid size, or if the service is started.
+func TestSetOutboxPanics(t *testing.T) {
+	func() {
+		defer func() {
+			if v := recover(); v == nil {
+				t.Errorf("expected SetOutbox with size 0 to panic, but nothing happened")
+			}
+		}()
+		res.NewService("test").SetOutbox(0, nil)
+	}()
+
+	runTest(t, nil, func(s *Session) {
+		defer func() {
+			if v := recover(); v == nil {
+				t.Errorf("expected SetOutbox to panic, but nothing happened")
+			}
+		}()
+		s.SetOutbox(10, nil)
+	})
+}
+
+// Test that FileOutboxLog appends, loads, and truncates events.
+func TestFileOutboxLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := res.NewFileOutboxLog(filepath.Join(dir, "outbox.log"))
+	AssertNoError(t, err)
+	defer l.Close()
+
+	evs := []res.OutboxEvent{
+		{Subject: "event.test.model.change", Payload: []byte(`{"foo":"bar"}`)},
+		{Subject: "event.test.model.reaccess"},
+	}
+	for _, ev := range evs {
+		AssertNoError(t, l.Append(ev))
+	}
+	loaded, err := l.Load()
+	AssertNoError(t, err)
+	AssertEqual(t, "loaded events", loaded, evs)
+
+	AssertNoError(t, l.Truncate())
+	loaded, err = l.Load()
+	AssertNoError(t, err)
+	AssertEqual(t, "number of loaded events", len(loaded), 0)
+}
+
+// Test that unpublished events are appended to the outbox log, and that
+// the log is truncated once the events are published.
+func TestOutboxWithLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := res.NewFileOutboxLog(filepath.Join(dir, "outbox.log"))
+	AssertNoError(t, err)
+	defer l.Close()
+
+	runTest(t, func(s *Session) {
+		s.SetOutbox(10, l)
+		handleGroupedModels(s)
+	}, func(s *Session) {
+		s.SetPublishError(errPublish)
+		withChangeEvents(t, s, "test.model.a")
+		loaded, err := l.Load()
+		AssertNoError(t, err)
+		AssertEqual(t, "number of loaded events", len(loaded), 1)
+		AssertEqual(t, "loaded event subject", loaded[0].Subject, "event.test.model.a.change")
+
+		s.SetPublishError(nil)
+		withChangeEvents(t, s, "test.model.b")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.a.change")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.b.change")
+		loaded, err = l.Load()
+		AssertNoError(t, err)
+		AssertEqual(t, "number of loaded events", len(loaded), 0)
+	})
+}
+
+// Test that events in the outbox log are published before the initial
+// system.reset when the service is started.
+func TestOutboxLogPublishedOnServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	AssertNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := res.NewFileOutboxLog(filepath.Join(dir, "outbox.log"))
+	AssertNoError(t, err)
+	defer l.Close()
+	AssertNoError(t, l.Append(res.OutboxEvent{Subject: "event.test.model.custom", Payload: json.RawMessage(`{"foo":"bar"}`)}))
+
+	c := NewTestConn()
+	rs := res.NewService("test")
+	rs.SetLogger(newMemLogger(true, true))
+	rs.SetOutbox(10, l)
+	cl := make(chan struct{})
+	go func() {
+		defer close(cl)
+		AssertNoError(t, rs.Serve(c))
+	}()
+
+	c.GetMsg(t).
+		AssertSubject(t, "event.test.model.custom").
+		AssertPayload(t, map[string]interface{}{"foo": "bar"})
+	c.GetMsg(t).AssertSubject(t, "system.reset")
+
+	AssertNoError(t, rs.Shutdown())
+	<-cl
+}
@@ -0,0 +1,221 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that invalid model responses result in a system.internalError.
+func TestModelPayloadValidation(t *testing.T) {
+	tbl := []struct {
+		Model interface{}
+		Valid bool
+	}{
+		{json.RawMessage(`{"foo":"bar","num":42,"bool":true,"null":null}`), true},
+		{map[string]interface{}{"ref": res.Ref("test.model.a")}, true},
+		{map[string]interface{}{}, true},
+		{nil, false},
+		{[]interface{}{"foo"}, false},
+		{"foo", false},
+		{json.RawMessage(`{"foo":{"bar":42}}`), false},
+		{json.RawMessage(`{"foo":[42]}`), false},
+		{json.RawMessage(`{"foo":{"rid":"test.*"}}`), false},
+		{map[string]interface{}{"deleted": res.DeleteAction}, false},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+				r.Model(l.Model)
+			}))
+		}, func(s *Session) {
+			inb := s.Request("get.test.model", nil)
+			m := s.GetMsg(t).AssertSubject(t, inb)
+			if l.Valid {
+				m.AssertPathPayload(t, "result.model", l.Model)
+			} else {
+				m.AssertErrorCode(t, res.CodeInternalError)
+			}
+		})
+	}
+}
+
+// Test that invalid collection responses result in a system.internalError.
+func TestCollectionPayloadValidation(t *testing.T) {
+	tbl := []struct {
+		Collection interface{}
+		Valid      bool
+	}{
+		{json.RawMessage(`["foo",42,true,null]`), true},
+		{[]interface{}{res.Ref("test.model.a")}, true},
+		{[]interface{}{}, true},
+		{nil, false},
+		{map[string]interface{}{"foo": "bar"}, false},
+		{json.RawMessage(`[{"foo":"bar"}]`), false},
+		{json.RawMessage(`[[42]]`), false},
+	}
+
+	for _, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+				r.Collection(l.Collection)
+			}))
+		}, func(s *Session) {
+			inb := s.Request("get.test.collection", nil)
+			m := s.GetMsg(t).AssertSubject(t, inb)
+			if l.Valid {
+				m.AssertPathPayload(t, "result.collection", l.Collection)
+			} else {
+				m.AssertErrorCode(t, res.CodeInternalError)
+			}
+		})
+	}
+}
+
+// Test that ChangeEvent and AddEvent drops and logs invalid payloads sent
+// outside of a request handler.
+func TestEventPayloadValidation(t *testing.T) {
+	tbl := []struct {
+		Pattern string
+		Handler res.HandlerOption
+		Event   func(r res.Resource)
+	}{
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), func(r res.Resource) {
+			r.ChangeEvent(map[string]interface{}{"foo": map[string]interface{}{"bar": 42}})
+		}},
+		{"model", res.GetModel(func(r res.ModelRequest) { r.NotFound() }), func(r res.Resource) {
+			r.ChangeEvent([]interface{}{"foo"})
+		}},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), func(r res.Resource) {
+			r.AddEvent([]interface{}{"foo"}, 0)
+		}},
+		{"collection", res.GetCollection(func(r res.CollectionRequest) { r.NotFound() }), func(r res.Resource) {
+			r.AddEvent(res.DeleteAction, 0)
+		}},
+	}
+
+	for i, l := range tbl {
+		runTest(t, func(s *Session) {
+			s.Handle(l.Pattern, l.Handler)
+		}, func(s *Session) {
+			AssertNoError(t, s.With("test."+l.Pattern, func(r res.Resource) {
+				defer func() {
+					if v := recover(); v != nil {
+						t.Errorf("expected event #%d not to panic, but it did: %v", i, v)
+					}
+				}()
+				l.Event(r)
+				r.Event("custom", nil)
+			}))
+			// The invalid event is dropped
+			s.GetMsg(t).AssertSubject(t, "event.test."+l.Pattern+".custom")
+			if log := s.Logger().(*MemLogger).String(); !strings.Contains(log, "invalid") {
+				t.Errorf("expected event #%d to be logged as invalid, but log was:\n%s", i, log)
+			}
+		})
+	}
+}
+
+// Test that invalid events in a request handler result in a system.internalError response.
+func TestEventPayloadValidationInHandler(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.GetModel(func(r res.ModelRequest) { r.NotFound() }),
+			res.Call("method", func(r res.CallRequest) {
+				r.ChangeEvent(map[string]interface{}{"foo": []int{42}})
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInternalError)
+	})
+}
+
+// Test that SetPayloadValidation(false) disables payload validation.
+func TestSetPayloadValidationDisabled(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetPayloadValidation(false)
+		s.Handle("model",
+			res.GetModel(func(r res.ModelRequest) {
+				r.Model(json.RawMessage(`{"foo":{"bar":42}}`))
+			}),
+			res.Call("method", func(r res.CallRequest) {
+				r.ChangeEvent(map[string]interface{}{"foo": []int{42}})
+				r.OK(nil)
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"foo":{"bar":42}}}}`))
+		inb = s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, "event.test.model.change").AssertPayload(t, json.RawMessage(`{"foo":[42]}`))
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+	})
+}
+
+// Test that payload validation is disabled by default when the logger's
+// IsDebug method returns false.
+func TestPayloadValidationDisabledWithoutDebug(t *testing.T) {
+	runTestWithLogger(t, newMemLogger(false, false), func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.Model(json.RawMessage(`{"foo":{"bar":42}}`))
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"foo":{"bar":42}}}}`))
+	})
+}
+
+// Test that payload validation is disabled by default when the logger has
+// no IsDebug method, even if it writes debug messages.
+func TestPayloadValidationDisabledWithoutIsDebug(t *testing.T) {
+	l := newMemLogger(true, true)
+	runTestWithLogger(t, eagerLogger{l}, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.Model(json.RawMessage(`{"foo":{"bar":42}}`))
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"foo":{"bar":42}}}}`))
+	})
+	if strings.Contains(l.String(), "validation") {
+		t.Errorf("expected no payload validation log entry, but log was:\n%s", l)
+	}
+}
+
+// eagerLogger is a logger without an IsDebug method, that formats all
+// messages before passing them to the underlying logger.
+type eagerLogger struct {
+	l *MemLogger
+}
+
+func (l eagerLogger) Logf(prefix string, format string, v ...interface{}) {
+	l.l.Logf(prefix, "%s", fmt.Sprintf(format, v...))
+}
+
+func (l eagerLogger) Debugf(prefix string, format string, v ...interface{}) {
+	l.l.Debugf(prefix, "%s", fmt.Sprintf(format, v...))
+}
+
+func (l eagerLogger) Tracef(prefix string, format string, v ...interface{}) {
+	l.l.Tracef(prefix, "%s", fmt.Sprintf(format, v...))
+}
+
+// Test that SetPayloadValidation(true) enables payload validation when the
+// logger's IsDebug method returns false.
+func TestSetPayloadValidationEnabledWithoutDebug(t *testing.T) {
+	runTestWithLogger(t, newMemLogger(false, false), func(s *Session) {
+		s.SetPayloadValidation(true)
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.Model(json.RawMessage(`{"foo":{"bar":42}}`))
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInternalError)
+	})
+}
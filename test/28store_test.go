@@ -0,0 +1,175 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+	"github.com/jirenius/go-res/store"
+)
+
+type storeBook struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+}
+
+func newTestStore(t *testing.T) *store.Store {
+	st := store.New()
+	AssertNoError(t, st.LoadModel("test.book.1", storeBook{Title: "Animal Farm", Author: "George Orwell"}))
+	AssertNoError(t, st.LoadCollection("test.books", []interface{}{res.Ref("test.book.1")}))
+	return st
+}
+
+func handleStore(st *store.Store) func(s *Session) {
+	return func(s *Session) {
+		s.Handle("book.$id", st.GetModel())
+		s.Handle("books", st.GetCollection())
+	}
+}
+
+// Test that the store get handlers respond with stored values.
+func TestStoreGet(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"title":"Animal Farm","author":"George Orwell"}}}`))
+		inb = s.Request("get.test.books", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":[{"rid":"test.book.1"}]}}`))
+		inb = s.Request("get.test.book.2", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
+
+// Test that SetModel sends a change event with the changed properties,
+// and updates the stored model.
+func TestStoreSetModel(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.With("test.book.1", func(r res.Resource) {
+			AssertNoError(t, st.SetModel(r, storeBook{Title: "1984", Author: "George Orwell"}))
+		}))
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.book.1.change").
+			AssertPayload(t, map[string]interface{}{"title": "1984"})
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"title":"1984","author":"George Orwell"}}}`))
+	})
+}
+
+// Test that SetModel sends a create event if no model is stored.
+func TestStoreSetModelCreates(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.With("test.book.2", func(r res.Resource) {
+			AssertNoError(t, st.SetModel(r, storeBook{Title: "Coraline", Author: "Neil Gaiman"}))
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.book.2.create")
+		m, err := st.Model("test.book.2")
+		AssertNoError(t, err)
+		AssertEqual(t, "model", m, json.RawMessage(`{"title":"Coraline","author":"Neil Gaiman"}`))
+	})
+}
+
+// Test that collection updates send the matching add and remove events.
+func TestStoreCollectionUpdates(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.With("test.books", func(r res.Resource) {
+			AssertNoError(t, st.AddValue(r, res.Ref("test.book.2"), 1))
+			AssertNoError(t, st.RemoveValue(r, 0))
+			AssertNoError(t, st.SetCollection(r, []interface{}{res.Ref("test.book.3"), res.Ref("test.book.2")}))
+		}))
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.add").
+			AssertPayload(t, json.RawMessage(`{"value":{"rid":"test.book.2"},"idx":1}`))
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.remove").
+			AssertPayload(t, json.RawMessage(`{"idx":0}`))
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.add").
+			AssertPayload(t, json.RawMessage(`{"value":{"rid":"test.book.3"},"idx":0}`))
+		inb := s.Request("get.test.books", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":[{"rid":"test.book.3"},{"rid":"test.book.2"}]}}`))
+	})
+}
+
+// Test that Delete removes the value and sends a delete event.
+func TestStoreDelete(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.With("test.book.1", func(r res.Resource) {
+			AssertNoError(t, st.Delete(r))
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.book.1.delete")
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
+
+// Test that the store methods return errors on invalid use, without
+// sending any events.
+func TestStoreErrors(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		done := make(chan struct{})
+		AssertNoError(t, s.With("test.books", func(r res.Resource) {
+			AssertEqual(t, "SetModel error", st.SetModel(r, storeBook{}), store.ErrWrongType)
+			AssertEqual(t, "AddValue error", st.AddValue(r, "foo", 2), store.ErrIndexOutOfRange)
+			AssertEqual(t, "RemoveValue error", st.RemoveValue(r, 1), store.ErrIndexOutOfRange)
+			AssertEqual(t, "RemoveValue error", st.RemoveValue(r, -1), store.ErrIndexOutOfRange)
+			close(done)
+		}))
+		<-done
+		AssertNoError(t, s.With("test.book.2", func(r res.Resource) {
+			AssertEqual(t, "AddValue error", st.AddValue(r, "foo", 0), store.ErrNotFound)
+			AssertEqual(t, "Delete error", st.Delete(r), store.ErrNotFound)
+		}))
+		AssertEqual(t, "LoadModel error", st.LoadModel("test.book.3", []string{"foo"}), store.ErrNotObject)
+		_, err := st.Collection("test.book.1")
+		AssertEqual(t, "Collection error", err, store.ErrWrongType)
+	})
+}
+
+// Test that updates with values that are not primitives or resource
+// references are rejected without changing the store.
+func TestStoreInvalidValue(t *testing.T) {
+	st := newTestStore(t)
+	AssertEqual(t, "err", st.SetModel(nil, map[string]interface{}{"nested": map[string]int{"a": 1}}), store.ErrInvalidValue)
+	AssertEqual(t, "err", st.AddValue(nil, []int{42}, 0), store.ErrInvalidValue)
+	c, err := st.Collection("test.books")
+	AssertNoError(t, err)
+	AssertEqual(t, "collection", c, []json.RawMessage{json.RawMessage(`{"rid":"test.book.1"}`)})
+}
+
+// Test that the previous value is restored if sending the events panics.
+func TestStoreRestoresOnEventPanic(t *testing.T) {
+	st := newTestStore(t)
+	AssertNoError(t, st.LoadCollection("test.book.2", []interface{}{"foo"}))
+	runTestAsync(t, handleStore(st), func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.book.2", func(r res.Resource) {
+			// The model handler does not allow collection events
+			if err := st.SetCollection(r, []interface{}{"bar"}); err == nil {
+				t.Error("expected SetCollection to return an error, but it didn't")
+			}
+			c, err := st.Collection("test.book.2")
+			AssertNoError(t, err)
+			AssertEqual(t, "collection", c, []json.RawMessage{json.RawMessage(`"foo"`)})
+			done()
+		}))
+	})
+}
+
+// Test that the previous value is restored if a transaction is rolled back.
+func TestStoreRestoresOnRollback(t *testing.T) {
+	st := newTestStore(t)
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.WithTx("test.book.1", func(r res.Resource) error {
+			AssertNoError(t, st.SetModel(r, storeBook{Title: "1984", Author: "George Orwell"}))
+			AssertNoError(t, st.SetModel(r, storeBook{Title: "Homage to Catalonia", Author: "George Orwell"}))
+			return errors.New("rollback")
+		}))
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"title":"Animal Farm","author":"George Orwell"}}}`))
+	})
+}
@@ -0,0 +1,208 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+	"github.com/jirenius/go-res/store"
+)
+
+func tempStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	AssertNoError(t, err)
+	return dir
+}
+
+func assertStoredModel(t *testing.T, st *store.Store, rname string, expected string) {
+	m, err := st.Model(rname)
+	AssertNoError(t, err)
+	AssertEqual(t, "model", m, json.RawMessage(expected))
+}
+
+// Test that a file store restores the values after being reopened.
+func TestFileStoreRestoresValues(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	st, err := store.OpenFile(dir)
+	AssertNoError(t, err)
+	AssertNoError(t, st.LoadModel("test.book.1", storeBook{Title: "Animal Farm", Author: "George Orwell"}))
+	AssertNoError(t, st.LoadModel("test.book.2", storeBook{Title: "Coraline", Author: "Neil Gaiman"}))
+	AssertNoError(t, st.LoadCollection("test.books", []interface{}{res.Ref("test.book.1"), res.Ref("test.book.2")}))
+	runTest(t, handleStore(st), func(s *Session) {
+		AssertNoError(t, s.With("test.book.1", func(r res.Resource) {
+			AssertNoError(t, st.SetModel(r, storeBook{Title: "1984", Author: "George Orwell"}))
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.book.1.change")
+		AssertNoError(t, s.With("test.book.2", func(r res.Resource) {
+			AssertNoError(t, st.Delete(r))
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.book.2.delete")
+		AssertNoError(t, s.With("test.books", func(r res.Resource) {
+			AssertNoError(t, st.RemoveValue(r, 1))
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.books.remove")
+	})
+	AssertNoError(t, st.Close())
+
+	st, err = store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	assertStoredModel(t, st, "test.book.1", `{"title":"1984","author":"George Orwell"}`)
+	_, err = st.Model("test.book.2")
+	AssertEqual(t, "error", err, store.ErrNotFound)
+	c, err := st.Collection("test.books")
+	AssertNoError(t, err)
+	AssertEqual(t, "collection", c, []json.RawMessage{json.RawMessage(`{"rid":"test.book.1"}`)})
+	AssertEqual(t, "reset resources", st.ResetResources(), []string{})
+}
+
+// Test that ResetResources returns resources with unpublished changes.
+func TestFileStoreResetResources(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := store.NewFilePersister(dir)
+	AssertNoError(t, err)
+	AssertNoError(t, p.Save("test.book.1", false, json.RawMessage(`{"title":"Animal Farm"}`)))
+	AssertNoError(t, p.Published("test.book.1"))
+	AssertNoError(t, p.Save("test.book.2", false, json.RawMessage(`{"title":"Coraline"}`)))
+	AssertNoError(t, p.Save("test.book.1", false, json.RawMessage(`{"title":"1984"}`)))
+	AssertNoError(t, p.Save("test.book.3", false, json.RawMessage(`{"title":"Dune"}`)))
+	AssertNoError(t, p.Published("test.book.3"))
+	AssertNoError(t, p.Save("test.book.3", false, nil))
+	AssertNoError(t, p.Close())
+
+	st, err := store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	AssertEqual(t, "reset resources", st.ResetResources(), []string{"test.book.1", "test.book.2", "test.book.3"})
+	assertStoredModel(t, st, "test.book.1", `{"title":"1984"}`)
+	_, err = st.Model("test.book.3")
+	AssertEqual(t, "error", err, store.ErrNotFound)
+}
+
+// serveWithResetPending starts serving a service handling the store, with
+// ResetPending replacing the initial reset, and waits until it is called.
+// Unlike setup, no initial system.reset event is consumed.
+func serveWithResetPending(st *store.Store) *Session {
+	c := NewTestConn()
+	r := res.NewService("test")
+	r.SetLogger(newMemLogger(true, true))
+	s := &Session{MockConn: c, Service: r, cl: make(chan struct{})}
+	handleStore(st)(s)
+	served := make(chan struct{})
+	s.SetOnServe(func(r *res.Service) {
+		st.ResetPending(r)
+		close(served)
+	})
+	go func() {
+		defer close(s.cl)
+		if err := r.Serve(c); err != nil {
+			panic("test: failed to start service: " + err.Error())
+		}
+	}()
+	<-served
+	return s
+}
+
+// Test that ResetPending replaces the initial reset with a reset event for
+// the resources with unpublished changes only.
+func TestFileStoreResetPending(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := store.NewFilePersister(dir)
+	AssertNoError(t, err)
+	AssertNoError(t, p.Save("test.book.1", false, json.RawMessage(`{"title":"Animal Farm"}`)))
+	AssertNoError(t, p.Close())
+
+	st, err := store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	s := serveWithResetPending(st)
+	defer teardown(s)
+	s.GetMsg(t).
+		AssertSubject(t, "system.reset").
+		AssertPayload(t, map[string]interface{}{"resources": []string{"test.book.1"}})
+	AssertEqual(t, "reset resources", st.ResetResources(), []string{})
+	// No other reset is sent before serving requests
+	inb := s.Request("get.test.book.1", nil)
+	s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, map[string]interface{}{"model": map[string]interface{}{"title": "Animal Farm"}})
+}
+
+// Test that no reset event is sent at startup when ResetPending replaces
+// the initial reset, and there are no unpublished changes.
+func TestFileStoreResetPendingWithoutChanges(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	st, err := store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	AssertNoError(t, st.LoadModel("test.book.1", storeBook{Title: "Animal Farm"}))
+	s := serveWithResetPending(st)
+	defer teardown(s)
+	inb := s.Request("get.test.book.1", nil)
+	s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, map[string]interface{}{"model": map[string]interface{}{"title": "Animal Farm", "author": ""}})
+}
+
+// Test that a file store restores values from snapshots.
+func TestFileStoreSnapshot(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := store.NewFilePersister(dir)
+	AssertNoError(t, err)
+	p.SetSnapshotLimit(3)
+	st, err := store.NewWithPersister(p)
+	AssertNoError(t, err)
+	for _, title := range []string{"A", "B", "C", "D", "E"} {
+		AssertNoError(t, st.LoadModel("test.book.1", storeBook{Title: title}))
+	}
+	AssertNoError(t, st.Close())
+
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatalf("expected snapshot file to exist, but got error: %s", err)
+	}
+
+	st, err = store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	assertStoredModel(t, st, "test.book.1", `{"title":"E","author":""}`)
+	AssertEqual(t, "reset resources", st.ResetResources(), []string{})
+}
+
+// Test that a file store ignores an incomplete last log record, and
+// continues to persist changes after it.
+func TestFileStoreWithIncompleteLog(t *testing.T) {
+	dir := tempStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	st, err := store.OpenFile(dir)
+	AssertNoError(t, err)
+	AssertNoError(t, st.LoadModel("test.book.1", storeBook{Title: "A"}))
+	AssertNoError(t, st.Close())
+
+	f, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_WRONLY|os.O_APPEND, 0644)
+	AssertNoError(t, err)
+	_, err = f.Write([]byte(`{"op":"save","rid":"test.bo`))
+	AssertNoError(t, err)
+	AssertNoError(t, f.Close())
+
+	st, err = store.OpenFile(dir)
+	AssertNoError(t, err)
+	assertStoredModel(t, st, "test.book.1", `{"title":"A","author":""}`)
+	AssertNoError(t, st.LoadModel("test.book.2", storeBook{Title: "B"}))
+	AssertNoError(t, st.Close())
+
+	st, err = store.OpenFile(dir)
+	AssertNoError(t, err)
+	defer st.Close()
+	assertStoredModel(t, st, "test.book.1", `{"title":"A","author":""}`)
+	assertStoredModel(t, st, "test.book.2", `{"title":"B","author":""}`)
+}
@@ -0,0 +1,266 @@
+package test
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+	"github.com/jirenius/go-res/sqlres"
+)
+
+func newTestSQLTable() (*sqlres.Table, *FakeDB) {
+	db, fdb := NewFakeDB("book",
+		map[string]driver.Value{"id": int64(1), "title": "Animal Farm", "author": "George Orwell"},
+		map[string]driver.Value{"id": int64(2), "title": "Brave New World", "author": "Aldous Huxley"},
+		map[string]driver.Value{"id": int64(3), "title": "1984", "author": "George Orwell"},
+	)
+	tbl := sqlres.NewTable(db, sqlres.Config{
+		Table:      "book",
+		Columns:    []string{"title", "author"},
+		Model:      "test.book",
+		Collection: "test.books",
+	})
+	return tbl, fdb
+}
+
+// assertSQLQueryEvent asserts that the message is a query event, and that
+// query requests on the event respond with the queried collection.
+func assertSQLQueryEvent(t *testing.T, s *Session, m *Msg, query string, collection string) {
+	m.AssertSubject(t, "event.test.books.query")
+	qsubj, _ := m.PathPayload(t, "subject").(string)
+	inb := s.Request(qsubj, &request{Query: query})
+	s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":`+collection+`}}`))
+}
+
+func handleSQLTable(tbl *sqlres.Table) func(s *Session) {
+	return func(s *Session) {
+		s.Handle("book.$id", tbl.GetModel(), tbl.Set())
+		s.Handle("books", tbl.GetCollection(), tbl.New(), tbl.Delete())
+	}
+}
+
+// Test that the table get handlers respond with rows and references.
+func TestSQLTableGet(t *testing.T) {
+	tbl, _ := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"id":1,"title":"Animal Farm","author":"George Orwell"}}}`))
+		inb = s.Request("get.test.books", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":[{"rid":"test.book.1"},{"rid":"test.book.2"},{"rid":"test.book.3"}]}}`))
+		inb = s.Request("get.test.book.4", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+	})
+}
+
+// Test that queried collections are filtered, ordered, and limited, and
+// respond with the normalized query.
+func TestSQLTableQuery(t *testing.T) {
+	tbl, _ := newTestSQLTable()
+	tbl2 := []struct {
+		Query      string
+		Collection string
+		Normalized string
+	}{
+		{"author=George+Orwell", `[{"rid":"test.book.1"},{"rid":"test.book.3"}]`, "author=George+Orwell"},
+		{"order=title", `[{"rid":"test.book.3"},{"rid":"test.book.1"},{"rid":"test.book.2"}]`, "order=title"},
+		{"order=-id", `[{"rid":"test.book.3"},{"rid":"test.book.2"},{"rid":"test.book.1"}]`, "order=-id"},
+		{"order=title&limit=2&offset=1", `[{"rid":"test.book.1"},{"rid":"test.book.2"}]`, "limit=2&offset=1&order=title"},
+		{"limit=1&author=George%20Orwell&order=-title", `[{"rid":"test.book.1"}]`, "author=George+Orwell&limit=1&order=-title"},
+		{"title=Coraline", `[]`, "title=Coraline"},
+	}
+	for _, l := range tbl2 {
+		runTest(t, handleSQLTable(tbl), func(s *Session) {
+			inb := s.Request("get.test.books", &request{Query: l.Query})
+			s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":`+l.Collection+`,"query":"`+l.Normalized+`"}}`))
+		})
+	}
+}
+
+// Test that invalid queries respond with system.invalidQuery.
+func TestSQLTableInvalidQuery(t *testing.T) {
+	tbl, _ := newTestSQLTable()
+	for _, q := range []string{"foo=bar", "order=foo", "limit=-1", "limit=x", "offset=1", "title=a&title=b"} {
+		runTest(t, handleSQLTable(tbl), func(s *Session) {
+			inb := s.Request("get.test.books", &request{Query: q})
+			s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidQuery)
+		})
+	}
+}
+
+// Test that set updates the row, and sends a change event and a query
+// event for the collection.
+func TestSQLTableSet(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("call.test.book.1.set", &request{Params: json.RawMessage(`{"title":"Homage to Catalonia","author":"George Orwell"}`)})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.book.1.change").
+			AssertPayload(t, json.RawMessage(`{"title":"Homage to Catalonia"}`))
+		pm := s.GetParallelMsgs(t, 2)
+		pm.GetMsg(t, inb).AssertResult(t, nil)
+		assertSQLQueryEvent(t, s, pm.GetMsg(t, "event.test.books.query"), "order=title", `[{"rid":"test.book.3"},{"rid":"test.book.2"},{"rid":"test.book.1"}]`)
+		AssertEqual(t, "title", fdb.Row(1)["title"], "Homage to Catalonia")
+	})
+}
+
+// Test that set with invalid parameters, or on a missing row, responds
+// with an error without updating the table.
+func TestSQLTableSetErrors(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("call.test.book.1.set", &request{Params: json.RawMessage(`{"id":5}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("call.test.book.1.set", &request{Params: json.RawMessage(`{"title":{"foo":"bar"}}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("call.test.book.4.set", &request{Params: json.RawMessage(`{"title":"Coraline"}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		AssertEqual(t, "title", fdb.Row(1)["title"], "Animal Farm")
+	})
+}
+
+// Test that new inserts a row, and sends an add event and a query event.
+func TestSQLTableNew(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"title":"Coraline","author":"Neil Gaiman"}`)})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.add").
+			AssertPayload(t, json.RawMessage(`{"value":{"rid":"test.book.4"},"idx":3}`))
+		m := s.GetMsg(t)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"rid":"test.book.4"}}`))
+		assertSQLQueryEvent(t, s, m, "author=Neil+Gaiman", `[{"rid":"test.book.4"}]`)
+		AssertEqual(t, "author", fdb.Row(4)["author"], "Neil Gaiman")
+	})
+}
+
+// Test that new with an explicit key adds the reference at the index
+// matching the key order.
+func TestSQLTableNewWithKey(t *testing.T) {
+	db, _ := NewFakeDB("book",
+		map[string]driver.Value{"id": int64(1), "title": "Animal Farm"},
+		map[string]driver.Value{"id": int64(5), "title": "Coraline"},
+	)
+	tbl := sqlres.NewTable(db, sqlres.Config{Table: "book", Columns: []string{"title"}, Model: "test.book", Collection: "test.books"})
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"id":3,"title":"1984"}`)})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.add").
+			AssertPayload(t, json.RawMessage(`{"value":{"rid":"test.book.3"},"idx":1}`))
+		s.GetMsg(t).AssertSubject(t, "event.test.books.query")
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"rid":"test.book.3"}}`))
+	})
+}
+
+// Test that delete removes the row, and sends a remove event and a query
+// event on the collection, and a delete event on the model.
+func TestSQLTableDelete(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("call.test.books.delete", &request{Params: json.RawMessage(`{"id":2}`)})
+		pm := s.GetParallelMsgs(t, 4)
+		pm.GetMsg(t, "event.test.books.remove").AssertPayload(t, json.RawMessage(`{"idx":1}`))
+		pm.GetMsg(t, "event.test.book.2.delete")
+		pm.GetMsg(t, inb).AssertResult(t, nil)
+		assertSQLQueryEvent(t, s, pm.GetMsg(t, "event.test.books.query"), "author=Aldous+Huxley", `[]`)
+		AssertEqual(t, "row", fdb.Row(2) == nil, true)
+
+		inb = s.Request("call.test.books.delete", &request{Params: json.RawMessage(`{"id":2}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		inb = s.Request("call.test.books.delete", &request{Params: json.RawMessage(`{}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+	})
+}
+
+// Test that model resource names with integer keys not in canonical form
+// are not found.
+func TestSQLTableNonCanonicalKey(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		for _, rid := range []string{"test.book.01", "test.book.+1", "test.book.foo"} {
+			inb := s.Request("get."+rid, nil)
+			s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+			inb = s.Request("call."+rid+".set", &request{Params: json.RawMessage(`{"title":"Coraline"}`)})
+			s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		}
+		inb := s.Request("call.test.books.delete", &request{Params: json.RawMessage(`{"id":"1"}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		AssertEqual(t, "title", fdb.Row(1)["title"], "Animal Farm")
+	})
+}
+
+// Test that a table with a string key passes the keys as strings.
+func TestSQLTableStringKey(t *testing.T) {
+	db, fdb := NewFakeDB("book",
+		map[string]driver.Value{"id": "007", "title": "Casino Royale"},
+		map[string]driver.Value{"id": "5", "title": "Coraline"},
+	)
+	tbl := sqlres.NewTable(db, sqlres.Config{Table: "book", Columns: []string{"title"}, Model: "test.book", Collection: "test.books", StringKey: true})
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("get.test.book.007", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"model":{"id":"007","title":"Casino Royale"}}}`))
+		inb = s.Request("get.test.book.7", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		inb = s.Request("get.test.books", nil)
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"collection":[{"rid":"test.book.5"},{"rid":"test.book.007"}]}}`))
+
+		inb = s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"title":"Dune"}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"id":8,"title":"Dune"}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertErrorCode(t, res.CodeInvalidParams)
+		inb = s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"id":"dune","title":"Dune"}`)})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.books.add").
+			AssertPayload(t, json.RawMessage(`{"value":{"rid":"test.book.dune"},"idx":2}`))
+		s.GetMsg(t).AssertSubject(t, "event.test.books.query")
+		s.GetMsg(t).Equals(t, inb, json.RawMessage(`{"result":{"rid":"test.book.dune"}}`))
+
+		inb = s.Request("call.test.books.delete", &request{Params: json.RawMessage(`{"id":"007"}`)})
+		pm := s.GetParallelMsgs(t, 4)
+		pm.GetMsg(t, "event.test.books.remove").AssertPayload(t, json.RawMessage(`{"idx":1}`))
+		pm.GetMsg(t, "event.test.books.query")
+		pm.GetMsg(t, "event.test.book.007.delete")
+		pm.GetMsg(t, inb).AssertResult(t, nil)
+		AssertEqual(t, "row", fdb.Row("007") == nil, true)
+	})
+}
+
+// Test that database errors result in system.internalError responses.
+func TestSQLTableDatabaseError(t *testing.T) {
+	tbl, fdb := newTestSQLTable()
+	fdb.SetError(errors.New("connection lost"))
+	runTest(t, handleSQLTable(tbl), func(s *Session) {
+		inb := s.Request("get.test.book.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrInternalError)
+		inb = s.Request("get.test.books", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrInternalError)
+		inb = s.Request("call.test.books.new", &request{Params: json.RawMessage(`{"title":"Coraline"}`)})
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrInternalError)
+		if l := s.Logger().(*MemLogger).String(); !strings.Contains(l, "connection lost") {
+			t.Errorf("expected database error to be logged, but log was:\n%s", l)
+		}
+	})
+}
+
+// Test that NewTable panics on invalid configuration.
+func TestSQLTableInvalidConfig(t *testing.T) {
+	db, _ := NewFakeDB("book")
+	for _, c := range []sqlres.Config{
+		{Table: "book; DROP TABLE book", Model: "test.book"},
+		{Table: "book"},
+		{Table: "book", Model: "test.book", Columns: []string{"id"}},
+		{Table: "book", Model: "test.book", Columns: []string{"limit"}},
+		{Table: "book", Model: "test.book", Columns: []string{"title", "title"}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected NewTable to panic for config %+v", c)
+				}
+			}()
+			sqlres.NewTable(db, c)
+		}()
+	}
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// countingModelHandler returns a model get handler responding with the
+// resource name, counting the number of calls.
+func countingModelHandler(calls *int32) res.HandlerOption {
+	return res.GetModel(func(r res.ModelRequest) {
+		atomic.AddInt32(calls, 1)
+		r.Model(map[string]string{"rname": r.ResourceName()})
+	})
+}
+
+// withValue calls Value on the resource using With, and waits for the
+// callback to be called.
+func withValue(t *testing.T, s *Session, rid string, cb func(r res.Resource)) interface{} {
+	var v interface{}
+	done := make(chan struct{})
+	AssertNoError(t, s.With(rid, func(r res.Resource) {
+		defer close(done)
+		var err error
+		v, err = r.Value()
+		AssertNoError(t, err)
+		if cb != nil {
+			cb(r)
+		}
+	}))
+	select {
+	case <-done:
+	case <-time.After(timeoutDuration):
+		panic("test: timeout waiting for With callback")
+	}
+	return v
+}
+
+func assertCalls(t *testing.T, calls *int32, expected int32) {
+	if n := atomic.LoadInt32(calls); n != expected {
+		t.Errorf("expected get handler to be called %d time(s), but it was called %d time(s)", expected, n)
+	}
+}
+
+// Test that Value calls the get handler each time when no cache is set.
+func TestValueWithoutCache(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model", countingModelHandler(&calls))
+	}, func(s *Session) {
+		withValue(t, s, "test.model", nil)
+		withValue(t, s, "test.model", nil)
+		assertCalls(t, &calls, 2)
+	})
+}
+
+// Test that Value returns the cached value when a cache is set.
+func TestValueCache(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id", countingModelHandler(&calls), res.ValueCache(10, 0))
+	}, func(s *Session) {
+		v1 := withValue(t, s, "test.model.1", nil)
+		v2 := withValue(t, s, "test.model.1", nil)
+		AssertEqual(t, "value", v2, v1)
+		assertCalls(t, &calls, 1)
+		withValue(t, s, "test.model.1?q=foo", nil)
+		withValue(t, s, "test.model.2", nil)
+		assertCalls(t, &calls, 3)
+	})
+}
+
+// Test that sending events on a resource invalidates the cached values,
+// including those of query resources.
+func TestValueCacheInvalidatedByEvents(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model", countingModelHandler(&calls), res.ValueCache(10, 0))
+	}, func(s *Session) {
+		withValue(t, s, "test.model", nil)
+		withValue(t, s, "test.model?q=foo", func(r res.Resource) {
+			r.ChangeEvent(map[string]interface{}{"foo": "bar"})
+		})
+		s.GetMsg(t).AssertSubject(t, "event.test.model.change")
+		withValue(t, s, "test.model", func(r res.Resource) {
+			r.DeleteEvent()
+		})
+		s.GetMsg(t).AssertSubject(t, "event.test.model.delete")
+		withValue(t, s, "test.model", func(r res.Resource) {
+			r.ResetEvent()
+		})
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		withValue(t, s, "test.model", nil)
+		assertCalls(t, &calls, 5)
+	})
+}
+
+// Test that add and remove events invalidate the cached collection.
+func TestValueCacheInvalidatedByCollectionEvents(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("collection",
+			res.GetCollection(func(r res.CollectionRequest) {
+				atomic.AddInt32(&calls, 1)
+				r.Collection([]string{"foo"})
+			}),
+			res.ValueCache(10, 0),
+		)
+	}, func(s *Session) {
+		withValue(t, s, "test.collection", func(r res.Resource) {
+			r.AddEvent("bar", 1)
+		})
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.add")
+		withValue(t, s, "test.collection", func(r res.Resource) {
+			r.RemoveEvent(1)
+		})
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.remove")
+		withValue(t, s, "test.collection", nil)
+		assertCalls(t, &calls, 3)
+	})
+}
+
+// Test that Service.Reset and Service.ResetAll clear the cached values.
+func TestValueCacheClearedByReset(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model", countingModelHandler(&calls), res.ValueCache(10, 0))
+	}, func(s *Session) {
+		withValue(t, s, "test.model", nil)
+		s.Reset([]string{"test.other"}, nil)
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		withValue(t, s, "test.model", nil)
+		s.ResetAll()
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		withValue(t, s, "test.model", nil)
+		withValue(t, s, "test.model", nil)
+		assertCalls(t, &calls, 3)
+	})
+}
+
+// Test that the least recently used value is evicted when the cache is full.
+func TestValueCacheSizeLimit(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model.$id", countingModelHandler(&calls), res.ValueCache(2, 0))
+	}, func(s *Session) {
+		withValue(t, s, "test.model.1", nil)
+		withValue(t, s, "test.model.2", nil)
+		withValue(t, s, "test.model.1", nil)
+		withValue(t, s, "test.model.3", nil)
+		assertCalls(t, &calls, 3)
+		withValue(t, s, "test.model.1", nil)
+		assertCalls(t, &calls, 3)
+		withValue(t, s, "test.model.2", nil)
+		assertCalls(t, &calls, 4)
+	})
+}
+
+// Test that cached values expire after the time to live.
+func TestValueCacheTTL(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model", countingModelHandler(&calls), res.ValueCache(10, 200*time.Millisecond))
+	}, func(s *Session) {
+		withValue(t, s, "test.model", nil)
+		withValue(t, s, "test.model", nil)
+		assertCalls(t, &calls, 1)
+		time.Sleep(300 * time.Millisecond)
+		withValue(t, s, "test.model", nil)
+		assertCalls(t, &calls, 2)
+	})
+}
+
+// Test that errors from the get handler are not cached.
+func TestValueCacheSkipsErrors(t *testing.T) {
+	var calls int32
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.GetModel(func(r res.ModelRequest) {
+				atomic.AddInt32(&calls, 1)
+				r.NotFound()
+			}),
+			res.ValueCache(10, 0),
+		)
+	}, func(s *Session) {
+		for i := 0; i < 2; i++ {
+			done := make(chan struct{})
+			AssertNoError(t, s.With("test.model", func(r res.Resource) {
+				defer close(done)
+				_, err := r.Value()
+				AssertEqual(t, "error", err, res.ErrNotFound)
+			}))
+			<-done
+		}
+		assertCalls(t, &calls, 2)
+	})
+}
+
+// Test that ValueCache panics on a size less than 1.
+func TestValueCacheInvalidSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected ValueCache to panic, but it didn't")
+		}
+	}()
+	res.ValueCache(0, 0)
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+
+	res "github.com/jirenius/go-res"
+)
+
+func handleReferenceTracking(s *Session) {
+	s.SetReferenceTracking(true)
+	s.Handle("model.$id", res.GetModel(func(r res.ModelRequest) {
+		r.Model(map[string]interface{}{"name": "foo", "child": res.Ref("test.model.child")})
+	}))
+	s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+		if r.Query() != "" {
+			r.QueryCollection([]interface{}{res.Ref("test.model.1")}, r.Query())
+			return
+		}
+		r.Collection([]interface{}{res.Ref("test.model.1"), 42, res.Ref("test.model.2"), res.Ref("test.model.1")})
+	}))
+}
+
+// Test that references are not tracked unless enabled.
+func TestReferenceTrackingDisabled(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("collection", res.GetCollection(func(r res.CollectionRequest) {
+			r.Collection([]interface{}{res.Ref("test.model.1")})
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		AssertEqual(t, "References", s.References("test.collection"), []string(nil))
+		AssertEqual(t, "Referrers", s.Referrers("test.model.1"), []string(nil))
+	})
+}
+
+// Test that references in get responses are tracked.
+func TestReferenceTrackingGetResponses(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		inb = s.Request("get.test.collection", &request{Query: "limit=1"})
+		s.GetMsg(t).AssertSubject(t, inb)
+		inb = s.Request("get.test.model.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		AssertEqual(t, "References", s.References("test.collection"), []string{"test.model.1", "test.model.2"})
+		AssertEqual(t, "References", s.References("test.collection?limit=1"), []string{"test.model.1"})
+		AssertEqual(t, "References", s.References("test.model.1"), []string{"test.model.child"})
+		AssertEqual(t, "Referrers", s.Referrers("test.model.1"), []string{"test.collection", "test.collection?limit=1"})
+		AssertEqual(t, "Referrers", s.Referrers("test.model.child"), []string{"test.model.1"})
+		AssertEqual(t, "DanglingReferences", s.DanglingReferences(), []string(nil))
+	})
+}
+
+// Test that change, add, remove, and delete events update the tracked
+// references.
+func TestReferenceTrackingEvents(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		inb = s.Request("get.test.model.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		AssertNoError(t, s.With("test.model.1", func(r res.Resource) {
+			r.ChangeEvent(map[string]interface{}{"child": res.Ref("test.model.3"), "other": res.Ref("test.model.4")})
+			r.ChangeEvent(map[string]interface{}{"other": res.DeleteAction})
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.model.1.change")
+		s.GetMsg(t).AssertSubject(t, "event.test.model.1.change")
+		AssertEqual(t, "References", s.References("test.model.1"), []string{"test.model.3"})
+
+		AssertNoError(t, s.With("test.collection", func(r res.Resource) {
+			r.AddEvent(res.Ref("test.model.5"), 1)
+			r.RemoveEvent(0)
+			r.RemoveEvent(3)
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.add")
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.remove")
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.remove")
+		AssertEqual(t, "References", s.References("test.collection"), []string{"test.model.2", "test.model.5"})
+		AssertEqual(t, "Referrers", s.Referrers("test.model.1"), []string(nil))
+
+		AssertNoError(t, s.With("test.collection", func(r res.Resource) {
+			r.DeleteEvent()
+		}))
+		s.GetMsg(t).AssertSubject(t, "event.test.collection.delete")
+		AssertEqual(t, "References", s.References("test.collection"), []string(nil))
+		AssertEqual(t, "Referrers", s.Referrers("test.model.2"), []string(nil))
+	})
+}
+
+// Test that a system.reset event removes the tracked references of the
+// matching resources.
+func TestReferenceTrackingReset(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		inb = s.Request("get.test.model.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		s.Reset([]string{"test.model.$id"}, nil)
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		AssertEqual(t, "References", s.References("test.model.1"), []string(nil))
+		AssertEqual(t, "References", s.References("test.collection"), []string{"test.model.1", "test.model.2"})
+
+		s.ResetAll()
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		AssertEqual(t, "References", s.References("test.collection"), []string(nil))
+	})
+}
+
+// Test that a system.reset event sent by ResetEvent removes the tracked
+// references of the resource.
+func TestReferenceTrackingResetEvent(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.model.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		AssertNoError(t, s.With("test.model.1", func(r res.Resource) {
+			r.ResetEvent()
+		}))
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		AssertEqual(t, "References", s.References("test.model.1"), []string(nil))
+		AssertEqual(t, "Referrers", s.Referrers("test.model.child"), []string(nil))
+	})
+}
+
+// Test that the system.reset event sent when replacing a handler removes
+// the tracked references of the matching resources.
+func TestReferenceTrackingReplace(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.model.1", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		AssertNoError(t, s.Replace("model.$id", res.Handler{
+			GetModel: func(r res.ModelRequest) { r.NotFound() },
+		}))
+		s.GetMsg(t).AssertSubject(t, "system.reset")
+		AssertEqual(t, "References", s.References("test.model.1"), []string(nil))
+		AssertEqual(t, "Referrers", s.Referrers("test.model.child"), []string(nil))
+	})
+}
+
+// Test that only the most recently responded query resources are tracked.
+func TestReferenceTrackingQueryLimit(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		for i := 0; i <= 1024; i++ {
+			inb := s.Request("get.test.collection", &request{Query: "page=" + strconv.Itoa(i)})
+			s.GetMsg(t).AssertSubject(t, inb)
+		}
+		AssertEqual(t, "References", s.References("test.collection?page=0"), []string(nil))
+		AssertEqual(t, "References", s.References("test.collection?page=1"), []string{"test.model.1"})
+		AssertEqual(t, "References", s.References("test.collection?page=1024"), []string{"test.model.1"})
+		AssertEqual(t, "Referrers count", len(s.Referrers("test.model.1")), 1024)
+	})
+}
+
+// Test that references to resources with no registered handler are
+// reported as dangling.
+func TestReferenceTrackingDanglingReferences(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetReferenceTracking(true)
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.Model(map[string]interface{}{
+				"missing": res.Ref("test.missing"),
+				"self":    res.Ref("test.model"),
+				"other":   res.Ref("other.model"),
+			})
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		AssertEqual(t, "DanglingReferences", s.DanglingReferences(), []string{"test.missing"})
+	})
+}
+
+// Test that RemoveReferences sends remove events in descending index order
+// for the referring collections.
+func TestReferenceTrackingRemoveReferences(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+		inb = s.Request("get.test.collection", &request{Query: "limit=1"})
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		var idxs []int
+		s.RemoveReferences("test.model.1", func(r res.Resource, idx int) error {
+			AssertEqual(t, "ResourceName", r.ResourceName(), "test.collection")
+			idxs = append(idxs, idx)
+			return nil
+		})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.collection.remove").
+			AssertPayload(t, json.RawMessage(`{"idx":3}`))
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.collection.remove").
+			AssertPayload(t, json.RawMessage(`{"idx":0}`))
+		AssertEqual(t, "idxs", idxs, []int{3, 0})
+		AssertEqual(t, "Referrers", s.Referrers("test.model.1"), []string{"test.collection?limit=1"})
+	})
+}
+
+// Test that RemoveReferences sends no remove event for an index where the
+// callback returns an error.
+func TestReferenceTrackingRemoveReferencesWithError(t *testing.T) {
+	runTest(t, handleReferenceTracking, func(s *Session) {
+		inb := s.Request("get.test.collection", nil)
+		s.GetMsg(t).AssertSubject(t, inb)
+
+		s.RemoveReferences("test.model.1", func(r res.Resource, idx int) error {
+			if idx == 3 {
+				return errors.New("not removed")
+			}
+			return nil
+		})
+		s.GetMsg(t).
+			AssertSubject(t, "event.test.collection.remove").
+			AssertPayload(t, json.RawMessage(`{"idx":0}`))
+		AssertEqual(t, "References", s.References("test.collection"), []string{"test.model.1", "test.model.2"})
+	})
+}
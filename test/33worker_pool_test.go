@@ -0,0 +1,168 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// blockingModelHandler returns a model get handler that signals on started
+// when called, and waits for release before responding.
+func blockingModelHandler(started chan<- string, release <-chan struct{}) res.HandlerOption {
+	return res.GetModel(func(r res.ModelRequest) {
+		started <- r.ResourceName()
+		<-release
+		r.Model(map[string]string{"foo": "bar"})
+	})
+}
+
+func assertStarted(t *testing.T, started <-chan string, rname string) {
+	select {
+	case v := <-started:
+		AssertEqual(t, "started", v, rname)
+	case <-time.After(timeoutDuration):
+		t.Fatalf("expected handler for %s to be called, but it wasn't", rname)
+	}
+}
+
+// Test that a single worker handles requests for different resources one
+// at a time.
+func TestSetWorkerCount(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetWorkerCount(1)
+		s.Handle("model.$id", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		inb1 := s.Request("get.test.model.1", nil)
+		assertStarted(t, started, "test.model.1")
+		inb2 := s.Request("get.test.model.2", nil)
+		select {
+		case rname := <-started:
+			t.Fatalf("expected handler for %s not to be called while the single worker is busy", rname)
+		case <-time.After(50 * time.Millisecond):
+		}
+		release <- struct{}{}
+		s.GetMsg(t).AssertSubject(t, inb1)
+		assertStarted(t, started, "test.model.2")
+		release <- struct{}{}
+		s.GetMsg(t).AssertSubject(t, inb2)
+	})
+}
+
+// Test that requests exceeding the queue limit are responded to with
+// system.timeout when using OverloadTimeout.
+func TestSetQueueLimitWithOverloadTimeout(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueueLimit(1, res.OverloadTimeout)
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		inb1 := s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		inb2 := s.Request("get.test.model", nil)
+		inb3 := s.Request("get.test.model", nil)
+		s.GetMsg(t).AssertSubject(t, inb3).AssertError(t, res.ErrTimeout)
+		close(release)
+		s.GetMsg(t).AssertSubject(t, inb1).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+		s.GetMsg(t).AssertSubject(t, inb2).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+	})
+}
+
+// Test that requests exceeding the queue limit are responded to with the
+// busy error when using OverloadBusy.
+func TestSetQueueLimitWithOverloadBusy(t *testing.T) {
+	busy := &res.Error{Code: "test.busy", Message: "Busy"}
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueueLimit(1, res.OverloadBusy)
+		s.SetBusyError(busy)
+		s.Handle("model", blockingModelHandler(started, release))
+		s.Handle("other", res.GetModel(func(r res.ModelRequest) {
+			r.NotFound()
+		}))
+	}, func(s *Session) {
+		inb1 := s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		inb2 := s.Request("get.test.model", nil)
+		inb3 := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb3).AssertError(t, busy)
+		// Other resources are not affected
+		inb4 := s.Request("get.test.other", nil)
+		s.GetMsg(t).AssertSubject(t, inb4).AssertError(t, res.ErrNotFound)
+		close(release)
+		s.GetMsg(t).AssertSubject(t, inb1)
+		s.GetMsg(t).AssertSubject(t, inb2)
+	})
+}
+
+// Test that incoming requests are blocked, but not rejected, when the
+// queue limit is reached using OverloadBlock.
+func TestSetQueueLimitWithOverloadBlock(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueueLimit(1, res.OverloadBlock)
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		inb1 := s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		inb2 := s.Request("get.test.model", nil)
+		inb3 := s.Request("get.test.model", nil)
+		close(release)
+		for _, inb := range []string{inb1, inb2, inb3} {
+			s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+		}
+	})
+}
+
+// Test that the queue limit does not apply to callbacks queued using With.
+func TestSetQueueLimitIgnoresWith(t *testing.T) {
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueueLimit(1, res.OverloadTimeout)
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		done := make(chan struct{}, 2)
+		for i := 0; i < 2; i++ {
+			AssertNoError(t, s.With("test.model", func(r res.Resource) {
+				done <- struct{}{}
+			}))
+		}
+		close(release)
+		s.GetMsg(t).AssertSubject(t, inb)
+		for i := 0; i < 2; i++ {
+			select {
+			case <-done:
+			case <-time.After(timeoutDuration):
+				t.Fatal("expected With callback to be called, but it wasn't")
+			}
+		}
+	})
+}
+
+// Test that the worker pool options panic on invalid values.
+func TestWorkerPoolOptionsPanicOnInvalidValues(t *testing.T) {
+	tbl := []func(s *res.Service){
+		func(s *res.Service) { s.SetWorkerCount(0) },
+		func(s *res.Service) { s.SetInChannelSize(0) },
+		func(s *res.Service) { s.SetQueueLimit(-1, res.OverloadBlock) },
+		func(s *res.Service) { s.SetBusyError(nil) },
+	}
+	for i, f := range tbl {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected test %d to panic, but it didn't", i)
+				}
+			}()
+			f(res.NewService("test"))
+		}()
+	}
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that the request context has a deadline derived from the request
+// timeout, and is cancelled when the handler returns.
+func TestRequestContextDeadline(t *testing.T) {
+	ctxs := make(chan context.Context, 1)
+	runTest(t, func(s *Session) {
+		s.SetRequestTimeout(5 * time.Second)
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			ctx := r.Context()
+			AssertNoError(t, ctx.Err())
+			deadline, ok := ctx.Deadline()
+			AssertEqual(t, "ok", ok, true)
+			if d := time.Until(deadline); d <= 4*time.Second || d > 5*time.Second {
+				t.Errorf("expected deadline to be about 5 seconds from now, but it was %s", d)
+			}
+			ctxs <- ctx
+			r.NotFound()
+		}))
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrNotFound)
+		ctx := <-ctxs
+		select {
+		case <-ctx.Done():
+			AssertEqual(t, "Err", ctx.Err(), context.Canceled)
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected context to be done after handler returned")
+		}
+	})
+}
+
+// Test that Timeout extends the deadline of the request context.
+func TestRequestContextTimeoutExtendsDeadline(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.Timeout(time.Minute)
+			deadline, _ := r.Context().Deadline()
+			if d := time.Until(deadline); d <= 50*time.Second {
+				t.Errorf("expected deadline to be about 1 minute from now, but it was %s", d)
+			}
+			r.OK(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertRawPayload(t, []byte(`timeout:"60000"`))
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+	})
+}
+
+// Test that the request context is done with context.DeadlineExceeded
+// when the deadline is exceeded.
+func TestRequestContextDeadlineExceeded(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetRequestTimeout(10 * time.Millisecond)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			ctx := r.Context()
+			select {
+			case <-ctx.Done():
+			case <-time.After(timeoutDuration):
+				t.Fatal("expected context to be done when deadline exceeded")
+			}
+			AssertEqual(t, "Err", ctx.Err(), context.DeadlineExceeded)
+			r.Error(res.ErrTimeout)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrTimeout)
+	})
+}
+
+// Test that the context of a resource passed to With has no deadline, and
+// is cancelled on Shutdown.
+func TestWithContextCancelledOnShutdown(t *testing.T) {
+	ctxs := make(chan context.Context, 1)
+	runTestAsync(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.NotFound()
+		}))
+	}, func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			ctx := r.Context()
+			_, ok := ctx.Deadline()
+			AssertEqual(t, "ok", ok, false)
+			AssertNoError(t, ctx.Err())
+			ctxs <- ctx
+			done()
+		}))
+	})
+	ctx := <-ctxs
+	select {
+	case <-ctx.Done():
+	case <-time.After(timeoutDuration):
+		t.Fatal("expected context to be done after shutdown")
+	}
+}
+
+// Test that SetRequestTimeout panics on a duration not greater than zero.
+func TestSetRequestTimeoutPanicsOnInvalidDuration(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected SetRequestTimeout to panic, but it didn't")
+		}
+	}()
+	res.NewService("test").SetRequestTimeout(0)
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+type shutdownResult struct {
+	abandoned int
+	err       error
+}
+
+func shutdownContext(s *Session, ctx context.Context) <-chan shutdownResult {
+	ch := make(chan shutdownResult, 1)
+	go func() {
+		n, err := s.ShutdownContext(ctx)
+		ch <- shutdownResult{n, err}
+	}()
+	return ch
+}
+
+// Test that ShutdownContext waits for queued requests to be handled and
+// responded to before closing.
+func TestShutdownContextDrainsQueuedRequests(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		inb1 := s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		inb2 := s.Request("get.test.model", nil)
+
+		ch := shutdownContext(s, context.Background())
+		select {
+		case <-ch:
+			t.Fatal("expected ShutdownContext to wait for queued requests")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+
+		s.GetMsg(t).AssertSubject(t, inb1).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+		s.GetMsg(t).AssertSubject(t, inb2).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+		select {
+		case r := <-ch:
+			AssertNoError(t, r.err)
+			AssertEqual(t, "abandoned", r.abandoned, 0)
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected ShutdownContext to return, but it didn't")
+		}
+		if !s.IsClosed() {
+			t.Error("expected connection to be closed")
+		}
+	})
+}
+
+// Test that ShutdownContext closes the connection when the context is done,
+// reporting the number of abandoned requests.
+func TestShutdownContextAbandonsOnContextDone(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		s.Request("get.test.model", nil)
+		s.Request("get.test.model", nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ch := shutdownContext(s, ctx)
+
+		// Release the blocked handler once the connection is closed.
+		for !s.IsClosed() {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+
+		select {
+		case r := <-ch:
+			AssertEqual(t, "err", r.err, context.DeadlineExceeded)
+			AssertEqual(t, "abandoned", r.abandoned, 2)
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected ShutdownContext to return, but it didn't")
+		}
+		select {
+		case rname := <-started:
+			t.Errorf("expected abandoned request for %s not to be handled", rname)
+		default:
+		}
+	})
+}
+
+// Test that a request blocked by the OverloadBlock policy is not queued
+// once the service is shut down.
+func TestShutdownContextWithBlockedRequest(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetQueueLimit(1, res.OverloadBlock)
+		s.Handle("model", blockingModelHandler(started, release))
+	}, func(s *Session) {
+		s.Request("get.test.model", nil)
+		assertStarted(t, started, "test.model")
+		s.Request("get.test.model", nil)
+		s.Request("get.test.model", nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ch := shutdownContext(s, ctx)
+		for !s.IsClosed() {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+
+		select {
+		case r := <-ch:
+			AssertEqual(t, "err", r.err, context.DeadlineExceeded)
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected ShutdownContext to return, but it didn't")
+		}
+		select {
+		case rname := <-started:
+			t.Errorf("expected blocked request for %s not to be handled", rname)
+		default:
+		}
+	})
+}
+
+// Test that ShutdownContext returns an error if the service is not started.
+func TestShutdownContextWhenNotStarted(t *testing.T) {
+	_, err := res.NewService("test").ShutdownContext(context.Background())
+	if err == nil {
+		t.Error("expected ShutdownContext to return an error, but it didn't")
+	}
+}
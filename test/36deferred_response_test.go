@@ -0,0 +1,214 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that a deferred response is sent from another goroutine, and that
+// the worker is freed to handle other requests for the resource.
+func TestDeferredResponse(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.Handle("model",
+			res.GetModel(func(r res.ModelRequest) {
+				r.Model(map[string]string{"foo": "bar"})
+			}),
+			res.Call("method", func(r res.CallRequest) {
+				responders <- r.Defer()
+			}),
+		)
+	}, func(s *Session) {
+		inb1 := s.Request("call.test.model.method", nil)
+		p := <-responders
+		inb2 := s.Request("get.test.model", nil)
+		s.GetMsg(t).AssertSubject(t, inb2).AssertResult(t, map[string]interface{}{"model": map[string]string{"foo": "bar"}})
+		go p.OK("done")
+		s.GetMsg(t).AssertSubject(t, inb1).AssertResult(t, "done")
+	})
+}
+
+// Test that only the first deferred response is sent.
+func TestDeferredResponseSentOnce(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			p := r.Defer()
+			p.OK("first")
+			p.Error(res.ErrNotFound)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, "first")
+		inb = s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, "first")
+	})
+}
+
+// Test that the request timeout is extended automatically until the
+// deferred response is sent.
+func TestDeferredResponseExtendsTimeout(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.SetRequestTimeout(100 * time.Millisecond)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			responders <- r.Defer()
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		p := <-responders
+		for i := 0; i < 2; i++ {
+			s.GetMsg(t).AssertSubject(t, inb).AssertRawPayload(t, []byte(`timeout:"100"`))
+		}
+		p.OK(nil)
+		for {
+			m := s.GetMsg(t).AssertSubject(t, inb)
+			if string(m.RawPayload) != `timeout:"100"` {
+				m.AssertResult(t, nil)
+				break
+			}
+		}
+	})
+}
+
+// Test that a panic inside the handler after deferring the response sends
+// an error response.
+func TestDeferredResponseOnPanic(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.Defer()
+			panic(res.ErrMethodNotFound)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrMethodNotFound)
+	})
+}
+
+// Test that the request context is cancelled once the deferred response is
+// sent, and not when the handler returns.
+func TestDeferredResponseContext(t *testing.T) {
+	type deferred struct {
+		ctx context.Context
+		p   *res.Responder
+	}
+	ch := make(chan deferred, 1)
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			ch <- deferred{r.Context(), r.Defer()}
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		d := <-ch
+		select {
+		case <-d.ctx.Done():
+			t.Fatal("expected context not to be done before the deferred response is sent")
+		case <-time.After(20 * time.Millisecond):
+		}
+		d.p.OK(nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+		select {
+		case <-d.ctx.Done():
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected context to be done after the deferred response is sent")
+		}
+	})
+}
+
+// Test that Value waits for a deferred get response.
+func TestDeferredResponseValue(t *testing.T) {
+	runTestAsync(t, func(s *Session) {
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			p := r.Defer()
+			go p.Model(map[string]string{"foo": "bar"})
+		}))
+	}, func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			v, err := r.Value()
+			AssertNoError(t, err)
+			AssertEqual(t, "value", v, map[string]string{"foo": "bar"})
+			done()
+		}))
+	})
+}
+
+// Test that ShutdownContext waits for deferred responses to be sent.
+func TestDeferredResponseShutdownContext(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			responders <- r.Defer()
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		p := <-responders
+		ch := shutdownContext(s, context.Background())
+		select {
+		case <-ch:
+			t.Fatal("expected ShutdownContext to wait for the deferred response")
+		case <-time.After(50 * time.Millisecond):
+		}
+		p.OK(nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+		select {
+		case r := <-ch:
+			AssertNoError(t, r.err)
+		case <-time.After(timeoutDuration):
+			t.Fatal("expected ShutdownContext to return, but it didn't")
+		}
+	})
+}
+
+// Test that a TypedCall handler may defer the response, without the
+// returned values being sent.
+func TestDeferredResponseTypedCall(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.TypedCall("method", func(r res.CallRequest, p *typedParams) (*typedResult, error) {
+			responders <- r.Defer()
+			return nil, nil
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		p := <-responders
+		go p.OK(&typedResult{Double: 42})
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, map[string]interface{}{"double": 42})
+	})
+}
+
+// Test that deferred responses abandoned on shutdown are not waited for
+// when the service is restarted, and that sending them once the service
+// is stopped does not panic.
+func TestDeferredResponseAbandonedOnShutdown(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			responders <- r.Defer()
+		}))
+	}, func(s *Session) {
+		s.Request("call.test.model.method", nil)
+		p := <-responders
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		n, err := s.ShutdownContext(ctx)
+		AssertEqual(t, "err", err, context.DeadlineExceeded)
+		AssertEqual(t, "abandoned", n, 1)
+		<-s.cl
+
+		c := NewTestConn()
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			AssertNoError(t, s.Serve(c))
+		}()
+		c.GetMsg(t).AssertSubject(t, "system.reset")
+		n, err = s.ShutdownContext(context.Background())
+		AssertNoError(t, err)
+		AssertEqual(t, "abandoned", n, 0)
+		<-closed
+
+		p.OK(nil)
+	})
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	res "github.com/jirenius/go-res"
+)
+
+// Test that a system.timeout response is sent when a handler does not
+// respond within the service handler timeout, and that the late response
+// is ignored.
+func TestHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetHandlerTimeout(20 * time.Millisecond)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			<-release
+			r.OK("late")
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrTimeout)
+		if l := s.Logger().(*MemLogger).String(); !strings.Contains(l, "handler timeout: call request for test.model, method method") {
+			t.Errorf("expected handler timeout to be logged, but log was:\n%s", l)
+		}
+		close(release)
+		inb = s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, "late")
+	})
+}
+
+// Test that the HandlerTimeout option overrides the service handler
+// timeout for the resource pattern.
+func TestHandlerTimeoutOption(t *testing.T) {
+	responders := make(chan *res.Responder, 1)
+	runTest(t, func(s *Session) {
+		s.SetHandlerTimeout(time.Minute)
+		s.Handle("model",
+			res.HandlerTimeout(20*time.Millisecond),
+			res.GetModel(func(r res.ModelRequest) {
+				responders <- r.Defer()
+			}),
+		)
+	}, func(s *Session) {
+		inb := s.Request("get.test.model", nil)
+		p := <-responders
+		s.GetMsg(t).AssertSubject(t, inb).AssertError(t, res.ErrTimeout)
+		p.Model(map[string]string{"foo": "bar"})
+		// The deferred response is no longer pending
+		n, err := s.ShutdownContext(context.Background())
+		AssertNoError(t, err)
+		AssertEqual(t, "abandoned", n, 0)
+	})
+}
+
+// Test that Timeout extends the handler timeout.
+func TestHandlerTimeoutExtendedByTimeout(t *testing.T) {
+	runTest(t, func(s *Session) {
+		s.SetHandlerTimeout(20 * time.Millisecond)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.Timeout(time.Second)
+			time.Sleep(50 * time.Millisecond)
+			r.OK(nil)
+		}))
+	}, func(s *Session) {
+		inb := s.Request("call.test.model.method", nil)
+		s.GetMsg(t).AssertSubject(t, inb).AssertRawPayload(t, []byte(`timeout:"1000"`))
+		s.GetMsg(t).AssertSubject(t, inb).AssertResult(t, nil)
+	})
+}
+
+// Test that Value fails with ErrTimeout when a deferred get response is
+// not sent within the handler timeout.
+func TestHandlerTimeoutValue(t *testing.T) {
+	runTestAsync(t, func(s *Session) {
+		s.SetHandlerTimeout(20 * time.Millisecond)
+		s.Handle("model", res.GetModel(func(r res.ModelRequest) {
+			r.Defer()
+		}))
+	}, func(s *Session, done func()) {
+		AssertNoError(t, s.With("test.model", func(r res.Resource) {
+			v, err := r.Value()
+			AssertEqual(t, "value", v, nil)
+			AssertEqual(t, "err", err, res.ErrTimeout)
+			done()
+		}))
+	})
+}
+
+// Test that the handler timeout options panic on invalid durations.
+func TestHandlerTimeoutPanicsOnInvalidDuration(t *testing.T) {
+	tbl := []func(){
+		func() { res.NewService("test").SetHandlerTimeout(-1) },
+		func() { res.HandlerTimeout(0) },
+	}
+	for i, f := range tbl {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected test %d to panic, but it didn't", i)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+// Test that handler timeouts are stopped when the service is stopped.
+func TestHandlerTimeoutStoppedOnShutdown(t *testing.T) {
+	deferred := make(chan struct{})
+	runTest(t, func(s *Session) {
+		s.SetHandlerTimeout(20 * time.Millisecond)
+		s.Handle("model", res.Call("method", func(r res.CallRequest) {
+			r.Defer()
+			close(deferred)
+		}))
+	}, func(s *Session) {
+		s.Request("call.test.model.method", nil)
+		<-deferred
+		AssertNoError(t, s.Shutdown())
+		<-s.cl
+		time.Sleep(50 * time.Millisecond)
+		if l := s.Logger().(*MemLogger).String(); strings.Contains(l, "handler timeout") {
+			t.Errorf("expected handler timeout not to expire after shutdown, but log was:\n%s", l)
+		}
+	})
+}
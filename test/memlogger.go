@@ -43,6 +43,11 @@ func (l *MemLogger) Debugf(prefix string, format string, v ...interface{}) {
 	}
 }
 
+// IsDebug returns true if debug entries are written
+func (l *MemLogger) IsDebug() bool {
+	return l.debug
+}
+
 // Tracef writes a trace entry
 func (l *MemLogger) Tracef(prefix string, format string, v ...interface{}) {
 	if l.trace {
@@ -18,6 +18,7 @@ import (
 // MockConn mocks a client connection to a NATS server.
 type MockConn struct {
 	closed bool
+	pubErr error
 
 	reqs chan *Msg
 	mu   sync.Mutex
@@ -50,6 +51,13 @@ func (c *MockConn) Publish(subj string, payload []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return nats.ErrConnectionClosed
+	}
+	if c.pubErr != nil {
+		return c.pubErr
+	}
+
 	var p interface{}
 	var err error
 	if len(payload) > 0 {
@@ -69,6 +77,14 @@ func (c *MockConn) Publish(subj string, payload []byte) error {
 	return nil
 }
 
+// SetPublishError sets an error to be returned by Publish, without
+// publishing the message. A nil error makes Publish succeed again.
+func (c *MockConn) SetPublishError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pubErr = err
+}
+
 // ChanSubscribe subscribes to messages matching the subject pattern.
 func (c *MockConn) ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscription, error) {
 	c.mu.Lock()
@@ -89,6 +105,12 @@ func (c *MockConn) ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscrip
 	return &nats.Subscription{}, nil
 }
 
+// QueueSubscribeSyncWithChan subscribes to messages matching the subject pattern.
+// The queue group is ignored by the mock connection.
+func (c *MockConn) QueueSubscribeSyncWithChan(subj, queue string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return c.ChanSubscribe(subj, ch)
+}
+
 // Close will close the connection to the server.
 func (c *MockConn) Close() {
 	c.mu.Lock()
@@ -99,7 +121,6 @@ func (c *MockConn) Close() {
 	}
 
 	close(c.reqs)
-	c.reqs = nil
 	c.closed = true
 }
 
@@ -160,8 +181,14 @@ func (c *MockConn) AssertNoSubscription(t *testing.T, subj string) {
 // it will log it as a fatal error.
 func (c *MockConn) GetMsg(t *testing.T) *Msg {
 	select {
-	case r := <-c.reqs:
-		return r
+	case r, ok := <-c.reqs:
+		if ok {
+			return r
+		}
+		if t == nil {
+			panic("expected a message but connection is closed")
+		}
+		t.Fatal("expected a message but connection is closed")
 	case <-time.After(timeoutDuration):
 		if t == nil {
 			pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
@@ -0,0 +1,359 @@
+package test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeDriverName is the name of the fake in-process SQL driver.
+const fakeDriverName = "restest"
+
+var (
+	fakeDriverOnce sync.Once
+	fakeDBMu       sync.Mutex
+	fakeDBs        = make(map[string]*FakeDB)
+	fakeDBCount    int
+)
+
+// Statements supported by the fake driver.
+var (
+	reFakeSelectRow   = regexp.MustCompile(`^SELECT (.+) FROM (\w+) WHERE (\w+) = \?$`)
+	reFakeSelectCount = regexp.MustCompile(`^SELECT COUNT\(\*\) FROM (\w+) WHERE (\w+) < \?$`)
+	reFakeSelectKeys  = regexp.MustCompile(`^SELECT (\w+) FROM (\w+)(?: WHERE (.+?))? ORDER BY (\w+) (ASC|DESC)(?:, \w+)?( LIMIT \?)?( OFFSET \?)?$`)
+	reFakeUpdate      = regexp.MustCompile(`^UPDATE (\w+) SET (.+) WHERE (\w+) = \?$`)
+	reFakeInsert      = regexp.MustCompile(`^INSERT INTO (\w+) \((.+)\) VALUES \((.+)\)$`)
+	reFakeDelete      = regexp.MustCompile(`^DELETE FROM (\w+) WHERE (\w+) = \?$`)
+	reFakeAssign      = regexp.MustCompile(`^(\w+) = \?$`)
+)
+
+// FakeDB is an in-memory database for the fake SQL driver, holding a single
+// table with an id key column. It supports only the statements
+// generated by the sqlres package.
+type FakeDB struct {
+	mu     sync.Mutex
+	table  string
+	rows   []map[string]driver.Value
+	nextID int64
+	err    error // Error returned by all statements, if set
+}
+
+// NewFakeDB opens a new sql.DB using the fake driver, with a table
+// containing the rows. Each row must have an int64 or string "id" value.
+func NewFakeDB(table string, rows ...map[string]driver.Value) (*sql.DB, *FakeDB) {
+	fakeDriverOnce.Do(func() {
+		sql.Register(fakeDriverName, fakeDriver{})
+	})
+
+	fdb := &FakeDB{table: table, nextID: 1}
+	for _, row := range rows {
+		fdb.rows = append(fdb.rows, row)
+		if id, ok := row["id"].(int64); ok && id >= fdb.nextID {
+			fdb.nextID = id + 1
+		}
+	}
+
+	fakeDBMu.Lock()
+	fakeDBCount++
+	name := strconv.Itoa(fakeDBCount)
+	fakeDBs[name] = fdb
+	fakeDBMu.Unlock()
+
+	db, err := sql.Open(fakeDriverName, name)
+	if err != nil {
+		panic("test: failed to open fake database: " + err.Error())
+	}
+	return db, fdb
+}
+
+// SetError sets an error to be returned by all statements.
+// A nil error clears it.
+func (fdb *FakeDB) SetError(err error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	fdb.err = err
+}
+
+// Row returns a copy of the row with the id, or nil if not found.
+func (fdb *FakeDB) Row(id interface{}) map[string]driver.Value {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if i := fdb.indexOf(id); i >= 0 {
+		row := make(map[string]driver.Value, len(fdb.rows[i]))
+		for k, v := range fdb.rows[i] {
+			row[k] = v
+		}
+		return row
+	}
+	return nil
+}
+
+func (fdb *FakeDB) indexOf(id interface{}) int {
+	for i, row := range fdb.rows {
+		if fakeEqual(row["id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (fdb *FakeDB) exec(query string, args []driver.Value) (driver.Result, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if fdb.err != nil {
+		return nil, fdb.err
+	}
+
+	if m := reFakeUpdate.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[1]); err != nil {
+			return nil, err
+		}
+		assigns := strings.Split(m[2], ", ")
+		if len(args) != len(assigns)+1 {
+			return nil, errors.New("fake: wrong number of arguments")
+		}
+		i := fdb.indexOf(args[len(assigns)])
+		if i < 0 {
+			return driver.RowsAffected(0), nil
+		}
+		for j, a := range assigns {
+			am := reFakeAssign.FindStringSubmatch(a)
+			if am == nil {
+				return nil, fmt.Errorf("fake: invalid assignment: %s", a)
+			}
+			fdb.rows[i][am[1]] = args[j]
+		}
+		return driver.RowsAffected(1), nil
+	}
+
+	if m := reFakeInsert.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[1]); err != nil {
+			return nil, err
+		}
+		cols := strings.Split(m[2], ", ")
+		if len(args) != len(cols) {
+			return nil, errors.New("fake: wrong number of arguments")
+		}
+		row := make(map[string]driver.Value, len(cols)+1)
+		for i, col := range cols {
+			row[col] = args[i]
+		}
+		if row["id"] == nil {
+			row["id"] = fdb.nextID
+		}
+		if fdb.indexOf(row["id"]) >= 0 {
+			return nil, errors.New("fake: duplicate key")
+		}
+		id, _ := row["id"].(int64)
+		if id >= fdb.nextID {
+			fdb.nextID = id + 1
+		}
+		fdb.rows = append(fdb.rows, row)
+		return fakeResult{id: id, affected: 1}, nil
+	}
+
+	if m := reFakeDelete.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[1]); err != nil {
+			return nil, err
+		}
+		i := fdb.indexOf(args[0])
+		if i < 0 {
+			return driver.RowsAffected(0), nil
+		}
+		fdb.rows = append(fdb.rows[:i], fdb.rows[i+1:]...)
+		return driver.RowsAffected(1), nil
+	}
+
+	return nil, fmt.Errorf("fake: unsupported statement: %s", query)
+}
+
+func (fdb *FakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+	if fdb.err != nil {
+		return nil, fdb.err
+	}
+
+	if m := reFakeSelectCount.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[1]); err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, row := range fdb.rows {
+			if fakeLess(row[m[2]], args[0]) {
+				n++
+			}
+		}
+		return &fakeRows{cols: []string{"COUNT(*)"}, values: [][]driver.Value{{n}}}, nil
+	}
+
+	if m := reFakeSelectKeys.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[2]); err != nil {
+			return nil, err
+		}
+		var conds []string
+		if m[3] != "" {
+			conds = strings.Split(m[3], " AND ")
+		}
+		var rows []map[string]driver.Value
+	next:
+		for _, row := range fdb.rows {
+			for i, c := range conds {
+				cm := reFakeAssign.FindStringSubmatch(c)
+				if cm == nil {
+					return nil, fmt.Errorf("fake: invalid condition: %s", c)
+				}
+				if !fakeEqual(row[cm[1]], args[i]) {
+					continue next
+				}
+			}
+			rows = append(rows, row)
+		}
+		col, desc := m[4], m[5] == "DESC"
+		sort.SliceStable(rows, func(i, j int) bool {
+			a, b := rows[i][col], rows[j][col]
+			if fakeEqual(a, b) {
+				return fakeLess(rows[i]["id"], rows[j]["id"])
+			}
+			if desc {
+				return fakeLess(b, a)
+			}
+			return fakeLess(a, b)
+		})
+		argi := len(conds)
+		if m[6] != "" {
+			limit := int(args[argi].(int64))
+			offset := 0
+			if m[7] != "" {
+				offset = int(args[argi+1].(int64))
+			}
+			if offset > len(rows) {
+				offset = len(rows)
+			}
+			rows = rows[offset:]
+			if limit < len(rows) {
+				rows = rows[:limit]
+			}
+		}
+		values := make([][]driver.Value, len(rows))
+		for i, row := range rows {
+			values[i] = []driver.Value{row[m[1]]}
+		}
+		return &fakeRows{cols: []string{m[1]}, values: values}, nil
+	}
+
+	if m := reFakeSelectRow.FindStringSubmatch(query); m != nil {
+		if err := fdb.checkTable(m[2]); err != nil {
+			return nil, err
+		}
+		cols := strings.Split(m[1], ", ")
+		r := &fakeRows{cols: cols}
+		if i := fdb.indexOf(args[0]); i >= 0 {
+			vs := make([]driver.Value, len(cols))
+			for j, col := range cols {
+				vs[j] = fdb.rows[i][col]
+			}
+			r.values = [][]driver.Value{vs}
+		}
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("fake: unsupported query: %s", query)
+}
+
+func (fdb *FakeDB) checkTable(table string) error {
+	if table != fdb.table {
+		return fmt.Errorf("fake: no such table: %s", table)
+	}
+	return nil
+}
+
+// fakeEqual compares two values by their string representation.
+func fakeEqual(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// fakeLess compares two values numerically if both are integers, otherwise
+// by their string representation.
+func fakeLess(a, b interface{}) bool {
+	an, aerr := strconv.ParseInt(fmt.Sprint(a), 10, 64)
+	bn, berr := strconv.ParseInt(fmt.Sprint(b), 10, 64)
+	if aerr == nil && berr == nil {
+		return an < bn
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBMu.Lock()
+	defer fakeDBMu.Unlock()
+	fdb, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("fake: unknown database: %s", name)
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+type fakeConn struct {
+	db *FakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake: transactions not supported")
+}
+
+type fakeStmt struct {
+	db    *FakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.db.exec(s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeResult struct {
+	id       int64
+	affected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,168 @@
+package res
+
+import (
+	"sync"
+	"time"
+)
+
+// handlerTimeout responds with a system.timeout error if a handler, or its
+// deferred responder, does not respond within the handler timeout.
+type handlerTimeout struct {
+	s         *Service
+	mu        sync.Mutex
+	timer     *time.Timer
+	done      bool       // Flag telling if a response is sent, or the timeout expired
+	expired   bool       // Flag telling if the timeout expired before the response was deferred
+	responder *Responder // Responder of a deferred response
+	onExpire  func(deferred bool)
+}
+
+// SetHandlerTimeout sets the duration a handler, or the responder of a
+// deferred response, has to respond before a system.timeout error response
+// is sent and the handler is logged as timed out. Any later response is
+// ignored. Calling Timeout on the request extends the handler timeout.
+// Resource.Value fails with ErrTimeout when exceeded.
+//
+// A handler blocking the worker goroutine cannot be interrupted, and will
+// continue to block the worker for the resource.
+//
+// The setting may be overridden for a resource pattern with the
+// HandlerTimeout option. A duration of 0 means no handler timeout, which is
+// the default.
+//
+// Panics if d is less than 0, or if service is already started.
+func (s *Service) SetHandlerTimeout(d time.Duration) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if d < 0 {
+		panic("res: negative handler timeout")
+	}
+
+	s.handlerTimeout = d
+	return s
+}
+
+// HandlerTimeout sets the handler timeout for the resources matching the
+// pattern, overriding any timeout set by Service.SetHandlerTimeout.
+//
+// Panics if d is not greater than zero.
+func HandlerTimeout(d time.Duration) HandlerOption {
+	if d <= 0 {
+		panic("res: handler timeout not greater than zero")
+	}
+	return func(hs *Handler) {
+		hs.HandlerTimeout = d
+	}
+}
+
+// handlerTimeoutFor returns the handler timeout for the resources of a
+// handler. Zero means no timeout.
+func (s *Service) handlerTimeoutFor(hs *regHandler) time.Duration {
+	if hs.HandlerTimeout > 0 {
+		return hs.HandlerTimeout
+	}
+	return s.handlerTimeout
+}
+
+// newHandlerTimeout starts a new handler timeout, calling onExpire if no
+// response is sent within the duration d. The deferred flag tells if the
+// response was deferred, in which case the responder sends the
+// system.timeout error response.
+//
+// The timeout is stopped if the service is stopped.
+func (s *Service) newHandlerTimeout(d time.Duration, onExpire func(deferred bool)) *handlerTimeout {
+	t := &handlerTimeout{s: s, onExpire: onExpire}
+	s.mu.Lock()
+	s.timeouts[t] = true
+	s.mu.Unlock()
+	t.mu.Lock()
+	t.timer = time.AfterFunc(d, t.expire)
+	t.mu.Unlock()
+	return t
+}
+
+// stopHandlerTimeouts stops all handler timeouts, as the service is
+// stopped.
+func (s *Service) stopHandlerTimeouts() {
+	s.mu.Lock()
+	ts := make([]*handlerTimeout, 0, len(s.timeouts))
+	for t := range s.timeouts {
+		ts = append(ts, t)
+	}
+	s.mu.Unlock()
+	for _, t := range ts {
+		t.stop()
+	}
+}
+
+// reply stops the timeout as a response is sent. Returns false if the
+// timeout has already expired, and the response should be ignored.
+func (t *handlerTimeout) reply() bool {
+	t.mu.Lock()
+	t.done = true
+	t.timer.Stop()
+	expired := t.expired
+	t.mu.Unlock()
+	t.remove()
+	return !expired
+}
+
+// stop stops the timeout once the handler is done without responding, as
+// when the request is handled by another service.
+func (t *handlerTimeout) stop() {
+	t.mu.Lock()
+	t.done = true
+	t.timer.Stop()
+	t.mu.Unlock()
+	t.remove()
+}
+
+// remove removes the timeout from the service once it is done.
+func (t *handlerTimeout) remove() {
+	t.s.mu.Lock()
+	delete(t.s.timeouts, t)
+	t.s.mu.Unlock()
+}
+
+// extend resets the timeout to expire after the duration d, unless it has
+// already expired.
+func (t *handlerTimeout) extend(d time.Duration) {
+	t.mu.Lock()
+	if !t.done {
+		t.timer.Reset(d)
+	}
+	t.mu.Unlock()
+}
+
+// deferTo sets the responder of a deferred response, which is to send the
+// system.timeout error response if the timeout expires. Returns false if
+// the timeout has already expired.
+func (t *handlerTimeout) deferTo(p *Responder) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expired {
+		return false
+	}
+	t.responder = p
+	return true
+}
+
+// expire is called by the timer when the timeout expires.
+func (t *handlerTimeout) expire() {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	p := t.responder
+	t.expired = p == nil
+	t.mu.Unlock()
+	t.remove()
+
+	t.onExpire(p != nil)
+	if p != nil {
+		p.Error(ErrTimeout)
+	}
+}
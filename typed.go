@@ -0,0 +1,139 @@
+package res
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+var (
+	callRequestType = reflect.TypeOf((*CallRequest)(nil)).Elem()
+	newRequestType  = reflect.TypeOf((*NewRequest)(nil)).Elem()
+	authRequestType = reflect.TypeOf((*AuthRequest)(nil)).Elem()
+	errorType       = reflect.TypeOf((*error)(nil)).Elem()
+	refType         = reflect.TypeOf(Ref(""))
+)
+
+// typedFunc is a validated function value used by typed handlers.
+type typedFunc struct {
+	fn    reflect.Value
+	ptype reflect.Type // Type of the params argument
+}
+
+// TypedCall sets a handler for resource call requests, where the
+// parameters are unmarshaled into the second argument of fn, and the
+// returned result or error is sent as response.
+//
+// The function, fn, must be of the type:
+//  func(r CallRequest, p *Params) (*Result, error)
+// where Params and Result may be any types that unmarshals from and marshals
+// into JSON. If the parameters fail to unmarshal, or fail validation by
+// ValidateParams, a system.invalidParams error is sent. If the returned error is not nil, it is sent as the
+// response, converted with ToError. Otherwise the result is sent with OK.
+// If fn has already sent a response, the returned values are ignored.
+//
+// Panics if fn is not a function of the above type, or in the same
+// cases as Call.
+func TypedCall(method string, fn interface{}) HandlerOption {
+	tf := newTypedFunc(fn, callRequestType, nil)
+	return Call(method, func(r CallRequest) {
+		result, err := tf.call(r, r.RawParams())
+		typedReply(r, result, err, r.Error, r.OK)
+	})
+}
+
+// TypedNew sets a handler for new resource requests, where the parameters
+// are unmarshaled into the second argument of fn, and the returned
+// resource reference or error is sent as response.
+//
+// The function, fn, must be of the type:
+//  func(r NewRequest, p *Params) (Ref, error)
+// The parameters and returned error are handled as for TypedCall.
+// Otherwise the returned reference is sent with New.
+//
+// Panics if fn is not a function of the above type, or in the same
+// cases as New.
+func TypedNew(fn interface{}) HandlerOption {
+	tf := newTypedFunc(fn, newRequestType, refType)
+	return New(func(r NewRequest) {
+		result, err := tf.call(r, r.RawParams())
+		typedReply(r, result, err, r.Error, func(v interface{}) {
+			r.New(v.(Ref))
+		})
+	})
+}
+
+// TypedAuth sets a handler for resource auth requests, where the
+// parameters are unmarshaled into the second argument of fn, and the
+// returned result or error is sent as response.
+//
+// The function, fn, must be of the type:
+//  func(r AuthRequest, p *Params) (*Result, error)
+// The parameters, result, and error are handled as for TypedCall.
+//
+// Panics if fn is not a function of the above type, or in the same
+// cases as Auth.
+func TypedAuth(method string, fn interface{}) HandlerOption {
+	tf := newTypedFunc(fn, authRequestType, nil)
+	return Auth(method, func(r AuthRequest) {
+		result, err := tf.call(r, r.RawParams())
+		typedReply(r, result, err, r.Error, r.OK)
+	})
+}
+
+// newTypedFunc validates that fn is a function taking a request of type
+// rtyp and a params value, and returning a result and an error.
+// If restyp is not nil, the result must be of that type.
+func newTypedFunc(fn interface{}, rtyp reflect.Type, restyp reflect.Type) typedFunc {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() {
+		panic("res: nil typed handler function")
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Func ||
+		t.NumIn() != 2 || t.In(0) != rtyp ||
+		t.NumOut() != 2 || t.Out(1) != errorType ||
+		(restyp != nil && t.Out(0) != restyp) {
+		panic("res: invalid typed handler function: " + t.String())
+	}
+	return typedFunc{fn: v, ptype: t.In(1)}
+}
+
+// call unmarshals the params and calls the function.
+// If unmarshaling fails, a system.invalidParams error is returned.
+func (tf typedFunc) call(r interface{}, params json.RawMessage) (interface{}, error) {
+	var p reflect.Value
+	if tf.ptype.Kind() == reflect.Ptr {
+		p = reflect.New(tf.ptype.Elem())
+	} else {
+		p = reflect.New(tf.ptype)
+	}
+	if len(params) > 0 {
+		err := json.Unmarshal(params, p.Interface())
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+	}
+	if err := ValidateParams(p.Interface()); err != nil {
+		return nil, err
+	}
+	if tf.ptype.Kind() != reflect.Ptr {
+		p = p.Elem()
+	}
+	out := tf.fn.Call([]reflect.Value{reflect.ValueOf(r), p})
+	err, _ := out[1].Interface().(error)
+	return out[0].Interface(), err
+}
+
+// typedReply calls errf with the error, if not nil, or else calls ok with
+// the result. Nothing is sent if the request already has been responded to,
+// or if the response has been deferred.
+func typedReply(r interface{}, result interface{}, err error, errf func(*Error), ok func(interface{})) {
+	if req, isReq := r.(*Request); isReq && (req.replied || req.responder != nil) {
+		return
+	}
+	if err != nil {
+		errf(ToError(err))
+		return
+	}
+	ok(result)
+}
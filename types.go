@@ -16,6 +16,17 @@ const (
 	rtypeCollection
 )
 
+// String returns the name of the resource type.
+func (t rtype) String() string {
+	switch t {
+	case rtypeModel:
+		return "model"
+	case rtypeCollection:
+		return "collection"
+	}
+	return ""
+}
+
 var refPrefix = []byte(`{"rid":`)
 
 const refSuffix = '}'
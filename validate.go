@@ -0,0 +1,289 @@
+package res
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValidationError describes a parameter that failed validation.
+// A list of validation errors is set as Data on system.invalidParams
+// errors caused by failed validation.
+type ValidationError struct {
+	// Field is the dot separated path to the invalid value.
+	// Empty if the parameters as a whole are invalid.
+	Field string `json:"field"`
+
+	// Message describes why the value is invalid.
+	Message string `json:"message"`
+}
+
+// A fieldRule holds the parsed validation rules of a struct field.
+type fieldRule struct {
+	idx       int
+	name      string
+	required  bool
+	omitEmpty bool
+	min       *float64
+	max       *float64
+	minLen    int
+	maxLen    int // -1 means no limit
+	pattern   *regexp.Regexp
+	enum      []string
+}
+
+var (
+	ruleCache   = make(map[reflect.Type][]fieldRule)
+	ruleCacheMu sync.Mutex
+)
+
+// ValidateParams validates the struct value p, or the struct p points to,
+// using the rules of the res struct tags. It returns nil if p is valid,
+// otherwise a system.invalidParams *Error with a []ValidationError as
+// Data.
+//
+// The tag value is a comma separated list of rules:
+//  required   - value must not be the zero value, or a nil pointer
+//  omitempty  - zero values are only validated by the required rule
+//  min=<n>    - number must be greater than or equal to n
+//  max=<n>    - number must be less than or equal to n
+//  minlen=<n> - length of string, slice, or map must be at least n
+//  maxlen=<n> - length of string, slice, or map must be at most n
+//  enum=<a|b> - value must be one of the pipe separated values
+//  pattern=<regexp> - string must match the regular expression.
+//                     Must be the last rule, as it may contain commas.
+//
+// Nested structs, and slices of structs, are validated recursively.
+// Nil pointers, and zero values of fields with the omitempty rule, are
+// only validated by the required rule. Other zero values, such as empty
+// strings or 0, are validated by all rules.
+//
+// ValidateParams panics if a tag contains an invalid rule.
+//
+// ValidateParams is called by Request.ParseParams and the typed handlers
+// after unmarshaling the parameters.
+func ValidateParams(p interface{}) error {
+	var errs []ValidationError
+	validateValue(reflect.ValueOf(p), "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &Error{Code: CodeInvalidParams, Message: "Invalid parameters", Data: errs}
+}
+
+// validateValue validates structs, and slices or arrays of structs,
+// appending any validation errors to errs.
+func validateValue(v reflect.Value, path string, errs *[]ValidationError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, fr := range structRules(v.Type()) {
+			fr.validate(v.Field(fr.idx), joinField(path, fr.name), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), joinField(path, strconv.Itoa(i)), errs)
+		}
+	}
+}
+
+// structRules returns the cached field rules for the struct type t.
+func structRules(t reflect.Type) []fieldRule {
+	ruleCacheMu.Lock()
+	frs, ok := ruleCache[t]
+	ruleCacheMu.Unlock()
+	if ok {
+		return frs
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // Unexported field
+		}
+		name := f.Name
+		if jt := strings.Split(f.Tag.Get("json"), ",")[0]; jt == "-" {
+			continue
+		} else if jt != "" {
+			name = jt
+		}
+		fr := fieldRule{idx: i, name: name, maxLen: -1}
+		if tag, ok := f.Tag.Lookup("res"); ok {
+			fr.parse(tag, t.Name()+"."+f.Name)
+		}
+		frs = append(frs, fr)
+	}
+
+	ruleCacheMu.Lock()
+	ruleCache[t] = frs
+	ruleCacheMu.Unlock()
+	return frs
+}
+
+// parse parses a res tag. It panics on invalid rules.
+func (fr *fieldRule) parse(tag string, field string) {
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "pattern=") {
+			rule, tag = tag, ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		key, val := rule, ""
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			key, val = rule[:i], rule[i+1:]
+		}
+
+		var err error
+		switch key {
+		case "required":
+			fr.required = true
+		case "omitempty":
+			fr.omitEmpty = true
+		case "min":
+			fr.min, err = parseFloatRule(val)
+		case "max":
+			fr.max, err = parseFloatRule(val)
+		case "minlen":
+			fr.minLen, err = strconv.Atoi(val)
+		case "maxlen":
+			fr.maxLen, err = strconv.Atoi(val)
+		case "enum":
+			fr.enum = strings.Split(val, "|")
+		case "pattern":
+			fr.pattern, err = regexp.Compile(val)
+		case "":
+		default:
+			err = fmt.Errorf("unknown rule %#v", key)
+		}
+		if err != nil {
+			panic("res: invalid res tag on " + field + ": " + err.Error())
+		}
+	}
+}
+
+func parseFloatRule(s string) (*float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// validate validates the field value v, appending any validation errors
+// to errs.
+func (fr *fieldRule) validate(v reflect.Value, path string, errs *[]ValidationError) {
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, ValidationError{Field: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if isZero(v) {
+		if fr.required {
+			fail("is required")
+			return
+		}
+		if fr.omitEmpty {
+			return
+		}
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if fr.min != nil || fr.max != nil {
+		var n float64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		default:
+			panic("res: min and max rules are only valid on numbers: " + path)
+		}
+		if fr.min != nil && n < *fr.min {
+			fail("must be at least %v", *fr.min)
+		}
+		if fr.max != nil && n > *fr.max {
+			fail("must be at most %v", *fr.max)
+		}
+	}
+
+	if fr.minLen > 0 || fr.maxLen >= 0 {
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		default:
+			panic("res: minlen and maxlen rules are only valid on strings, slices, and maps: " + path)
+		}
+		l := v.Len()
+		if v.Kind() == reflect.String {
+			l = len([]rune(v.String()))
+		}
+		if l < fr.minLen {
+			fail("must have a length of at least %d", fr.minLen)
+		}
+		if fr.maxLen >= 0 && l > fr.maxLen {
+			fail("must have a length of at most %d", fr.maxLen)
+		}
+	}
+
+	if fr.enum != nil {
+		s := fmt.Sprint(v.Interface())
+		found := false
+		for _, e := range fr.enum {
+			if e == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of: %s", strings.Join(fr.enum, ", "))
+		}
+	}
+
+	if fr.pattern != nil {
+		if v.Kind() != reflect.String {
+			panic("res: pattern rule is only valid on strings: " + path)
+		}
+		if !fr.pattern.MatchString(v.String()) {
+			fail("must match pattern %s", fr.pattern)
+		}
+	}
+
+	validateValue(v, path, errs)
+}
+
+// isZero reports whether v is the zero value for its type.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	case reflect.Array, reflect.Struct:
+		return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+	}
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+// joinField joins a field path and a field name with a dot separator.
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -1,11 +1,134 @@
 package res
 
+import nats "github.com/nats-io/go-nats"
+
+// OverloadPolicy determines how an incoming request is handled when the
+// work queue of its resource, or group, has reached the queue limit.
+type OverloadPolicy int
+
+// Overload policies
+const (
+	// OverloadBlock blocks the handling of incoming requests until there is
+	// room in the queue. As incoming requests are buffered in the in
+	// channel, and then by the NATS connection, a blocked queue may cause
+	// requests to be dropped as a slow consumer.
+	OverloadBlock OverloadPolicy = iota
+
+	// OverloadTimeout responds to the request with a system.timeout error.
+	OverloadTimeout
+
+	// OverloadBusy responds to the request with the error set by
+	// SetBusyError.
+	OverloadBusy
+)
+
+// errBusy is the default error response used by the OverloadBusy policy.
+var errBusy = &Error{Code: CodeInternalError, Message: "Internal error: service busy"}
+
+// errShutdown is the error response to requests blocked by the OverloadBlock
+// policy when the service is shut down.
+var errShutdown = &Error{Code: CodeInternalError, Message: "Internal error: service shutting down"}
+
 type work struct {
 	s     *Service
 	wid   string   // Worker ID for the work queue
 	queue []func() // Callback queue
 }
 
+// SetWorkerCount sets the number of worker goroutines handling requests
+// and callbacks. Defaults to 32.
+//
+// Panics if n is less than 1, or if service is already started.
+func (s *Service) SetWorkerCount(n int) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if n < 1 {
+		panic("res: worker count less than 1")
+	}
+
+	s.workerCount = n
+	return s
+}
+
+// SetInChannelSize sets the size of the channel buffering incoming
+// requests from NATS Server before they are queued for a worker.
+// Defaults to 256.
+//
+// Panics if n is less than 1, or if service is already started.
+func (s *Service) SetInChannelSize(n int) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if n < 1 {
+		panic("res: in channel size less than 1")
+	}
+
+	s.inChannelSize = n
+	return s
+}
+
+// SetQueueLimit sets the maximum number of incoming requests queued for
+// a single resource, or group, waiting to be handled. Once the limit is
+// reached, any further requests are handled according to the overload
+// policy. A limit of 0 means no limit, which is the default.
+//
+// The limit does not apply to callbacks queued with With or WithTx, which
+// are always queued.
+//
+// With the OverloadBlock policy, a full queue stops the handling of all
+// incoming requests, not only those for the resource. The requests are
+// instead buffered by the NATS connection, which may drop them, and
+// disconnect the service, as a slow consumer. Use OverloadTimeout or
+// OverloadBusy unless the handlers are known to keep up. Requests blocked
+// when the service is shut down get an internal error response.
+//
+// Panics if limit is less than 0, or if service is already started.
+func (s *Service) SetQueueLimit(limit int, policy OverloadPolicy) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if limit < 0 {
+		panic("res: queue limit less than 0")
+	}
+
+	s.queueLimit = limit
+	s.overload = policy
+	return s
+}
+
+// SetBusyError sets the error response used by the OverloadBusy policy.
+// Defaults to a system.internalError with the message "Internal error:
+// service busy".
+//
+// Panics if err is nil, or if service is already started.
+func (s *Service) SetBusyError(err *Error) *Service {
+	if s.nc != nil {
+		panic("res: service already started")
+	}
+	if err == nil {
+		panic("res: busy error is nil")
+	}
+
+	s.busyErr = err
+	return s
+}
+
+// overloaded responds to the incoming request, m, according to the
+// overload policy.
+func (s *Service) overloaded(m *nats.Msg, wid string) {
+	s.Debugf("queue limit reached for %s, rejecting request %s", wid, m.Subject)
+	r := &Request{
+		resource: resource{s: s},
+		msg:      m,
+	}
+	if s.overload == OverloadTimeout {
+		r.error(ErrTimeout)
+	} else {
+		r.error(s.busyErr)
+	}
+}
+
 // startWorker starts a new resource worker that will listen for resources to
 // process requests on.
 func (s *Service) startWorker(ch chan *work) {
@@ -17,13 +140,16 @@ func (s *Service) startWorker(ch chan *work) {
 
 func (w *work) processQueue() {
 	var f func()
-	idx := 0
 
 	w.s.mu.Lock()
-	for len(w.queue) > idx {
-		f = w.queue[idx]
+	for len(w.queue) > 0 {
+		f = w.queue[0]
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		if w.s.queueLimit > 0 {
+			w.s.queueCond.Broadcast()
+		}
 		w.s.mu.Unlock()
-		idx++
 		f()
 		w.s.mu.Lock()
 	}